@@ -0,0 +1,36 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The all notifier bundles every notifier in this repo into a single binary and picks the implementation for each
+// config based on its `kind`.
+package main
+
+import (
+	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+	log "github.com/golang/glog"
+
+	// Register every notifier kind.
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/bigquery/bigquerynotifier"
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/githubissues/githubissuesnotifier"
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/googlechat/googlechatnotifier"
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/http/httpnotifier"
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/slack/slacknotifier"
+	_ "github.com/GoogleCloudPlatform/cloud-build-notifiers/smtp/smtpnotifier"
+)
+
+func main() {
+	if err := notifiers.MainFromRegistry(); err != nil {
+		log.Fatalf("fatal error: %v", err)
+	}
+}
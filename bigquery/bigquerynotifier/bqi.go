@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package bigquerynotifier
 
 import "context"
 
@@ -24,4 +24,5 @@ type bq interface {
 	EnsureDataset(ctx context.Context, datasetName string) error
 	EnsureTable(ctx context.Context, tableName string) error
 	WriteRow(ctx context.Context, r *bqRow) error
+	Close() error
 }
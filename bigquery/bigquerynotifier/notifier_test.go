@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package bigquerynotifier
 
 import (
 	"context"
@@ -63,6 +63,7 @@ func (ml *fakeLayer) MediaType() (types.MediaType, error) {
 type fakeBQ struct {
 	validSchema bool
 	writtenRows []*bqRow
+	closed      bool
 }
 
 type fakeBQFactory struct {
@@ -159,12 +160,18 @@ func (bq *fakeBQ) WriteRow(ctx context.Context, row *bqRow) error {
 	return nil
 }
 
+func (bq *fakeBQ) Close() error {
+	bq.closed = true
+	return nil
+}
+
 func TestSetUp(t *testing.T) {
 
 	for _, tc := range []struct {
-		name    string
-		cfg     *notifiers.Config
-		wantErr bool
+		name     string
+		cfg      *notifiers.Config
+		template string
+		wantErr  bool
 	}{{
 		name: "valid config",
 		cfg: &notifiers.Config{
@@ -241,10 +248,24 @@ func TestSetUp(t *testing.T) {
 			},
 		},
 		wantErr: true,
+	}, {
+		name: "bad template",
+		cfg: &notifiers.Config{
+			Spec: &notifiers.Spec{
+				Notification: &notifiers.Notification{
+					Filter: `build.build_trigger_id == "123e4567-e89b-12d3-a456-426614174000" `,
+					Delivery: map[string]interface{}{
+						"table": tableURI,
+					},
+				},
+			},
+		},
+		template: "{{.Build.Status",
+		wantErr:  true,
 	}} {
 		t.Run(tc.name, func(t *testing.T) {
 			n := &bqNotifier{bqf: &fakeBQFactory{&fakeBQ{}}}
-			err := n.SetUp(context.Background(), tc.cfg, "", nil, nil)
+			err := n.SetUp(context.Background(), tc.cfg, tc.template, nil, nil)
 			if err != nil {
 				if tc.wantErr {
 					t.Logf("got expected error: %v", err)
@@ -616,6 +637,32 @@ func TestSendNotification(t *testing.T) {
 	}
 }
 
+func TestClose(t *testing.T) {
+	if err := new(bqNotifier).Close(context.Background()); err != nil {
+		t.Errorf("Close() before SetUp got unexpected error: %v", err)
+	}
+
+	fakeBQ := &fakeBQ{}
+	n := &bqNotifier{bqf: &fakeBQFactory{fakeBQ}}
+	cfg := &notifiers.Config{
+		Spec: &notifiers.Spec{
+			Notification: &notifiers.Notification{
+				Filter:   `build.status == Build.Status.SUCCESS`,
+				Delivery: map[string]interface{}{"table": tableURI},
+			},
+		},
+	}
+	if err := n.SetUp(context.Background(), cfg, "{{.Build.Status}}", nil, nil); err != nil {
+		t.Fatalf("SetUp(%v) got unexpected error: %v", cfg, err)
+	}
+	if err := n.Close(context.Background()); err != nil {
+		t.Errorf("Close() got unexpected error: %v", err)
+	}
+	if !fakeBQ.closed {
+		t.Error("Close() did not close the BigQuery client")
+	}
+}
+
 func TestGetImageSize(t *testing.T) {
 	for _, tc := range []struct {
 		name      string
@@ -0,0 +1,199 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package githubissuesnotifier implements a Cloud Build notifier that files GitHub issues for Builds.
+package githubissuesnotifier
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+)
+
+const (
+	githubTokenSecretName = "githubToken"
+	githubApiEndpoint     = "https://api.github.com/repos"
+)
+
+// Kind is the Config `kind` that the GitHub Issues notifier is registered under.
+const Kind = "GitHubIssuesNotifier"
+
+// deliverySchema is the JSON Schema for the `delivery` of `cloud-build-notifiers/v2` configs of this Kind.
+//
+//go:embed delivery.schema.json
+var deliverySchema []byte
+
+func init() {
+	notifiers.Register(Kind, New)
+	notifiers.RegisterDeliverySchema(Kind, deliverySchema)
+}
+
+// New returns a new GitHub Issues notifier that has not been set up yet.
+func New() notifiers.Notifier {
+	return new(githubissuesNotifier)
+}
+
+type githubissuesNotifier struct {
+	filter      notifiers.EventFilter
+	tmpl        *template.Template
+	githubToken string
+	githubRepo  string
+
+	br    notifiers.BindingResolver
+	retry *notifiers.RetryPolicy
+}
+
+type githubissuesMessage struct {
+	Title string              `json:"title"`
+	Body  *notifiers.Template `json:"body"`
+}
+
+func (g *githubissuesNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, issueTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
+	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
+	if err != nil {
+		return fmt.Errorf("failed to make a CEL predicate: %w", err)
+	}
+	g.filter = prd
+
+	rp, err := notifiers.NewRetryPolicy(cfg.Spec.Notification.Retry)
+	if err != nil {
+		return fmt.Errorf("failed to configure retries: %w", err)
+	}
+	g.retry = rp
+	g.br = br
+
+	repo, ok := cfg.Spec.Notification.Delivery["githubRepo"].(string)
+	if !ok {
+		return fmt.Errorf("expected delivery config %v to have string field `githubRepo`", cfg.Spec.Notification.Delivery)
+	}
+	g.githubRepo = repo
+
+	tmpl, err := template.New("issue_template").Funcs(notifiers.TemplateFuncs()).Parse(issueTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse issue body template: %w", err)
+	}
+	g.tmpl = tmpl
+
+	wuRef, err := notifiers.GetSecretRef(cfg.Spec.Notification.Delivery, githubTokenSecretName)
+	if err != nil {
+		return fmt.Errorf("failed to get Secret ref from delivery config (%v) field %q: %w", cfg.Spec.Notification.Delivery, githubTokenSecretName, err)
+	}
+	wuResource, err := notifiers.FindSecretResourceName(cfg.Spec.Secrets, wuRef)
+	if err != nil {
+		return fmt.Errorf("failed to find Secret for ref %q: %w", wuRef, err)
+	}
+	wu, err := sg.GetSecret(ctx, wuResource)
+	if err != nil {
+		return fmt.Errorf("failed to get token secret: %w", err)
+	}
+	g.githubToken = wu
+
+	return nil
+}
+
+func (g *githubissuesNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if !g.filter.Apply(ctx, build) {
+		notifiers.V(2).Infof(ctx, "not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
+		return nil
+	}
+
+	repo := GetGithubRepo(build)
+	if repo == "" {
+		notifiers.Warningf(ctx, "could not determine GitHub repository from build, skipping notification")
+		return nil
+	}
+	webhookURL := fmt.Sprintf("%s/%s/issues", githubApiEndpoint, repo)
+
+	notifiers.Infof(ctx, "sending GitHub Issue webhook for Build %q (status: %q) to url %q", build.Id, build.Status, webhookURL)
+
+	payload, err := g.render(ctx, build)
+	if err != nil {
+		return err
+	}
+
+	err = g.retry.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, strings.NewReader(payload))
+		if err != nil {
+			return notifiers.Permanent(fmt.Errorf("failed to create a new HTTP request: %w", err))
+		}
+
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", g.githubToken))
+		req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
+
+		resp, err := notifiers.HTTPClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to make HTTP request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if err := notifiers.CheckResponse(resp); err != nil {
+			return fmt.Errorf("failed to send HTTP request: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	notifiers.V(2).Infof(ctx, "send HTTP request successfully")
+	return nil
+}
+
+// Render returns the issue that SendNotification would create for the Build, regardless of the filter and of whether
+// the Build has a GitHub repository.
+func (g *githubissuesNotifier) Render(ctx context.Context, build *cbpb.Build) (string, error) {
+	return g.render(ctx, build)
+}
+
+func (g *githubissuesNotifier) render(ctx context.Context, build *cbpb.Build) (string, error) {
+	bindings, err := g.br.Resolve(ctx, nil, build)
+	if err != nil {
+		notifiers.Errorf(ctx, "failed to resolve bindings :%v", err)
+	}
+	view := &notifiers.TemplateView{
+		Build:      &notifiers.BuildView{Build: build},
+		Params:     bindings,
+		Message:    notifiers.MessageFrom(ctx),
+		Suppressed: notifiers.SuppressedFrom(ctx),
+	}
+	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.HTTPMedium)
+	if err != nil {
+		return "", notifiers.Permanent(fmt.Errorf("failed to add UTM params: %w", err))
+	}
+	build.LogUrl = logURL
+
+	var buf bytes.Buffer
+	if err := notifiers.ExecuteTemplate(ctx, &buf, g.tmpl, view); err != nil {
+		return "", notifiers.Permanent(fmt.Errorf("failed to execute template: %w", err))
+	}
+	return buf.String(), nil
+}
+
+func GetGithubRepo(build *cbpb.Build) string {
+	if build.Substitutions != nil && build.Substitutions["REPO_FULL_NAME"] != "" {
+		// return repo full name if it's available
+		// e.g. "GoogleCloudPlatform/cloud-build-notifiers"
+		return build.Substitutions["REPO_FULL_NAME"]
+	}
+	return ""
+}
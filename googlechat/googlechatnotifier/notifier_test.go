@@ -1,6 +1,7 @@
-package main
+package googlechatnotifier
 
 import (
+	"context"
 	"testing"
 
 	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
@@ -18,7 +19,7 @@ func TestWriteMessage(t *testing.T) {
 		LogUrl:    "https://some.example.com/log/url?foo=bar",
 	}
 
-	got, err := n.writeMessage(b)
+	got, err := n.writeMessage(context.Background(), b)
 	if err != nil {
 		t.Fatalf("writeMessage failed: %v", err)
 	}
@@ -68,3 +69,16 @@ func TestWriteMessage(t *testing.T) {
 	}
 
 }
+
+func TestWriteMessageShortBuildID(t *testing.T) {
+	n := new(googlechatNotifier)
+	for _, id := range []string{"", "abc", "12345678"} {
+		got, err := n.writeMessage(context.Background(), &cbpb.Build{Id: id, Status: cbpb.Build_FAILURE})
+		if err != nil {
+			t.Fatalf("writeMessage(%q) failed: %v", id, err)
+		}
+		if want := "Build " + id + " Status: FAILURE"; got.Cards[0].Header.Title != want {
+			t.Errorf("writeMessage(%q) got title %q, want %q", id, got.Cards[0].Header.Title, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpnotifier implements a Cloud Build notifier that POSTs a JSON payload to an HTTP endpoint.
+package httpnotifier
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+)
+
+const (
+	urlSecretName = "urlRef"
+)
+
+// Kind is the Config `kind` that the HTTP notifier is registered under.
+const Kind = "HTTPNotifier"
+
+// deliverySchema is the JSON Schema for the `delivery` of `cloud-build-notifiers/v2` configs of this Kind.
+//
+//go:embed delivery.schema.json
+var deliverySchema []byte
+
+func init() {
+	notifiers.Register(Kind, New)
+	notifiers.RegisterDeliverySchema(Kind, deliverySchema)
+}
+
+// New returns a new HTTP notifier that has not been set up yet.
+func New() notifiers.Notifier {
+	return new(httpNotifier)
+}
+
+type httpNotifier struct {
+	filter notifiers.EventFilter
+	tmpl   *template.Template
+	url    string
+	br     notifiers.BindingResolver
+	retry  *notifiers.RetryPolicy
+}
+
+func (h *httpNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, httpTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
+	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
+	if err != nil {
+		return fmt.Errorf("failed to create CELPredicate: %w", err)
+	}
+	h.filter = prd
+
+	rp, err := notifiers.NewRetryPolicy(cfg.Spec.Notification.Retry)
+	if err != nil {
+		return fmt.Errorf("failed to configure retries: %w", err)
+	}
+	h.retry = rp
+	h.br = br
+
+	if url, ok := cfg.Spec.Notification.Delivery["url"].(string); ok {
+		h.url = url
+	} else {
+		uRef, err := notifiers.GetSecretRef(cfg.Spec.Notification.Delivery, urlSecretName)
+		if err != nil {
+			return fmt.Errorf("failed to get Secret ref from delivery config (%v) field %q: %w", cfg.Spec.Notification.Delivery, urlSecretName, err)
+		}
+		uResource, err := notifiers.FindSecretResourceName(cfg.Spec.Secrets, uRef)
+		if err != nil {
+			return fmt.Errorf("failed to find Secret for ref %q: %w", uRef, err)
+		}
+		url, err := sg.GetSecret(ctx, uResource)
+		if err != nil {
+			return fmt.Errorf("failed to get token secret: %w", err)
+		}
+		h.url = url
+	}
+
+	tmpl, err := template.New("http_template").Funcs(notifiers.TemplateFuncs()).Parse(httpTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %v", err)
+	}
+	h.tmpl = tmpl
+
+	return nil
+}
+
+func (h *httpNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if !h.filter.Apply(ctx, build) {
+		notifiers.V(2).Infof(ctx, "not sending HTTP request for event (build id = %s, status = %v)", build.Id, build.Status)
+		return nil
+	}
+
+	notifiers.Infof(ctx, "sending HTTP request for event (build id = %s, status = %s)", build.Id, build.Status)
+
+	payload, err := h.render(ctx, build)
+	if err != nil {
+		return err
+	}
+	err = h.retry.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, strings.NewReader(payload))
+		if err != nil {
+			return notifiers.Permanent(fmt.Errorf("failed to create a new HTTP request: %w", err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
+		resp, err := notifiers.HTTPClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to make HTTP request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if err := notifiers.CheckResponse(resp); err != nil {
+			return fmt.Errorf("failed to send HTTP request: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	notifiers.V(2).Infof(ctx, "send HTTP request successfully")
+	return nil
+}
+
+// Render returns the payload that SendNotification would POST for the Build, regardless of the filter.
+func (h *httpNotifier) Render(ctx context.Context, build *cbpb.Build) (string, error) {
+	return h.render(ctx, build)
+}
+
+func (h *httpNotifier) render(ctx context.Context, build *cbpb.Build) (string, error) {
+	bindings, err := h.br.Resolve(ctx, nil, build)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve bindings: %w", err)
+	}
+	view := &notifiers.TemplateView{
+		Build:      &notifiers.BuildView{Build: build},
+		Params:     bindings,
+		Message:    notifiers.MessageFrom(ctx),
+		Suppressed: notifiers.SuppressedFrom(ctx),
+	}
+
+	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.HTTPMedium)
+	if err != nil {
+		return "", notifiers.Permanent(fmt.Errorf("failed to add UTM params: %w", err))
+	}
+	build.LogUrl = logURL
+
+	var buf bytes.Buffer
+	if err := notifiers.ExecuteTemplate(ctx, &buf, h.tmpl, view); err != nil {
+		return "", notifiers.Permanent(fmt.Errorf("failed to execute template: %w", err))
+	}
+	return buf.String(), nil
+}
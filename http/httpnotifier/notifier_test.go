@@ -12,13 +12,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package httpnotifier
 
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
 )
 
@@ -151,6 +155,123 @@ func TestSetUp(t *testing.T) {
 	}
 }
 
+func TestSendNotificationResponseStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status        int
+		wantErr       bool
+		wantPermanent bool
+		wantRequests  int
+	}{
+		{status: http.StatusOK, wantRequests: 1},
+		{status: http.StatusAccepted, wantRequests: 1},
+		{status: http.StatusBadRequest, wantErr: true, wantPermanent: true, wantRequests: 1},
+		{status: http.StatusTooManyRequests, wantErr: true, wantRequests: 2},
+		{status: http.StatusBadGateway, wantErr: true, wantRequests: 2},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests++
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			cfg := &notifiers.Config{
+				Spec: &notifiers.Spec{
+					Notification: &notifiers.Notification{
+						Filter:   "true",
+						Delivery: map[string]interface{}{"url": srv.URL},
+						Retry:    &notifiers.RetryConfig{Attempts: 2, InitialBackoff: "1ms", MaxBackoff: "1ms"},
+					},
+				},
+			}
+			n := new(httpNotifier)
+			if err := n.SetUp(context.Background(), cfg, `{"id": "{{.Build.Id}}"}`, new(fakeSecretGetter), fakeResolver{}); err != nil {
+				t.Fatalf("SetUp failed: %v", err)
+			}
+
+			err := n.SendNotification(context.Background(), &cbpb.Build{Id: "some-build"})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("SendNotification() = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got := notifiers.IsPermanent(err); got != tc.wantPermanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, got, tc.wantPermanent)
+			}
+			if requests != tc.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { requests++ }))
+	defer srv.Close()
+
+	cfg := &notifiers.Config{
+		Spec: &notifiers.Spec{
+			Notification: &notifiers.Notification{
+				Filter:   "false",
+				Delivery: map[string]interface{}{"url": srv.URL},
+			},
+		},
+	}
+	n := new(httpNotifier)
+	if err := n.SetUp(context.Background(), cfg, `{"id": "{{.Build.Id}}", "log": "{{.Build.LogUrl}}"}`, new(fakeSecretGetter), fakeResolver{}); err != nil {
+		t.Fatalf("SetUp failed: %v", err)
+	}
+
+	got, err := n.Render(context.Background(), &cbpb.Build{Id: "some-build", LogUrl: "https://some.example.com/log"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	want := `{"id": "some-build", "log": "https://some.example.com/log?utm_campaign=google-cloud-build-notifiers&utm_medium=http&utm_source=google-cloud-build"}`
+	if got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+	if requests != 0 {
+		t.Errorf("got %d requests, want none", requests)
+	}
+}
+
+func TestRenderConcurrently(t *testing.T) {
+	cfg := &notifiers.Config{
+		Spec: &notifiers.Spec{
+			Notification: &notifiers.Notification{
+				Filter:   "true",
+				Delivery: map[string]interface{}{"url": "https://some.example.com/hook"},
+			},
+		},
+	}
+	n := new(httpNotifier)
+	if err := n.SetUp(context.Background(), cfg, `{{.Build.Id}}`, new(fakeSecretGetter), fakeResolver{}); err != nil {
+		t.Fatalf("SetUp failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("build-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := n.Render(context.Background(), &cbpb.Build{Id: id})
+			if err != nil {
+				t.Errorf("Render(%s) failed: %v", id, err)
+			} else if got != id {
+				t.Errorf("Render(%s) = %q, want the payload of its own Build", id, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type fakeResolver struct{}
+
+func (fakeResolver) Resolve(context.Context, notifiers.SecretGetter, *cbpb.Build) (map[string]string, error) {
+	return nil, nil
+}
+
 const urlSecretResource = "projects/test-project/secrets/test-secret/versions/latest"
 const urlSecret = "http://example.com/?secret"
 
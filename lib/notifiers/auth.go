@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// googleIssuers are the issuers of Google-signed OIDC tokens.
+var googleIssuers = map[string]bool{
+	"https://accounts.google.com": true,
+	"accounts.google.com":         true,
+}
+
+// errForbidden is returned by pushVerifier.verify for valid tokens of service accounts that are not allowed.
+var errForbidden = errors.New("service account is not allowed")
+
+// pushVerifier verifies the OIDC tokens that Pub/Sub push subscriptions with authentication attach to requests.
+type pushVerifier struct {
+	validator *idtoken.Validator
+	audience  string
+	// serviceAccounts are the only service account emails whose tokens are accepted.
+	serviceAccounts map[string]bool
+}
+
+// pushVerifierFromEnv returns the pushVerifier configured by PUSH_AUTH_AUDIENCE and PUSH_AUTH_SERVICE_ACCOUNTS, or nil
+// if PUSH_AUTH_AUDIENCE is not set.
+func pushVerifierFromEnv(ctx context.Context) (*pushVerifier, error) {
+	audience, ok := GetEnv("PUSH_AUTH_AUDIENCE")
+	if !ok {
+		return nil, nil
+	}
+	// Any Google account can get a token for any audience, so the audience alone does not authenticate anything.
+	sas, ok := GetEnv("PUSH_AUTH_SERVICE_ACCOUNTS")
+	if !ok {
+		return nil, errors.New("expected PUSH_AUTH_SERVICE_ACCOUNTS to be non-empty when PUSH_AUTH_AUDIENCE is set")
+	}
+	validator, err := idtoken.NewValidator(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ID token validator: %w", err)
+	}
+	return newPushVerifier(validator, audience, splitConfigPaths(sas))
+}
+
+func newPushVerifier(validator *idtoken.Validator, audience string, serviceAccounts []string) (*pushVerifier, error) {
+	if len(serviceAccounts) == 0 {
+		return nil, errors.New("expected at least one allowed service account")
+	}
+	v := &pushVerifier{validator: validator, audience: audience, serviceAccounts: map[string]bool{}}
+	for _, sa := range serviceAccounts {
+		v.serviceAccounts[sa] = true
+	}
+	return v, nil
+}
+
+// verify checks the signature, audience, expiry and issuer of the request's bearer token, and that it belongs to an
+// allowed service account. It returns an error wrapping errForbidden if only the latter check fails.
+func (v *pushVerifier) verify(ctx context.Context, r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return errors.New("missing bearer token")
+	}
+	payload, err := v.validator.Validate(ctx, token, v.audience)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if !googleIssuers[payload.Issuer] {
+		return fmt.Errorf("unexpected token issuer %q", payload.Issuer)
+	}
+	email, _ := payload.Claims["email"].(string)
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified || !v.serviceAccounts[email] {
+		return fmt.Errorf("%w: %q", errForbidden, email)
+	}
+	return nil
+}
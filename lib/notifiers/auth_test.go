@@ -0,0 +1,301 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	testAudience       = "https://notifier.example.com/"
+	testServiceAccount = "pubsub-push@some-project.iam.gserviceaccount.com"
+)
+
+// jwksTransport serves locally generated keys in place of Google's.
+type jwksTransport map[string]*rsa.PublicKey
+
+func (j jwksTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var keys []string
+	for kid, k := range j {
+		keys = append(keys, fmt.Sprintf(`{"kty": "RSA", "alg": "RS256", "use": "sig", "kid": %q, "n": %q, "e": %q}`, kid,
+			base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())))
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"keys": [` + strings.Join(keys, ",") + `]}`)),
+		Request:    r,
+	}, nil
+}
+
+// newTestVerifier returns a pushVerifier that accepts tokens of testServiceAccount for testAudience signed with the
+// given keys.
+func newTestVerifier(t *testing.T, keys jwksTransport) *pushVerifier {
+	t.Helper()
+	validator, err := idtoken.NewValidator(context.Background(), option.WithHTTPClient(&http.Client{Transport: keys}))
+	if err != nil {
+		t.Fatalf("failed to create ID token validator: %v", err)
+	}
+	v, err := newPushVerifier(validator, testAudience, []string{testServiceAccount})
+	if err != nil {
+		t.Fatalf("newPushVerifier failed: %v", err)
+	}
+	return v
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	var parts []string
+	for _, part := range []map[string]interface{}{header, claims} {
+		j, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(j))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestPushVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            testAudience,
+			"iat":            now.Add(-time.Minute).Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+			"email":          testServiceAccount,
+			"email_verified": true,
+		}
+	}
+	header := map[string]interface{}{"alg": "RS256", "kid": "key-1", "typ": "JWT"}
+
+	for _, tc := range []struct {
+		name          string
+		authorization func() string
+		wantErr       bool
+		wantForbidden bool
+	}{{
+		name:          "valid",
+		authorization: func() string { return "Bearer " + signToken(t, key, header, validClaims()) },
+	}, {
+		name:          "missing token",
+		authorization: func() string { return "" },
+		wantErr:       true,
+	}, {
+		name:          "not a bearer token",
+		authorization: func() string { return "Basic dXNlcjpwYXNz" },
+		wantErr:       true,
+	}, {
+		name:          "malformed token",
+		authorization: func() string { return "Bearer not.a-token" },
+		wantErr:       true,
+	}, {
+		name:          "signed by another key",
+		authorization: func() string { return "Bearer " + signToken(t, otherKey, header, validClaims()) },
+		wantErr:       true,
+	}, {
+		name: "unknown key ID",
+		authorization: func() string {
+			return "Bearer " + signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "key-2"}, validClaims())
+		},
+		wantErr: true,
+	}, {
+		name: "unsigned",
+		authorization: func() string {
+			tok := signToken(t, key, map[string]interface{}{"alg": "none", "kid": "key-1"}, validClaims())
+			return "Bearer " + tok[:bytes.LastIndexByte([]byte(tok), '.')+1]
+		},
+		wantErr: true,
+	}, {
+		name: "wrong issuer",
+		authorization: func() string {
+			c := validClaims()
+			c["iss"] = "https://evil.example.com"
+			return "Bearer " + signToken(t, key, header, c)
+		},
+		wantErr: true,
+	}, {
+		name: "wrong audience",
+		authorization: func() string {
+			c := validClaims()
+			c["aud"] = "https://other.example.com/"
+			return "Bearer " + signToken(t, key, header, c)
+		},
+		wantErr: true,
+	}, {
+		name: "expired",
+		authorization: func() string {
+			c := validClaims()
+			c["exp"] = now.Add(-time.Hour).Unix()
+			return "Bearer " + signToken(t, key, header, c)
+		},
+		wantErr: true,
+	}, {
+		name: "service account not allowed",
+		authorization: func() string {
+			c := validClaims()
+			c["email"] = "someone-else@some-project.iam.gserviceaccount.com"
+			return "Bearer " + signToken(t, key, header, c)
+		},
+		wantErr:       true,
+		wantForbidden: true,
+	}, {
+		name: "email not verified",
+		authorization: func() string {
+			c := validClaims()
+			c["email_verified"] = false
+			return "Bearer " + signToken(t, key, header, c)
+		},
+		wantErr:       true,
+		wantForbidden: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(t, jwksTransport{"key-1": &key.PublicKey})
+			req := httptest.NewRequest(http.MethodPost, testAudience, nil)
+			if a := tc.authorization(); a != "" {
+				req.Header.Set("Authorization", a)
+			}
+
+			err := v.verify(context.Background(), req)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("verify() = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got := errors.Is(err, errForbidden); got != tc.wantForbidden {
+				t.Errorf("verify() = %v, want forbidden %v", err, tc.wantForbidden)
+			}
+		})
+	}
+}
+
+func TestNewPushVerifierRequiresServiceAccounts(t *testing.T) {
+	if _, err := newPushVerifier(nil, testAudience, nil); err == nil {
+		t.Error("newPushVerifier() without service accounts succeeded, want error")
+	}
+}
+
+func TestPushVerifierFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		audience        string
+		serviceAccounts string
+		wantVerifier    bool
+		wantErr         bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", audience: testAudience, serviceAccounts: testServiceAccount, wantVerifier: true},
+		{name: "without service accounts", audience: testAudience, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PUSH_AUTH_AUDIENCE", tc.audience)
+			t.Setenv("PUSH_AUTH_SERVICE_ACCOUNTS", tc.serviceAccounts)
+			v, err := pushVerifierFromEnv(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("pushVerifierFromEnv() got error %v, want error %v", err, tc.wantErr)
+			}
+			if (v != nil) != tc.wantVerifier {
+				t.Errorf("pushVerifierFromEnv() = %v, want a verifier %v", v, tc.wantVerifier)
+			}
+		})
+	}
+}
+
+func TestReceiverRejectsUnauthenticatedRequests(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := protojson.Marshal(&cbpb.Build{Id: "some-build-id", Status: cbpb.Build_SUCCESS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{Data: data, ID: "some-message-id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := new(ruleNotifier)
+	handler := newReceiver(n, &receiverParams{verifier: newTestVerifier(t, jwksTransport{"key-1": &key.PublicKey})})
+	claims := func(email string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "accounts.google.com",
+			"aud":            testAudience,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"email":          email,
+			"email_verified": true,
+		}
+	}
+	header := map[string]interface{}{"alg": "RS256", "kid": "key-1"}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"other service account", "Bearer " + signToken(t, key, header, claims("intruder@example.com")), http.StatusForbidden},
+		{"allowed service account", "Bearer " + signToken(t, key, header, claims(testServiceAccount)), http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, testAudience, bytes.NewReader(body))
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if got := w.Result().StatusCode; got != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.wantStatus)
+		}
+	}
+	if len(n.builds) != 1 {
+		t.Errorf("notifier was sent %d Builds, want only the authenticated one", len(n.builds))
+	}
+}
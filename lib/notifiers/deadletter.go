@@ -0,0 +1,443 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultDeadLetterAttempts is the number of failed delivery attempts after which a message is dead-lettered, unless
+// DEAD_LETTER_AFTER_ATTEMPTS is set.
+const defaultDeadLetterAttempts = 5
+
+// deadLetterRecord is what the dead-letter sink stores for each notification rule that failed to deliver a Build.
+type deadLetterRecord struct {
+	MessageID   string            `json:"messageId,omitempty"`
+	PublishTime string            `json:"publishTime,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Attempts    int               `json:"attempts"`
+	RecordedAt  time.Time         `json:"recordedAt"`
+	// Rule is the name of the notification rule that failed (see ruleName), if known.
+	Rule string `json:"rule,omitempty"`
+	Kind string `json:"kind,omitempty"`
+	// Destination is the rule's `delivery` config, which only ever refers to secrets by their local name.
+	Destination map[string]interface{} `json:"destination,omitempty"`
+	// Payload is the rule's template rendered for the Build.
+	Payload string `json:"payload,omitempty"`
+	// Errors is the chain of errors, outermost first.
+	Errors []string        `json:"errors"`
+	Build  json.RawMessage `json:"build"`
+}
+
+// deadLetterStore stores dead-letter records by name.
+type deadLetterStore interface {
+	Write(ctx context.Context, name string, data []byte) error
+	// List returns the names of all stored records, in the order they were written.
+	List(ctx context.Context) ([]string, error)
+	Read(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// newDeadLetterStore returns a deadLetterStore for a `gs://bucket/prefix` or `file:///path/to/dir` URI.
+func newDeadLetterStore(uri string, sc *storage.Client) (deadLetterStore, error) {
+	switch {
+	case strings.HasPrefix(uri, "gs://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("expected %q to be of the form `gs://bucket/prefix`", uri)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &gcsDeadLetterStore{bucket: sc.Bucket(bucket), prefix: prefix}, nil
+	case strings.HasPrefix(uri, "file://"):
+		dir, err := filePath(uri)
+		if err != nil {
+			return nil, err
+		}
+		return fileDeadLetterStore(dir), nil
+	default:
+		return nil, fmt.Errorf("expected dead-letter sink %q to be a `gs://` or `file://` URI", uri)
+	}
+}
+
+// fileDeadLetterStore stores records as files in a local directory.
+type fileDeadLetterStore string
+
+func (d fileDeadLetterStore) Write(_ context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(string(d), name), data, 0o600)
+}
+
+func (d fileDeadLetterStore) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d fileDeadLetterStore) Read(_ context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), name))
+}
+
+func (d fileDeadLetterStore) Delete(_ context.Context, name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+// gcsDeadLetterStore stores records as objects under a GCS prefix.
+type gcsDeadLetterStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (g *gcsDeadLetterStore) Write(ctx context.Context, name string, data []byte) error {
+	w := g.bucket.Object(g.prefix + name).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (g *gcsDeadLetterStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: g.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if name := strings.TrimPrefix(attrs.Name, g.prefix); !strings.Contains(name, "/") && strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (g *gcsDeadLetterStore) Read(ctx context.Context, name string) ([]byte, error) {
+	r, err := g.bucket.Object(g.prefix + name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (g *gcsDeadLetterStore) Delete(ctx context.Context, name string) error {
+	return g.bucket.Object(g.prefix + name).Delete(ctx)
+}
+
+// deadLetterSink records notifications that failed permanently or after a number of attempts, so that the receiver
+// can ack them instead of having Pub/Sub redeliver them until they expire.
+type deadLetterSink struct {
+	store         deadLetterStore
+	afterAttempts int
+}
+
+func newDeadLetterSink(store deadLetterStore, afterAttempts int) *deadLetterSink {
+	return &deadLetterSink{store: store, afterAttempts: afterAttempts}
+}
+
+type deadLettersKey struct{}
+
+// withDeadLetters returns a context for notifications of messages that are recorded in the given sink if they fail,
+// which notifications that are sent later on (i.e. rate limit follow-ups) are recorded in too.
+func withDeadLetters(ctx context.Context, d *deadLetterSink) context.Context {
+	return context.WithValue(ctx, deadLettersKey{}, d)
+}
+
+func deadLettersFrom(ctx context.Context) *deadLetterSink {
+	d, _ := ctx.Value(deadLettersKey{}).(*deadLetterSink)
+	return d
+}
+
+// deadLetterSinkFromEnv returns the deadLetterSink configured by DEAD_LETTER_SINK and DEAD_LETTER_AFTER_ATTEMPTS, or
+// nil if DEAD_LETTER_SINK is not set.
+func deadLetterSinkFromEnv(sc *storage.Client) (*deadLetterSink, error) {
+	uri, ok := GetEnv("DEAD_LETTER_SINK")
+	if !ok {
+		return nil, nil
+	}
+	store, err := newDeadLetterStore(uri, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	after := defaultDeadLetterAttempts
+	if a, ok := GetEnv("DEAD_LETTER_AFTER_ATTEMPTS"); ok {
+		after, err = strconv.Atoi(a)
+		if err != nil || after < 1 {
+			return nil, fmt.Errorf("expected DEAD_LETTER_AFTER_ATTEMPTS %q to be a positive integer", a)
+		}
+	}
+	return newDeadLetterSink(store, after), nil
+}
+
+// record writes one record per failed notification rule in the given error.
+func (d *deadLetterSink) record(ctx context.Context, msg pubSubPushMessage, attempts int, build *cbpb.Build, err error) error {
+	bj, merr := protojson.Marshal(build)
+	if merr != nil {
+		return fmt.Errorf("failed to marshal Build: %w", merr)
+	}
+
+	now := time.Now().UTC()
+	base := deadLetterRecord{
+		MessageID:   msg.ID,
+		PublishTime: msg.PublishTime,
+		Attributes:  msg.Attributes,
+		Attempts:    attempts,
+		RecordedAt:  now,
+		Build:       bj,
+	}
+
+	var recs []*deadLetterRecord
+	for _, re := range ruleErrors(err) {
+		rec := base
+		rec.Rule = re.rule.name
+		rec.Kind = re.rule.cfg.Kind
+		rec.Destination = destination(re.rule.cfg)
+		rec.Errors = errorChain(re.err)
+		if payload, rerr := renderRule(ctx, re.rule, build); rerr != nil {
+			rec.Payload = fmt.Sprintf("failed to render payload: %v", rerr)
+		} else {
+			rec.Payload = payload
+		}
+		recs = append(recs, &rec)
+	}
+	if len(recs) == 0 {
+		rec := base
+		rec.Errors = errorChain(err)
+		recs = append(recs, &rec)
+	}
+
+	id := msg.ID
+	if id == "" {
+		id = build.GetId()
+	}
+	for _, rec := range recs {
+		data, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead-letter record: %w", err)
+		}
+		name := fmt.Sprintf("%s-%s-%s.json", now.Format("20060102T150405.000000000Z"), safeName(id), safeName(rec.Rule))
+		if err := d.store.Write(ctx, name, data); err != nil {
+			return fmt.Errorf("failed to write dead-letter record %q: %w", name, err)
+		}
+		Infof(ctx, "wrote dead-letter record %q for Build %q", name, build.GetId())
+	}
+	return nil
+}
+
+// ruleErrors returns all ruleErrors in the given error tree.
+func ruleErrors(err error) []*ruleError {
+	if re, ok := err.(*ruleError); ok {
+		return []*ruleError{re}
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var res []*ruleError
+		for _, e := range joined.Unwrap() {
+			res = append(res, ruleErrors(e)...)
+		}
+		return res
+	}
+	if err = errors.Unwrap(err); err != nil {
+		return ruleErrors(err)
+	}
+	return nil
+}
+
+// errorChain returns the messages of the given error and of everything it wraps, outermost first.
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		chain = append(chain, err.Error())
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				chain = append(chain, errorChain(e)...)
+			}
+			break
+		}
+		err = errors.Unwrap(err)
+	}
+	return chain
+}
+
+func destination(cfg *Config) map[string]interface{} {
+	if cfg.Spec == nil || cfg.Spec.Notification == nil {
+		return nil
+	}
+	dst := map[string]interface{}{}
+	for k, v := range cfg.Spec.Notification.Delivery {
+		dst[k] = jsonValue(v)
+	}
+	return dst
+}
+
+// renderRule returns the payload of the rule's notification for the given Build. If the rule's Notifier is a
+// Renderer, that is what it would deliver; otherwise, it is the rule's template rendered with the shared
+// TemplateFuncs.
+func renderRule(ctx context.Context, rl *rule, build *cbpb.Build) (string, error) {
+	if r, ok := rl.Notifier.(Renderer); ok {
+		// Notifiers may modify the Build while rendering, e.g. to add UTM parameters to its log URL.
+		return r.Render(ctx, proto.Clone(build).(*cbpb.Build))
+	}
+	if rl.tmpl == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(rl.name).Funcs(TemplateFuncs()).Parse(rl.tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+	params, err := rl.br.Resolve(ctx, rl.sg, build)
+	if err != nil {
+		return "", fmt.Errorf("failed to bind params: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, &TemplateView{Build: &BuildView{Build: build}, Params: params, Message: MessageFrom(ctx), Suppressed: SuppressedFrom(ctx)}); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func safeName(s string) string {
+	if s == "" {
+		return "all"
+	}
+	return unsafeNameChars.ReplaceAllString(s, "_")
+}
+
+// rulesOf returns the notification rules behind a Notifier returned by setUpConfigs.
+func rulesOf(n Notifier) []*rule {
+	switch n := n.(type) {
+	case *rule:
+		return []*rule{n}
+	case *ruleSet:
+		return n.rules
+	}
+	return nil
+}
+
+// replayDeadLetters re-sends every record in the store to the notification rule that failed to deliver it (or to all
+// rules whose messageFilter matches if that is unknown), bypassing their rate limits, and deletes the records that
+// were delivered.
+func replayDeadLetters(ctx context.Context, store deadLetterStore, notifier Notifier) error {
+	rules := map[string]*rule{}
+	for _, rl := range rulesOf(notifier) {
+		rules[rl.name] = rl
+	}
+
+	names, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list dead-letter records: %w", err)
+	}
+
+	var failed int
+	for _, name := range names {
+		if err := replayRecord(ctx, store, name, notifier, rules); err != nil {
+			Errorf(ctx, "failed to replay dead-letter record %q: %v", name, err)
+			failed++
+			continue
+		}
+		if err := store.Delete(ctx, name); err != nil {
+			Errorf(ctx, "replayed dead-letter record %q but failed to delete it: %v", name, err)
+			failed++
+			continue
+		}
+		Infof(ctx, "replayed dead-letter record %q", name)
+	}
+
+	Infof(ctx, "replayed %d of %d dead-letter records", len(names)-failed, len(names))
+	if failed > 0 {
+		return fmt.Errorf("failed to replay %d of %d dead-letter records", failed, len(names))
+	}
+	return nil
+}
+
+func replayRecord(ctx context.Context, store deadLetterStore, name string, notifier Notifier, rules map[string]*rule) error {
+	data, err := store.Read(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read record: %w", err)
+	}
+	rec := new(deadLetterRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	build := new(cbpb.Build)
+	uo := protojson.UnmarshalOptions{DiscardUnknown: true}
+	if err := uo.Unmarshal(rec.Build, build); err != nil {
+		return fmt.Errorf("failed to unmarshal Build: %w", err)
+	}
+	ctx = WithMessage(ctx, messageViewOf(&pubSubPushWrapper{
+		Message: pubSubPushMessage{ID: rec.MessageID, PublishTime: rec.PublishTime, Attributes: rec.Attributes},
+	}))
+
+	// Replays are sent straight to the rules, since a rate limit that dropped or coalesced them would lose the record.
+	if rec.Rule == "" {
+		all := rulesOf(notifier)
+		if len(all) == 0 {
+			return notifier.SendNotification(ctx, build)
+		}
+		var errs []error
+		for _, rl := range all {
+			if !rl.matchesMessage(ctx, MessageFrom(ctx)) {
+				continue
+			}
+			if err := rl.send(ctx, build); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	rl, ok := rules[rec.Rule]
+	if !ok {
+		return fmt.Errorf("notification rule %q is not in the current configs", rec.Rule)
+	}
+	return rl.send(ctx, build)
+}
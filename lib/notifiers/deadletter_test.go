@@ -0,0 +1,187 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestErrorChain(t *testing.T) {
+	inner := errors.New("connection refused")
+	err := fmt.Errorf("failed to send: %w", errors.Join(fmt.Errorf("POST failed: %w", inner), errors.New("other")))
+	want := []string{
+		"failed to send: POST failed: connection refused\nother",
+		"POST failed: connection refused\nother",
+		"POST failed: connection refused",
+		"connection refused",
+		"other",
+	}
+	if diff := cmp.Diff(want, errorChain(err)); diff != "" {
+		t.Errorf("errorChain got unexpected diff: (-want +got)\n%s", diff)
+	}
+}
+
+func TestReceiverDeadLettersAndReplay(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "dl"},
+		Spec: &Spec{
+			Notifications: []*Notification{{
+				Filter: "ok",
+			}, {
+				Filter:   "broken",
+				Delivery: map[string]interface{}{"url": map[interface{}]interface{}{"secretRef": "url"}},
+				Template: &Template{Type: "golang", Content: `{"text": "{{ .Build.Id }} {{ status .Build.Status }}"}`},
+			}},
+		},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), setupCheckSource{})
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+	rs := n.(*ruleSet)
+	ok, broken := rs.rules[0].Notifier.(*ruleNotifier), rs.rules[1].Notifier.(*ruleNotifier)
+	broken.err = errors.New("got a 503 from the webhook")
+
+	store := fileDeadLetterStore(t.TempDir())
+	handler := newReceiver(n, &receiverParams{deadLetters: newDeadLetterSink(store, 2)})
+
+	build := &cbpb.Build{Id: "some-build-id", Status: cbpb.Build_FAILURE}
+	data, err := protojson.Marshal(build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{Data: data, ID: "msg-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", bytes.NewBuffer(body)))
+		if got := w.Result().StatusCode; got != want {
+			t.Errorf("attempt %d: got status code %d, want %d", i+1, got, want)
+		}
+	}
+
+	names, err := store.List(ctx)
+	if err != nil || len(names) != 1 {
+		t.Fatalf("store.List() = (%v, %v), want a single record", names, err)
+	}
+	raw, err := store.Read(ctx, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(deadLetterRecord)
+	if err := json.Unmarshal(raw, rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MessageID != "msg-1" || rec.Attempts != 2 || rec.Rule != "dl[1]" || rec.Kind != "TestNotifier" {
+		t.Errorf("got record %+v, want message msg-1 after 2 attempts for rule dl[1] of kind TestNotifier", rec)
+	}
+	if want := `{"text": "some-build-id FAILURE"}`; rec.Payload != want {
+		t.Errorf("got payload %q, want %q", rec.Payload, want)
+	}
+	if diff := cmp.Diff(map[string]interface{}{"url": map[string]interface{}{"secretRef": "url"}}, rec.Destination); diff != "" {
+		t.Errorf("got unexpected destination diff: (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"got a 503 from the webhook"}, rec.Errors); diff != "" {
+		t.Errorf("got unexpected errors diff: (-want +got)\n%s", diff)
+	}
+
+	// Replaying only re-sends to the rule that failed, and removes the record once it is delivered.
+	broken.err = nil
+	ok.builds, broken.builds = nil, nil
+	if err := replayDeadLetters(ctx, store, n); err != nil {
+		t.Fatalf("replayDeadLetters failed: %v", err)
+	}
+	if len(ok.builds) != 0 || len(broken.builds) != 1 || broken.builds[0] != "some-build-id" {
+		t.Errorf("replay sent %v to the healthy rule and %v to the broken one, want nothing and [some-build-id]", ok.builds, broken.builds)
+	}
+	if names, err := store.List(ctx); err != nil || len(names) != 0 {
+		t.Errorf("store.List() after replay = (%v, %v), want no records", names, err)
+	}
+}
+
+func TestReplayDeadLettersKeepsFailedRecords(t *testing.T) {
+	ctx := context.Background()
+	store := fileDeadLetterStore(t.TempDir())
+	for name, rec := range map[string]string{
+		"1.json": `{"rule": "gone[0]", "build": {"id": "b1"}}`,
+		"2.json": `{"build": {"id": "b2"}}`,
+	} {
+		if err := store.Write(ctx, name, []byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := &ruleNotifier{err: errors.New("still down")}
+	if err := replayDeadLetters(ctx, store, n); err == nil {
+		t.Fatal("replayDeadLetters unexpectedly succeeded")
+	}
+	if names, err := store.List(ctx); err != nil || len(names) != 2 {
+		t.Errorf("store.List() = (%v, %v), want both records kept", names, err)
+	}
+}
+
+func TestReplayDeadLettersBypassesRateLimit(t *testing.T) {
+	useStatus(t)
+	ctx := context.Background()
+	n := new(ruleNotifier)
+	rl := setUpRateLimitedRule(t, n, &RateLimitConfig{Rate: 1, Interval: "1h"})
+	// Use up the only token of the bucket.
+	if err := rl.SendNotification(ctx, &cbpb.Build{Id: "b0", Status: cbpb.Build_FAILURE}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := fileDeadLetterStore(t.TempDir())
+	if err := store.Write(ctx, "1.json", []byte(`{"rule": "limited[0]", "build": {"id": "b1", "status": "FAILURE"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayDeadLetters(ctx, store, rl); err != nil {
+		t.Fatalf("replayDeadLetters failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"b0", "b1"}, n.builds); diff != "" {
+		t.Errorf("got unexpected notifications (-want +got):\n%s", diff)
+	}
+	if names, err := store.List(ctx); err != nil || len(names) != 0 {
+		t.Errorf("store.List() after replay = (%v, %v), want no records", names, err)
+	}
+}
+
+func TestNewDeadLetterStore(t *testing.T) {
+	for _, uri := range []string{"s3://bucket/prefix", "gs://", "file://"} {
+		if _, err := newDeadLetterStore(uri, nil); err == nil {
+			t.Errorf("newDeadLetterStore(%q) unexpectedly succeeded", uri)
+		}
+	}
+	got, err := newDeadLetterStore("file:///tmp/dead-letters", nil)
+	if err != nil || got != fileDeadLetterStore("/tmp/dead-letters") {
+		t.Errorf("newDeadLetterStore(file:///tmp/dead-letters) = (%v, %v)", got, err)
+	}
+}
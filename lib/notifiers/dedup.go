@@ -0,0 +1,246 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultDedupTTL is how long messages and Build statuses are remembered, unless DEDUP_TTL is set.
+	defaultDedupTTL = time.Hour
+	// maxDedupEntries bounds the number of keys that the in-memory store remembers.
+	maxDedupEntries = 10000
+	// dedupExpiresMetadata is the GCS object metadata key that holds the expiry of a key.
+	dedupExpiresMetadata = "expires"
+)
+
+// dedupStore remembers keys for a while.
+type dedupStore interface {
+	// Claim remembers the key until the TTL expires. It returns false if the key was already remembered and has not
+	// expired.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release forgets the key, so that it can be claimed again.
+	Release(ctx context.Context, key string) error
+}
+
+// newDedupStore returns the in-memory dedupStore for `memory`, and a GCS one for a `gs://bucket/prefix` URI.
+func newDedupStore(uri string, sc *storage.Client) (dedupStore, error) {
+	switch {
+	case uri == "memory":
+		return newMemoryDedupStore(maxDedupEntries), nil
+	case strings.HasPrefix(uri, "gs://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("expected %q to be of the form `gs://bucket/prefix`", uri)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &gcsDedupStore{bucket: sc.Bucket(bucket), prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("expected dedup store %q to be `memory` or a `gs://` URI", uri)
+	}
+}
+
+// memoryDedupStore remembers up to a number of keys in memory, and forgets the least recently claimed ones first.
+// Keys are not shared between instances of the notifier.
+type memoryDedupStore struct {
+	size int
+	now  func() time.Time
+
+	mtx sync.Mutex
+	// lru holds *memoryDedupEntry values, most recently claimed first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryDedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newMemoryDedupStore(size int) *memoryDedupStore {
+	return &memoryDedupStore{size: size, now: time.Now, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (m *memoryDedupStore) Claim(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := m.now()
+	if el, ok := m.entries[key]; ok {
+		e := el.Value.(*memoryDedupEntry)
+		if now.Before(e.expires) {
+			return false, nil
+		}
+		e.expires = now.Add(ttl)
+		m.lru.MoveToFront(el)
+		return true, nil
+	}
+
+	m.entries[key] = m.lru.PushFront(&memoryDedupEntry{key: key, expires: now.Add(ttl)})
+	for m.lru.Len() > m.size {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryDedupEntry).key)
+	}
+	return true, nil
+}
+
+func (m *memoryDedupStore) Release(_ context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.lru.Remove(el)
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// gcsDedupStore remembers keys as empty objects under a GCS prefix, so that they are shared between instances of the
+// notifier. Claims use preconditions, so that only one instance can claim a key. Expired objects are overwritten, but
+// never deleted; a lifecycle rule on the bucket can clean them up.
+type gcsDedupStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (g *gcsDedupStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	obj := g.bucket.Object(g.prefix + url.PathEscape(key))
+	claimed, err := g.write(ctx, obj.If(storage.Conditions{DoesNotExist: true}), ttl)
+	if err != nil || claimed {
+		return claimed, err
+	}
+
+	attrs, err := obj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		// Released since we tried to claim it.
+		return g.write(ctx, obj.If(storage.Conditions{DoesNotExist: true}), ttl)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get attributes of %q: %w", obj.ObjectName(), err)
+	}
+	if expires, err := time.Parse(time.RFC3339Nano, attrs.Metadata[dedupExpiresMetadata]); err == nil && time.Now().Before(expires) {
+		return false, nil
+	}
+	return g.write(ctx, obj.If(storage.Conditions{GenerationMatch: attrs.Generation}), ttl)
+}
+
+// write creates the object for a claim and returns false if the object's preconditions failed.
+func (g *gcsDedupStore) write(ctx context.Context, obj *storage.ObjectHandle, ttl time.Duration) (bool, error) {
+	w := obj.NewWriter(ctx)
+	w.Metadata = map[string]string{dedupExpiresMetadata: time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)}
+	if err := w.Close(); err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to write %q: %w", obj.ObjectName(), err)
+	}
+	return true, nil
+}
+
+func (g *gcsDedupStore) Release(ctx context.Context, key string) error {
+	err := g.bucket.Object(g.prefix + url.PathEscape(key)).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// deduper skips Pub/Sub messages that were already handled, and Build statuses that a notification rule already
+// delivered. Keys are only remembered for successful deliveries, so that failed ones are retried.
+// Errors from the store are logged and do not prevent delivery.
+type deduper struct {
+	store dedupStore
+	ttl   time.Duration
+}
+
+// deduperFromEnv returns the deduper configured by DEDUP_STORE and DEDUP_TTL, or nil if DEDUP_STORE is not set.
+func deduperFromEnv(sc *storage.Client) (*deduper, error) {
+	uri, ok := GetEnv("DEDUP_STORE")
+	if !ok {
+		return nil, nil
+	}
+	store, err := newDedupStore(uri, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := defaultDedupTTL
+	if t, ok := GetEnv("DEDUP_TTL"); ok {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("expected DEDUP_TTL %q to be a positive duration", t)
+		}
+	}
+	return &deduper{store: store, ttl: ttl}, nil
+}
+
+// newDeliveredRules returns the deduper that remembers the Build statuses that rules delivered when DEDUP_STORE is not
+// set, in memory.
+func newDeliveredRules() *deduper {
+	return &deduper{store: newMemoryDedupStore(maxDedupEntries), ttl: defaultDedupTTL}
+}
+
+// claim claims the key and returns false if it was already claimed.
+func (d *deduper) claim(ctx context.Context, key string) bool {
+	claimed, err := d.store.Claim(ctx, key, d.ttl)
+	if err != nil {
+		Warningf(ctx, "failed to claim dedup key %q, not deduplicating: %v", key, err)
+		return true
+	}
+	return claimed
+}
+
+// release forgets the key after a failed delivery.
+func (d *deduper) release(ctx context.Context, key string) {
+	if err := d.store.Release(ctx, key); err != nil {
+		Warningf(ctx, "failed to release dedup key %q: %v", key, err)
+	}
+}
+
+func messageDedupKey(msgID string) string {
+	return "message/" + msgID
+}
+
+func buildDedupKey(ruleName string, build *cbpb.Build) string {
+	return fmt.Sprintf("build/%s/%s/%s", ruleName, build.GetId(), build.GetStatus())
+}
+
+type deduperKey struct{}
+
+// withDeduper returns a context that makes notification rules skip Build statuses that they already delivered.
+func withDeduper(ctx context.Context, d *deduper) context.Context {
+	return context.WithValue(ctx, deduperKey{}, d)
+}
+
+func deduperFrom(ctx context.Context) *deduper {
+	d, _ := ctx.Value(deduperKey{}).(*deduper)
+	return d
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newMemoryDedupStore(2)
+	m.now = func() time.Time { return now }
+
+	claim := func(key string, want bool) {
+		t.Helper()
+		if got, err := m.Claim(ctx, key, time.Minute); err != nil || got != want {
+			t.Errorf("Claim(%q) = (%v, %v), want (%v, nil)", key, got, err, want)
+		}
+	}
+
+	claim("a", true)
+	claim("a", false)
+
+	// Keys expire after the TTL.
+	now = now.Add(time.Minute)
+	claim("a", true)
+
+	// Released keys can be claimed again.
+	if err := m.Release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	claim("a", true)
+
+	// The least recently claimed key is evicted first.
+	claim("b", true)
+	claim("c", true)
+	claim("b", false)
+	claim("a", true)
+}
+
+func TestNewDedupStore(t *testing.T) {
+	for _, uri := range []string{"", "redis://localhost", "gs://"} {
+		if _, err := newDedupStore(uri, nil); err == nil {
+			t.Errorf("newDedupStore(%q) unexpectedly succeeded", uri)
+		}
+	}
+	if s, err := newDedupStore("memory", nil); err != nil {
+		t.Errorf("newDedupStore(memory) failed: %v", err)
+	} else if _, ok := s.(*memoryDedupStore); !ok {
+		t.Errorf("newDedupStore(memory) = %T, want a *memoryDedupStore", s)
+	}
+}
+
+func TestReceiverDedup(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "dedup"},
+		Spec: &Spec{
+			Notifications: []*Notification{{Filter: "first"}, {Filter: "second"}},
+		},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+	rs := n.(*ruleSet)
+	first, second := rs.rules[0].Notifier.(*ruleNotifier), rs.rules[1].Notifier.(*ruleNotifier)
+	second.err = errors.New("got a 503")
+
+	handler := newReceiver(n, &receiverParams{dedup: &deduper{store: newMemoryDedupStore(100), ttl: time.Hour}})
+	send := func(msgID string, status cbpb.Build_Status, wantCode int) {
+		t.Helper()
+		data, err := protojson.Marshal(&cbpb.Build{Id: "some-build", Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{ID: msgID, Data: data}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", bytes.NewBuffer(body)))
+		if got := w.Result().StatusCode; got != wantCode {
+			t.Errorf("message %q: got status code %d, want %d", msgID, got, wantCode)
+		}
+	}
+	wantBuilds := func(wantFirst, wantSecond int) {
+		t.Helper()
+		if len(first.builds) != wantFirst || len(second.builds) != wantSecond {
+			t.Errorf("rules got %d and %d Builds, want %d and %d", len(first.builds), len(second.builds), wantFirst, wantSecond)
+		}
+	}
+
+	// The second rule fails, so the message is redelivered, but only the second rule gets the Build again.
+	send("msg-1", cbpb.Build_SUCCESS, http.StatusInternalServerError)
+	wantBuilds(1, 1)
+	second.err = nil
+	send("msg-1", cbpb.Build_SUCCESS, http.StatusOK)
+	wantBuilds(1, 2)
+
+	// A redelivered message is acked without sending anything.
+	send("msg-1", cbpb.Build_SUCCESS, http.StatusOK)
+	wantBuilds(1, 2)
+
+	// So is another message for the same Build status, while a new status is delivered.
+	send("msg-2", cbpb.Build_SUCCESS, http.StatusOK)
+	wantBuilds(1, 2)
+	send("msg-3", cbpb.Build_FAILURE, http.StatusOK)
+	wantBuilds(2, 3)
+}
+
+func TestReceiverRemembersDeliveredRules(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "delivered"},
+		Spec: &Spec{
+			Notifications: []*Notification{{Filter: "first"}, {Filter: "second"}},
+		},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+	rs := n.(*ruleSet)
+	first, second := rs.rules[0].Notifier.(*ruleNotifier), rs.rules[1].Notifier.(*ruleNotifier)
+	second.err = errors.New("got a 503")
+
+	handler := newReceiver(n, &receiverParams{delivered: newDeliveredRules()})
+	data, err := protojson.Marshal(&cbpb.Build{Id: "some-build", Status: cbpb.Build_FAILURE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{ID: "msg-1", Data: data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK} {
+		if i == 2 {
+			second.err = nil
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", bytes.NewBuffer(body)))
+		if got := w.Result().StatusCode; got != want {
+			t.Errorf("delivery %d: got status code %d, want %d", i+1, got, want)
+		}
+	}
+
+	// Only the failing rule gets the redelivered Build, until it succeeds.
+	if len(first.builds) != 1 || len(second.builds) != 3 {
+		t.Errorf("rules got %d and %d Builds, want 1 and 3", len(first.builds), len(second.builds))
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sampleBuild is a Build that the setup check renders templates with and evaluates filters against.
+type sampleBuild struct {
+	name  string
+	build *cbpb.Build
+	// builtIn is true for the sample Builds that ship with the library. Binding errors for those are only reported,
+	// since they cannot know about every substitution that a config refers to, as are network errors from rendering
+	// them, since the check must not depend on the made-up resources they refer to.
+	builtIn bool
+}
+
+// sampleBuilds returns the built-in sample Builds: SUCCESS, FAILURE and TIMEOUT, each with and without a trigger.
+func sampleBuilds() []*sampleBuild {
+	created := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	statuses := []struct {
+		status  cbpb.Build_Status
+		elapsed time.Duration
+		failure *cbpb.Build_FailureInfo
+	}{
+		{cbpb.Build_SUCCESS, 83 * time.Second, nil},
+		{cbpb.Build_FAILURE, 42 * time.Second, &cbpb.Build_FailureInfo{
+			Type:   cbpb.Build_FailureInfo_USER_BUILD_STEP,
+			Detail: `Build step failure: build step 1 "gcr.io/cloud-builders/go" failed: step exited with non-zero status: 1`,
+		}},
+		{cbpb.Build_TIMEOUT, 10 * time.Minute, nil},
+	}
+
+	var samples []*sampleBuild
+	for _, s := range statuses {
+		for _, withTrigger := range []bool{true, false} {
+			id := fmt.Sprintf("sample-%s-build-id", strings.ToLower(s.status.String()))
+			b := &cbpb.Build{
+				Id:         id,
+				ProjectId:  "sample-project",
+				Status:     s.status,
+				LogUrl:     fmt.Sprintf("https://console.cloud.google.com/cloud-build/builds/%s?project=sample-project", id),
+				CreateTime: timestamppb.New(created),
+				StartTime:  timestamppb.New(created.Add(5 * time.Second)),
+				FinishTime: timestamppb.New(created.Add(5*time.Second + s.elapsed)),
+				Timeout:    durationpb.New(10 * time.Minute),
+				Steps: []*cbpb.BuildStep{
+					{Name: "gcr.io/cloud-builders/docker", Args: []string{"build", "-t", "gcr.io/sample-project/sample-image", "."}},
+					{Name: "gcr.io/cloud-builders/go", Args: []string{"test", "./..."}},
+				},
+				FailureInfo: s.failure,
+				Substitutions: map[string]string{
+					"PROJECT_ID": "sample-project",
+					"BUILD_ID":   id,
+				},
+			}
+			name := strings.ToLower(s.status.String())
+			if withTrigger {
+				name += "-with-trigger"
+				b.BuildTriggerId = "sample-trigger-id"
+				for k, v := range map[string]string{
+					"TRIGGER_NAME":    "sample-trigger",
+					"REPO_NAME":       "sample-repo",
+					"BRANCH_NAME":     "main",
+					"REF_NAME":        "main",
+					"COMMIT_SHA":      "0123456789abcdef0123456789abcdef01234567",
+					"SHORT_SHA":       "0123456",
+					"REVISION_ID":     "0123456789abcdef0123456789abcdef01234567",
+					"_COMMIT_MESSAGE": "Fix the flaky test",
+				} {
+					b.Substitutions[k] = v
+				}
+			} else {
+				name += "-without-trigger"
+			}
+			samples = append(samples, &sampleBuild{name: name, build: b, builtIn: true})
+		}
+	}
+	return samples
+}
+
+// readSampleBuilds reads user-supplied Builds from the given JSON files (in the format of Cloud Build Pub/Sub
+// messages).
+func readSampleBuilds(paths []string) ([]*sampleBuild, error) {
+	var samples []*sampleBuild
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Build JSON file: %w", err)
+		}
+		build := new(cbpb.Build)
+		uo := protojson.UnmarshalOptions{DiscardUnknown: true}
+		if err := uo.Unmarshal(data, build); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Build JSON from %q: %w", path, err)
+		}
+		samples = append(samples, &sampleBuild{name: path, build: build})
+	}
+	return samples, nil
+}
+
+// dryRun renders the payload and evaluates the filter of every notification rule of the given Notifier (as returned
+// by setUpConfigs) against each of the given Builds, and writes the results to w. Nothing is delivered.
+// It returns an error if any payload fails to render (other than from network I/O for a built-in sample Build), or if
+// any parameter of a user-supplied Build cannot be bound.
+func dryRun(ctx context.Context, w io.Writer, notifier Notifier, samples []*sampleBuild) error {
+	var errs []error
+	for _, rl := range rulesOf(notifier) {
+		prd, err := MakeCELPredicate(rl.cfg.Spec.Notification.Filter)
+		if err != nil {
+			return fmt.Errorf("failed to make CEL predicate for notification rule %s: %w", rl.name, err)
+		}
+		_, renderer := rl.Notifier.(Renderer)
+
+		for _, s := range samples {
+			matched := "filter matched"
+			if ok, err := prd.eval(ctx, s.build); err != nil {
+				matched = fmt.Sprintf("filter failed: %v", err)
+			} else if !ok {
+				matched = "filter did not match"
+			}
+			fmt.Fprintf(w, "--- %s / %s (%s): %s\n", rl.name, s.name, s.build.Status, matched)
+			if !renderer && rl.tmpl == "" {
+				continue
+			}
+
+			params, err := rl.br.Resolve(ctx, rl.sg, s.build)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: failed to bind params: %v\n", err)
+				if !s.builtIn {
+					errs = append(errs, fmt.Errorf("%s / %s: failed to bind params: %w", rl.name, s.name, err))
+				}
+			}
+
+			payload, err := renderDryRun(ctx, rl, s.build, params)
+			if err != nil && s.builtIn && isNetworkError(err) {
+				fmt.Fprintf(w, "WARNING: %v\n", err)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %v\n", err)
+				errs = append(errs, fmt.Errorf("%s / %s: %w", rl.name, s.name, err))
+				continue
+			}
+			if strings.Contains(payload, "<no value>") {
+				fmt.Fprintf(w, "WARNING: the rendered payload contains `<no value>` for a missing field or key\n")
+			}
+			fmt.Fprintf(w, "%s\n", payload)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isNetworkError reports whether err comes from network I/O, e.g. a Renderer looking up a resource that a sample Build
+// refers to.
+func isNetworkError(err error) bool {
+	var ue *url.Error
+	var ne net.Error
+	return errors.As(err, &ue) || errors.As(err, &ne)
+}
+
+// renderDryRun returns the payload that the rule's Notifier would deliver for the Build, if it is a Renderer.
+// Otherwise, it executes the rule's template with the given params and checks that payloads that look like JSON are
+// valid.
+func renderDryRun(ctx context.Context, rl *rule, build *cbpb.Build, params map[string]string) (string, error) {
+	if r, ok := rl.Notifier.(Renderer); ok {
+		return r.Render(ctx, proto.Clone(build).(*cbpb.Build))
+	}
+
+	tmpl, err := template.New(rl.name).Funcs(TemplateFuncs()).Parse(rl.tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	view := &TemplateView{Build: &BuildView{Build: build}, Params: params, Message: new(MessageView)}
+	if err := tmpl.Execute(buf, view); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	payload := buf.String()
+	if trimmed := strings.TrimSpace(payload); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), new(interface{})); err != nil {
+			return "", fmt.Errorf("template rendered invalid JSON: %w\n%s", err, payload)
+		}
+	}
+	return payload, nil
+}
+
+// setupCheckConfigSource returns the ConfigSource that the setup check reads templates and partials with. It is that
+// of the notifier, except that `sm://` URIs are read as empty templates, since the setup check has no secrets.
+func setupCheckConfigSource(grf gcsReaderFactory) ConfigSource {
+	return schemeSource{
+		"gs":    &gcsSource{grf},
+		"file":  fileSource{},
+		"https": &httpsSource{http.DefaultClient},
+		"sm":    setupCheckSource{},
+	}
+}
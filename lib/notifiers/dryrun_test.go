@@ -0,0 +1,229 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+)
+
+func TestSampleBuilds(t *testing.T) {
+	got := map[cbpb.Build_Status]int{}
+	for _, s := range sampleBuilds() {
+		got[s.build.Status]++
+		if hasTrigger := s.build.BuildTriggerId != ""; hasTrigger != strings.HasSuffix(s.name, "-with-trigger") {
+			t.Errorf("sample Build %q has BuildTriggerId %q", s.name, s.build.BuildTriggerId)
+		}
+	}
+	for _, status := range []cbpb.Build_Status{cbpb.Build_SUCCESS, cbpb.Build_FAILURE, cbpb.Build_TIMEOUT} {
+		if got[status] != 2 {
+			t.Errorf("got %d sample Builds with status %v, want 2", got[status], status)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "dry-run"},
+		Spec: &Spec{Notifications: []*Notification{{
+			Filter: "build.status == Build.Status.FAILURE",
+			Params: map[string]string{"trigger": "$(build.substitutions.TRIGGER_NAME)"},
+			Template: &Template{
+				Type:    "golang",
+				Content: `{"text": "{{ statusEmoji .Build.Status }} {{ .Build.Id }} {{ .Params.trigger }}"}`,
+			},
+		}, {
+			Filter: "true",
+		}}},
+	}
+
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), setupCheckSource{})
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := dryRun(ctx, buf, n, sampleBuilds()); err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+	out := buf.String()
+	t.Logf("dryRun output:\n%s", out)
+
+	for _, want := range []string{
+		"--- dry-run[0] / failure-with-trigger (FAILURE): filter matched\n" +
+			`{"text": "❌ sample-failure-build-id sample-trigger"}`,
+		"--- dry-run[0] / success-with-trigger (SUCCESS): filter did not match\n",
+		// Binding errors for built-in samples are only reported.
+		"--- dry-run[0] / timeout-without-trigger (TIMEOUT): filter did not match\nERROR: failed to bind params",
+		"--- dry-run[1] / timeout-without-trigger (TIMEOUT): filter matched\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dryRun output does not contain %q", want)
+		}
+	}
+}
+
+func TestDryRunPrefersRenderer(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestRenderNotifier",
+		Metadata:   &Metadata{Name: "renderer"},
+		Spec: &Spec{Notification: &Notification{
+			Filter:   "build.status == Build.Status.SUCCESS",
+			Template: &Template{Type: "golang", Content: `{{ .Build.Id }} from the template`},
+		}},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(renderingNotifier)), new(setupCheckSecretGetter), setupCheckSource{})
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+	samples := sampleBuilds()
+	buf := new(bytes.Buffer)
+	if err := dryRun(ctx, buf, n, samples); err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+
+	want := "--- renderer[0] / success-with-trigger (SUCCESS): filter matched\nrendered sample-success-build-id\n"
+	if out := buf.String(); !strings.Contains(out, want) {
+		t.Errorf("dryRun output = %q, want it to contain %q", out, want)
+	}
+	if strings.Contains(samples[0].build.LogUrl, "modified") {
+		t.Errorf("Render modified the sample Build's log URL to %q", samples[0].build.LogUrl)
+	}
+}
+
+func TestSetupCheckConfigSource(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := os.WriteFile(path, []byte(`{{ .Build.Id }}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	grf := &fakeGCSReaderFactory{data: map[string]string{"gs://bucket/template.json": `{"text": "{{ .Build.Id }}"}`}}
+	src := setupCheckConfigSource(grf)
+	for uri, want := range map[string]string{
+		"file://" + path:              `{{ .Build.Id }}`,
+		"gs://bucket/template.json":   `{"text": "{{ .Build.Id }}"}`,
+		"sm://projects/p/secrets/s/1": "",
+	} {
+		got, err := getTemplate(ctx, src, uri)
+		if err != nil {
+			t.Errorf("getTemplate(%q) failed: %v", uri, err)
+		} else if got != want {
+			t.Errorf("getTemplate(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestDryRunErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	buildPath := filepath.Join(dir, "build.json")
+	if err := os.WriteFile(buildPath, []byte(`{"id": "user-build", "status": "SUCCESS", "unknownField": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	userBuilds, err := readSampleBuilds([]string{buildPath})
+	if err != nil {
+		t.Fatalf("readSampleBuilds failed: %v", err)
+	}
+	if got := userBuilds[0].build.Id; got != "user-build" {
+		t.Fatalf("readSampleBuilds got Build ID %q, want %q", got, "user-build")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]string
+		tmpl   string
+	}{{
+		name: "invalid JSON",
+		tmpl: `{"text": "{{ .Build.Id }}",}`,
+	}, {
+		name: "execution error",
+		tmpl: `{{ formatTime "RFC3339" "Not/AZone" .Build.CreateTime }}`,
+	}, {
+		name:   "binding error for user-supplied Build",
+		params: map[string]string{"trigger": "$(build.substitutions.TRIGGER_NAME)"},
+		tmpl:   `{{ .Params.trigger }}`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{
+				Kind: "TestNotifier",
+				Spec: &Spec{Notification: &Notification{
+					Filter:   "true",
+					Params:   tc.params,
+					Template: &Template{Type: "golang", Content: tc.tmpl},
+				}},
+			}
+			n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), setupCheckSource{})
+			if err != nil {
+				t.Fatalf("setUpConfigs failed: %v", err)
+			}
+			samples := append(sampleBuilds()[:1], userBuilds...)
+			if err := dryRun(ctx, new(bytes.Buffer), n, samples); err == nil {
+				t.Errorf("dryRun unexpectedly succeeded")
+			}
+		})
+	}
+
+	if _, err := readSampleBuilds([]string{filepath.Join(dir, "missing.json")}); err == nil {
+		t.Errorf("readSampleBuilds with a missing file unexpectedly succeeded")
+	}
+}
+
+type offlineRenderNotifier struct {
+	ruleNotifier
+}
+
+func (o *offlineRenderNotifier) Render(context.Context, *cbpb.Build) (string, error) {
+	return "", &url.Error{Op: "Get", URL: "https://gcr.io/v2/", Err: errors.New("no network")}
+}
+
+func TestDryRunNetworkErrors(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestOfflineRenderNotifier",
+		Metadata:   &Metadata{Name: "offline"},
+		Spec:       &Spec{Notification: &Notification{Filter: "true"}},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(offlineRenderNotifier)), new(setupCheckSecretGetter), setupCheckSource{})
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := dryRun(ctx, buf, n, sampleBuilds()); err != nil {
+		t.Errorf("dryRun with built-in sample Builds failed: %v", err)
+	}
+	if want := "WARNING: Get \"https://gcr.io/v2/\": no network"; !strings.Contains(buf.String(), want) {
+		t.Errorf("dryRun output = %q, want it to contain %q", buf.String(), want)
+	}
+
+	user := &sampleBuild{name: "build.json", build: &cbpb.Build{Id: "user-build"}}
+	if err := dryRun(ctx, new(bytes.Buffer), n, []*sampleBuild{user}); err == nil {
+		t.Errorf("dryRun with a user-supplied Build unexpectedly succeeded")
+	}
+}
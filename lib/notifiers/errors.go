@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBodyBytes is how much of an unsuccessful HTTP response body is included in an HTTPStatusError.
+const maxErrorBodyBytes = 512
+
+// PermanentError is returned by a Notifier's SendNotification for failures that redelivering the same Build cannot
+// fix, such as a template that fails to execute or a destination that rejects the request.
+// The receiver acks messages whose notifications failed permanently instead of having Pub/Sub redeliver them.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// RetryableError is returned by a Notifier's SendNotification for failures that may go away when the Build is
+// delivered again, such as timeouts, rate limiting and server errors.
+// Errors that are neither a PermanentError nor a RetryableError are treated as retryable.
+type RetryableError struct {
+	Err error
+	// RetryAfter, if positive, is how long the destination asked to wait before retrying.
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps the given error in a PermanentError. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Retryable wraps the given error in a RetryableError. It returns nil if err is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// IsPermanent returns true if the given error, or every one of the errors joined in it, was classified as permanent.
+// The outermost classification in an error chain wins.
+func IsPermanent(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *PermanentError:
+		return true
+	case *RetryableError:
+		return false
+	case interface{ Unwrap() []error }:
+		errs := e.Unwrap()
+		for _, err := range errs {
+			if !IsPermanent(err) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	case interface{ Unwrap() error }:
+		return IsPermanent(e.Unwrap())
+	default:
+		return false
+	}
+}
+
+// HTTPStatusError is the error for an unsuccessful HTTP response.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	// Body is the start of the response body.
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("got a non-OK response status %q", e.Status)
+	}
+	return fmt.Sprintf("got a non-OK response status %q: %s", e.Status, e.Body)
+}
+
+// CheckResponse returns nil for a 2xx response. Otherwise, it returns an HTTPStatusError that is classified by
+// ClassifyHTTPStatus, and that carries the response's `Retry-After` if it is retryable. A 403 or 429 response that
+// signals rate limiting with `Retry-After` or `X-RateLimit-Remaining: 0` (as GitHub's secondary and primary rate
+// limits do) is retryable after the signalled wait. It does not close the response body.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	hse := &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+	now := time.Now()
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		if wait, ok := rateLimitWait(resp.Header, now); ok {
+			return &RetryableError{Err: hse, RetryAfter: wait}
+		}
+	}
+	err := ClassifyHTTPStatus(resp.StatusCode, hse)
+	if re, ok := err.(*RetryableError); ok {
+		re.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	}
+	return err
+}
+
+// rateLimitWait reports whether the given response headers signal rate limiting, and if so, how long to wait before
+// retrying: the `Retry-After`, or else the time until `X-RateLimit-Reset` (in UTC epoch seconds) once
+// `X-RateLimit-Remaining` is 0. The wait is 0 if the headers do not say.
+func rateLimitWait(header http.Header, now time.Time) (time.Duration, bool) {
+	if ra := header.Get("Retry-After"); ra != "" {
+		return parseRetryAfter(ra, now), true
+	}
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0, true
+	}
+	if t := time.Unix(reset, 0); t.After(now) {
+		return t.Sub(now), true
+	}
+	return 0, true
+}
+
+// ClassifyHTTPStatus wraps the given error for an HTTP response with the given status code in a RetryableError for
+// request timeouts (408), rate limiting (429) and server errors (5xx), and in a PermanentError otherwise.
+// Use CheckResponse to also take the response's rate limiting headers into account.
+func ClassifyHTTPStatus(code int, err error) error {
+	if code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500 {
+		return Retryable(err)
+	}
+	return Permanent(err)
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPermanent(t *testing.T) {
+	permanent := Permanent(errors.New("bad template"))
+	retryable := Retryable(errors.New("got a 503"))
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "unclassified", err: errors.New("connection reset"), want: false},
+		{name: "permanent", err: permanent, want: true},
+		{name: "wrapped permanent", err: fmt.Errorf("notification rule a[0]: %w", permanent), want: true},
+		{name: "retryable", err: retryable, want: false},
+		{name: "retryable outside permanent", err: Retryable(permanent), want: false},
+		{name: "permanent outside retryable", err: Permanent(retryable), want: true},
+		{name: "joined permanent", err: errors.Join(permanent, fmt.Errorf("wrapped: %w", permanent)), want: true},
+		{name: "joined permanent and retryable", err: errors.Join(permanent, retryable), want: false},
+		{name: "joined permanent and unclassified", err: errors.Join(permanent, errors.New("EOF")), want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsPermanent(tc.err); got != tc.want {
+				t.Errorf("IsPermanent(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+
+	if Permanent(nil) != nil || Retryable(nil) != nil {
+		t.Error("wrapping a nil error returned a non-nil error")
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	for _, tc := range []struct {
+		code          int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{code: http.StatusOK},
+		{code: http.StatusCreated},
+		{code: http.StatusNoContent},
+		{code: http.StatusBadRequest, wantErr: true, wantPermanent: true},
+		{code: http.StatusNotFound, wantErr: true, wantPermanent: true},
+		{code: http.StatusRequestTimeout, wantErr: true},
+		{code: http.StatusTooManyRequests, wantErr: true},
+		{code: http.StatusInternalServerError, wantErr: true},
+		{code: http.StatusServiceUnavailable, wantErr: true},
+	} {
+		t.Run(http.StatusText(tc.code), func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tc.code,
+				Status:     fmt.Sprintf("%d %s", tc.code, http.StatusText(tc.code)),
+				Body:       io.NopCloser(strings.NewReader(" some details\n")),
+			}
+			err := CheckResponse(resp)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("CheckResponse() = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			if got := IsPermanent(err); got != tc.wantPermanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, got, tc.wantPermanent)
+			}
+			var hse *HTTPStatusError
+			if !errors.As(err, &hse) || hse.StatusCode != tc.code || hse.Body != "some details" {
+				t.Errorf("CheckResponse() = %#v, want an HTTPStatusError with code %d and the trimmed body", err, tc.code)
+			}
+		})
+	}
+}
+
+func TestCheckResponseRateLimited(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	for _, tc := range []struct {
+		name          string
+		code          int
+		header        http.Header
+		wantPermanent bool
+		wantAtLeast   time.Duration
+		wantAtMost    time.Duration
+	}{{
+		name:          "forbidden",
+		code:          http.StatusForbidden,
+		header:        http.Header{"X-Ratelimit-Remaining": {"12"}},
+		wantPermanent: true,
+	}, {
+		name:        "forbidden with Retry-After",
+		code:        http.StatusForbidden,
+		header:      http.Header{"Retry-After": {"60"}},
+		wantAtLeast: time.Minute,
+		wantAtMost:  time.Minute,
+	}, {
+		name:        "forbidden with no remaining requests",
+		code:        http.StatusForbidden,
+		header:      http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {reset}},
+		wantAtLeast: 59 * time.Minute,
+		wantAtMost:  time.Hour,
+	}, {
+		name:   "forbidden with no remaining requests and no reset",
+		code:   http.StatusForbidden,
+		header: http.Header{"X-Ratelimit-Remaining": {"0"}},
+	}, {
+		name:        "too many requests with no remaining requests",
+		code:        http.StatusTooManyRequests,
+		header:      http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {reset}},
+		wantAtLeast: 59 * time.Minute,
+		wantAtMost:  time.Hour,
+	}, {
+		name:          "not found with Retry-After",
+		code:          http.StatusNotFound,
+		header:        http.Header{"Retry-After": {"60"}},
+		wantPermanent: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tc.code,
+				Status:     fmt.Sprintf("%d %s", tc.code, http.StatusText(tc.code)),
+				Header:     tc.header,
+				Body:       io.NopCloser(strings.NewReader("rate limited")),
+			}
+			err := CheckResponse(resp)
+			if got := IsPermanent(err); got != tc.wantPermanent {
+				t.Fatalf("IsPermanent(%v) = %v, want %v", err, got, tc.wantPermanent)
+			}
+			if tc.wantPermanent {
+				return
+			}
+			var re *RetryableError
+			if !errors.As(err, &re) {
+				t.Fatalf("CheckResponse() = %#v, want a RetryableError", err)
+			}
+			if re.RetryAfter < tc.wantAtLeast || re.RetryAfter > tc.wantAtMost {
+				t.Errorf("RetryAfter = %v, want between %v and %v", re.RetryAfter, tc.wantAtLeast, tc.wantAtMost)
+			}
+			var hse *HTTPStatusError
+			if !errors.As(err, &hse) || hse.StatusCode != tc.code {
+				t.Errorf("CheckResponse() = %#v, want an HTTPStatusError with code %d", err, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// messagePublishedType is the type of the CloudEvents that Eventarc delivers for Pub/Sub messages.
+	messagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+	// cloudEventsJSON is the content type of structured-mode CloudEvents.
+	cloudEventsJSON = "application/cloudevents+json"
+)
+
+// messagePublishedData is the data of a messagePublished CloudEvent.
+type messagePublishedData struct {
+	Message      pubSubPushMessage `json:"message"`
+	Subscription string            `json:"subscription"`
+}
+
+// structuredCloudEvent is a structured-mode CloudEvent, whose attributes and data are all in the request body.
+type structuredCloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	Type        string          `json:"type"`
+	ID          string          `json:"id"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	DataBase64  []byte          `json:"data_base64,omitempty"`
+}
+
+// decodePushRequest decodes the body of a request to the receiver, which is one of
+//   - a Pub/Sub push envelope,
+//   - a binary-mode CloudEvent, whose attributes are `Ce-` headers,
+//   - a structured-mode CloudEvent,
+//   - or the JSON of a Build,
+//
+// into the envelope that the Pub/Sub message would have been pushed in. CloudEvents must be messagePublished events,
+// like Eventarc delivers for Pub/Sub topics. Builds are wrapped in a message without an ID.
+func decodePushRequest(r *http.Request, body []byte) (*pubSubPushWrapper, error) {
+	if specVersion := r.Header.Get("Ce-Specversion"); specVersion != "" {
+		return decodeMessagePublished(r.Header.Get("Ce-Type"), r.Header.Get("Ce-Id"), body)
+	}
+
+	var probe struct {
+		Message     *json.RawMessage
+		SpecVersion string `json:"specversion"`
+		ID          string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal request body: %w", err)
+	}
+
+	switch {
+	case strings.HasPrefix(r.Header.Get("Content-Type"), cloudEventsJSON) || probe.SpecVersion != "":
+		ce := new(structuredCloudEvent)
+		if err := json.Unmarshal(body, ce); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal structured CloudEvent: %w", err)
+		}
+		data := []byte(ce.Data)
+		if ce.DataBase64 != nil {
+			data = ce.DataBase64
+		}
+		return decodeMessagePublished(ce.Type, ce.ID, data)
+	case probe.Message != nil:
+		pspw := new(pubSubPushWrapper)
+		if err := json.Unmarshal(body, pspw); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Pub/Sub push envelope: %w", err)
+		}
+		return pspw, nil
+	case probe.ID != "":
+		return &pubSubPushWrapper{Message: pubSubPushMessage{Data: body}}, nil
+	default:
+		return nil, errors.New("expected a Pub/Sub push envelope, a CloudEvent or a Build")
+	}
+}
+
+// decodeMessagePublished returns the Pub/Sub push envelope for the data of a CloudEvent with the given type and ID.
+func decodeMessagePublished(ceType, ceID string, data []byte) (*pubSubPushWrapper, error) {
+	if ceType != messagePublishedType {
+		return nil, fmt.Errorf("expected CloudEvent %q to be of type %q, got %q", ceID, messagePublishedType, ceType)
+	}
+	mpd := new(messagePublishedData)
+	if err := json.Unmarshal(data, mpd); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal data of CloudEvent %q: %w", ceID, err)
+	}
+
+	pspw := &pubSubPushWrapper{Message: mpd.Message, Subscription: mpd.Subscription}
+	// Eventarc uses the Pub/Sub message ID as the event ID.
+	if pspw.Message.ID == "" {
+		pspw.Message.ID = ceID
+	}
+	return pspw, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestDecodePushRequest(t *testing.T) {
+	build, err := protojson.Marshal(&cbpb.Build{Id: "some-build-id", Status: cbpb.Build_SUCCESS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := base64.StdEncoding.EncodeToString(build)
+	messagePublished := fmt.Sprintf(`{
+		"message": {"data": %q, "messageId": "some-message-id", "publishTime": "2020-01-01T12:00:00Z"},
+		"subscription": "projects/some-project/subscriptions/eventarc-sub"
+	}`, data)
+	fromEventarc := &pubSubPushWrapper{
+		Message:      pubSubPushMessage{Data: build, ID: "some-message-id", PublishTime: "2020-01-01T12:00:00Z"},
+		Subscription: "projects/some-project/subscriptions/eventarc-sub",
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		body    string
+		want    *pubSubPushWrapper
+		wantErr bool
+	}{{
+		name: "push envelope",
+		body: fmt.Sprintf(`{"message": {"data": %q, "id": "some-message-id"}, "subscription": "some-sub"}`, data),
+		want: &pubSubPushWrapper{Message: pubSubPushMessage{Data: build, ID: "some-message-id"}, Subscription: "some-sub"},
+	}, {
+		name: "binary CloudEvent",
+		headers: map[string]string{
+			"Ce-Specversion": "1.0",
+			"Ce-Type":        messagePublishedType,
+			"Ce-Id":          "some-message-id",
+			"Ce-Source":      "//pubsub.googleapis.com/projects/some-project/topics/cloud-builds",
+			"Content-Type":   "application/json",
+		},
+		body: messagePublished,
+		want: fromEventarc,
+	}, {
+		name:    "structured CloudEvent",
+		headers: map[string]string{"Content-Type": cloudEventsJSON},
+		body: fmt.Sprintf(`{"specversion": "1.0", "type": %q, "id": "some-message-id", "source": "//pubsub.googleapis.com/", "data": %s}`,
+			messagePublishedType, messagePublished),
+		want: fromEventarc,
+	}, {
+		name: "structured CloudEvent with base64 data and without a content type",
+		body: fmt.Sprintf(`{"specversion": "1.0", "type": %q, "id": "some-event-id", "data_base64": %q}`,
+			messagePublishedType, base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"message": {"data": %q}}`, data)))),
+		want: &pubSubPushWrapper{Message: pubSubPushMessage{Data: build, ID: "some-event-id"}},
+	}, {
+		name: "Build",
+		body: string(build),
+		want: &pubSubPushWrapper{Message: pubSubPushMessage{Data: build}},
+	}, {
+		name:    "other CloudEvent type",
+		headers: map[string]string{"Ce-Specversion": "1.0", "Ce-Type": "google.cloud.storage.object.v1.finalized", "Ce-Id": "1"},
+		body:    `{"bucket": "some-bucket"}`,
+		wantErr: true,
+	}, {
+		name:    "bad CloudEvent data",
+		headers: map[string]string{"Ce-Specversion": "1.0", "Ce-Type": messagePublishedType, "Ce-Id": "1"},
+		body:    `#corrupted#`,
+		wantErr: true,
+	}, {
+		name:    "unrecognized object",
+		body:    `{"hello": "world"}`,
+		wantErr: true,
+	}, {
+		name:    "not JSON",
+		body:    `#corrupted#`,
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			got, err := decodePushRequest(req, []byte(tc.body))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodePushRequest() = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("decodePushRequest() got unexpected diff: (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReceiverAcceptsCloudEventsAndBuilds(t *testing.T) {
+	build, err := protojson.Marshal(&cbpb.Build{Id: "some-build-id", Status: cbpb.Build_FAILURE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(ruleNotifier)
+	handler := newReceiver(n, &receiverParams{})
+
+	ce := httptest.NewRequest(http.MethodPost, "http://notifier.example.com/",
+		bytes.NewBufferString(fmt.Sprintf(`{"message": {"data": %q, "messageId": "1"}}`, base64.StdEncoding.EncodeToString(build))))
+	ce.Header.Set("Ce-Specversion", "1.0")
+	ce.Header.Set("Ce-Type", messagePublishedType)
+	ce.Header.Set("Ce-Id", "1")
+	raw := httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", bytes.NewReader(build))
+
+	for _, req := range []*http.Request{ce, raw} {
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if got := w.Result().StatusCode; got != http.StatusOK {
+			t.Errorf("got status %d, want %d", got, http.StatusOK)
+		}
+	}
+	if diff := cmp.Diff([]string{"some-build-id", "some-build-id"}, n.builds); diff != "" {
+		t.Errorf("notifier got unexpected Builds: (-want +got)\n%s", diff)
+	}
+}
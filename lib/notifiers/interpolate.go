@@ -0,0 +1,173 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// envVarPattern matches `$${...}` (an escaped, literal `${...}`) and `${NAME}`, `${NAME:-default}` and
+// `${NAME-default}` references.
+var envVarPattern = regexp.MustCompile(`\$(\$)?\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\}`)
+
+// interpolatedFields are the fields of notification rules whose values are interpolated. Other fields, such as
+// templates and filters, are free text that may contain a literal `${...}`.
+var interpolatedFields = []string{"delivery", "params"}
+
+// interpolateEnv parses the given YAML config, replaces environment variable references in the `delivery` and `params`
+// values of its notification rules with their values (see interpolateString) and encodes it again. Keys and comments
+// are left as they are, and the values of variables are never parsed as YAML. All unresolved references are reported
+// in a single error, together with the paths of their values.
+func interpolateEnv(raw []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var unresolved []string
+	for _, root := range doc.Content {
+		spec := mappingValue(root, "spec")
+		rules := map[string]*yaml.Node{}
+		if n := mappingValue(spec, "notification"); n != nil {
+			rules["config.spec.notification"] = n
+		}
+		if ns := mappingValue(spec, "notifications"); ns != nil && ns.Kind == yaml.SequenceNode {
+			for i, n := range ns.Content {
+				rules[fmt.Sprintf("config.spec.notifications[%d]", i)] = n
+			}
+		}
+		for path, n := range rules {
+			for _, field := range interpolatedFields {
+				if v := mappingValue(n, field); v != nil {
+					interpolateNode(v, path+"."+field, &unresolved)
+				}
+			}
+		}
+	}
+	sort.Strings(unresolved)
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("unresolved environment variables in config: %s; set them or use `${NAME:-default}`",
+			strings.Join(unresolved, ", "))
+	}
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode interpolated config: %w", err)
+	}
+	return out, nil
+}
+
+// mappingValue returns the value of the given key in the given mapping node, or nil if there is none.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// interpolateNode interpolates the string scalars in the given node, which is at the given path. Quoted scalars stay
+// strings. A plain scalar that is a single reference to a number or boolean (see scalarValue) takes that type, as if
+// the value had been written in the config.
+func interpolateNode(n *yaml.Node, path string, unresolved *[]string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			interpolateNode(n.Content[i+1], fmt.Sprintf("%s.%s", path, n.Content[i].Value), unresolved)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			interpolateNode(c, fmt.Sprintf("%s[%d]", path, i), unresolved)
+		}
+	case yaml.ScalarNode:
+		if n.ShortTag() != "!!str" {
+			return
+		}
+		s, missing := interpolateString(n.Value)
+		for _, name := range missing {
+			*unresolved = append(*unresolved, fmt.Sprintf("${%s} (at %s)", name, path))
+		}
+		if s == n.Value {
+			return
+		}
+		plain := n.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0
+		if _, isString := scalarValue(s).(string); plain && !isString && envVarPattern.FindString(n.Value) == n.Value {
+			// Without a tag, the plain scalar is resolved again when the config is decoded.
+			n.Tag = ""
+		} else {
+			n.Tag = "!!str"
+			if plain {
+				// Quoted, so that e.g. `yes` is not decoded as a boolean.
+				n.Style = yaml.DoubleQuotedStyle
+			}
+		}
+		n.Value = s
+	}
+}
+
+// interpolateString replaces environment variable references in the given string with their values:
+// - `${NAME}` is replaced with the value of NAME, which must be set.
+// - `${NAME:-default}` uses `default` if NAME is unset or empty.
+// - `${NAME-default}` uses `default` only if NAME is unset.
+// - `$${NAME}` is replaced with a literal `${NAME}`.
+// It also returns the names of unresolved references, which are left as they are.
+func interpolateString(s string) (string, []string) {
+	var unresolved []string
+	out := envVarPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envVarPattern.FindStringSubmatch(ref)
+		escaped, name, op, def := m[1] != "", m[2], m[3], m[4]
+		if escaped {
+			return ref[1:]
+		}
+
+		val, ok := os.LookupEnv(name)
+		switch {
+		case ok && (val != "" || op != ":-"):
+			return val
+		case op != "":
+			return def
+		default:
+			unresolved = append(unresolved, name)
+			return ref
+		}
+	})
+	return out, unresolved
+}
+
+// scalarValue returns the number or boolean that the given value is when decoded as the config is, so that a
+// reference to e.g. an integer is one. Values are never parsed as anything else, and values that would not be
+// written the same way (such as `007`) stay strings.
+func scalarValue(s string) interface{} {
+	var v interface{}
+	if err := yamlv2.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case int, int64, uint64, float64, bool:
+		if out, err := yamlv2.Marshal(v); err == nil && strings.TrimSuffix(string(out), "\n") == s {
+			return v
+		}
+	}
+	return s
+}
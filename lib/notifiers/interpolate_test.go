@@ -0,0 +1,231 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpolateString(t *testing.T) {
+	t.Setenv("NOTIFIER_TEST_CHANNEL", "#prod-builds")
+	t.Setenv("NOTIFIER_TEST_EMPTY", "")
+
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "no references",
+		in:   "build.status == Build.Status.SUCCESS",
+		want: "build.status == Build.Status.SUCCESS",
+	}, {
+		name: "set variable",
+		in:   "${NOTIFIER_TEST_CHANNEL}",
+		want: "#prod-builds",
+	}, {
+		name: "default for unset variable",
+		in:   "${NOTIFIER_TEST_UNSET:-projects/p/datasets/d/tables/dev}",
+		want: "projects/p/datasets/d/tables/dev",
+	}, {
+		name: "colon default for empty variable",
+		in:   "${NOTIFIER_TEST_EMPTY:-fallback}",
+		want: "fallback",
+	}, {
+		name: "dash default keeps empty variable",
+		in:   "${NOTIFIER_TEST_EMPTY-fallback}",
+		want: "",
+	}, {
+		name: "empty default",
+		in:   "${NOTIFIER_TEST_UNSET:-}",
+		want: "",
+	}, {
+		name: "escaped reference",
+		in:   "$${NOTIFIER_TEST_UNSET} and $NOTIFIER_TEST_CHANNEL",
+		want: "${NOTIFIER_TEST_UNSET} and $NOTIFIER_TEST_CHANNEL",
+	}, {
+		name: "several references on one line",
+		in:   "${NOTIFIER_TEST_CHANNEL}-${NOTIFIER_TEST_UNSET:-dev}",
+		want: "#prod-builds-dev",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, unresolved := interpolateString(tc.in)
+			if len(unresolved) != 0 {
+				t.Fatalf("interpolateString(%q) got unexpected unresolved variables: %v", tc.in, unresolved)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("interpolateString(%q) got unexpected diff: (-want +got)\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+func TestInterpolateEnvUnresolved(t *testing.T) {
+	in := `
+spec:
+  notifications:
+  - delivery:
+      a: ${NOTIFIER_TEST_UNSET_A}
+      b: ok
+      # c: ${NOTIFIER_TEST_UNSET_C}
+  - params:
+      d:
+      - ${NOTIFIER_TEST_UNSET_B}
+`
+	_, err := interpolateEnv([]byte(in))
+	if err == nil {
+		t.Fatalf("interpolateEnv(%q) unexpectedly succeeded", in)
+	}
+	for _, want := range []string{
+		"${NOTIFIER_TEST_UNSET_A} (at config.spec.notifications[0].delivery.a)",
+		"${NOTIFIER_TEST_UNSET_B} (at config.spec.notifications[1].params.d[0])",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("interpolateEnv(%q) error = %q, want it to contain %q", in, err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "NOTIFIER_TEST_UNSET_C") {
+		t.Errorf("interpolateEnv(%q) error = %q, want it to ignore the comment", in, err)
+	}
+}
+
+func TestDecodeConfigInterpolatesEnv(t *testing.T) {
+	t.Setenv("NOTIFIER_TEST_RECIPIENT", "oncall@example.com")
+	t.Setenv("NOTIFIER_TEST_FROM", "builds@example.com\nserver: evil.example.com")
+	t.Setenv("NOTIFIER_TEST_CHANNEL", "#prod-builds")
+
+	cfg, err := decodeConfig(strings.NewReader(`
+apiVersion: cloud-build-notifiers/v1
+kind: SMTPNotifier
+metadata:
+  name: smtp-notifier
+spec:
+  notification:
+    delivery:
+      # Disabled for now: ${NOTIFIER_TEST_UNSET}
+      recipients: ["${NOTIFIER_TEST_RECIPIENT}"]
+      from: ${NOTIFIER_TEST_FROM}
+    params:
+      channel: ${NOTIFIER_TEST_CHANNEL}
+      env: ${NOTIFIER_TEST_ENV:-dev}
+`))
+	if err != nil {
+		t.Fatalf("decodeConfig failed: %v", err)
+	}
+	if diff := cmp.Diff([]interface{}{"oncall@example.com"}, cfg.Spec.Notification.Delivery["recipients"]); diff != "" {
+		t.Errorf("got unexpected recipients diff: (-want +got)\n%s", diff)
+	}
+	if got, want := cfg.Spec.Notification.Delivery["from"], "builds@example.com\nserver: evil.example.com"; got != want {
+		t.Errorf("got delivery.from %q, want %q", got, want)
+	}
+	if _, ok := cfg.Spec.Notification.Delivery["server"]; ok {
+		t.Error("a variable injected delivery.server")
+	}
+	if diff := cmp.Diff(map[string]string{"channel": "#prod-builds", "env": "dev"}, cfg.Spec.Notification.Params); diff != "" {
+		t.Errorf("got unexpected params diff: (-want +got)\n%s", diff)
+	}
+
+	if _, err := decodeConfig(strings.NewReader("spec:\n  notification:\n    delivery:\n      url: ${NOTIFIER_TEST_UNSET}")); err == nil {
+		t.Error("decodeConfig with an unresolved variable unexpectedly succeeded")
+	}
+}
+
+func TestDecodeConfigLeavesFreeTextAlone(t *testing.T) {
+	t.Setenv("NOTIFIER_TEST_CHANNEL", "#prod-builds")
+
+	cfg, err := decodeConfig(strings.NewReader(`
+apiVersion: cloud-build-notifiers/v1
+kind: HTTPNotifier
+metadata:
+  name: ${NOT_A_VARIABLE}
+spec:
+  notification:
+    filter: build.substitutions["_X"] == "${NOT_A_VARIABLE}"
+    delivery:
+      url: https://example.com/${NOTIFIER_TEST_CHANNEL}
+    template:
+      type: golang
+      content: '{"cost": "${{ "{{" }}.Params.cost}}", "shell": "${HOME}"}'
+`))
+	if err != nil {
+		t.Fatalf("decodeConfig failed: %v", err)
+	}
+	if got, want := cfg.Metadata.Name, "${NOT_A_VARIABLE}"; got != want {
+		t.Errorf("got metadata.name %q, want %q", got, want)
+	}
+	if got, want := cfg.Spec.Notification.Filter, `build.substitutions["_X"] == "${NOT_A_VARIABLE}"`; got != want {
+		t.Errorf("got filter %q, want %q", got, want)
+	}
+	if got, want := cfg.Spec.Notification.Template.Content, `{"cost": "${{ "{{" }}.Params.cost}}", "shell": "${HOME}"}`; got != want {
+		t.Errorf("got template content %q, want %q", got, want)
+	}
+	if got, want := cfg.Spec.Notification.Delivery["url"], "https://example.com/#prod-builds"; got != want {
+		t.Errorf("got delivery.url %q, want %q", got, want)
+	}
+}
+
+func TestDecodeConfigKeepsQuotedValuesStrings(t *testing.T) {
+	t.Setenv("NOTIFIER_TEST_PORT", "587")
+	t.Setenv("NOTIFIER_TEST_ENABLED", "yes")
+
+	cfg, err := decodeConfig(strings.NewReader(`
+apiVersion: cloud-build-notifiers/v1
+kind: SMTPNotifier
+metadata:
+  name: smtp-notifier
+spec:
+  notification:
+    delivery:
+      server: smtp.example.com
+      port: '${NOTIFIER_TEST_PORT}'
+      doubleQuoted: "${NOTIFIER_TEST_PORT}"
+      unquoted: ${NOTIFIER_TEST_PORT}
+      enabled: ${NOTIFIER_TEST_ENABLED}
+`))
+	if err != nil {
+		t.Fatalf("decodeConfig failed: %v", err)
+	}
+	want := map[string]interface{}{
+		"server":       "smtp.example.com",
+		"port":         "587",
+		"doubleQuoted": "587",
+		"unquoted":     587,
+		"enabled":      "yes",
+	}
+	if diff := cmp.Diff(want, cfg.Spec.Notification.Delivery); diff != "" {
+		t.Errorf("got unexpected delivery diff: (-want +got)\n%s", diff)
+	}
+}
+
+func TestScalarValue(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want interface{}
+	}{
+		{in: "5", want: 5},
+		{in: "1.5", want: 1.5},
+		{in: "true", want: true},
+		{in: "007", want: "007"},
+		{in: "yes", want: "yes"},
+		{in: "a: b", want: "a: b"},
+		{in: "[a]", want: "[a]"},
+	} {
+		if got := scalarValue(tc.in); !cmp.Equal(got, tc.want) {
+			t.Errorf("scalarValue(%q) = %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -55,9 +55,16 @@ func newResolver(cfg *Config) (BindingResolver, error) {
 	}, nil
 }
 
-func (j *jpResolver) Resolve(ctx context.Context, sg SecretGetter, build *cbpb.Build) (map[string]string, error) {
+func (j *jpResolver) Resolve(ctx context.Context, sg SecretGetter, build *cbpb.Build) (_ map[string]string, err error) {
 	j.mtx.RLock()
 	defer j.mtx.RUnlock()
+	ctx, span := StartSpan(ctx, "notifiers.resolve", build)
+	defer func() {
+		if err != nil {
+			bindingErrors.WithLabelValues(deliveryFrom(ctx).kind).Inc()
+		}
+		EndSpan(span, err)
+	}()
 
 	// Use a "JSON" payload here since a struct would have export-field issues
 	// based on the lowercase names.
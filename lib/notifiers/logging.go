@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"cloud.google.com/go/compute/metadata"
+	log "github.com/golang/glog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the Cloud Logging fields of structured log entries.
+const (
+	traceField        = "logging.googleapis.com/trace"
+	spanIDField       = "logging.googleapis.com/spanId"
+	traceSampledField = "logging.googleapis.com/trace_sampled"
+	sourceField       = "logging.googleapis.com/sourceLocation"
+)
+
+// structuredHandler is the handler of the log functions (see Infof) if --log_format is `json`, or nil for glog.
+var structuredHandler slog.Handler
+
+// setUpLogging switches the log functions to Cloud Logging JSON entries on w if --log_format is `json`. Entries that
+// other code logs with the default slog logger are written as Cloud Logging JSON too.
+func setUpLogging(w io.Writer) error {
+	switch *logFormat {
+	case "glog":
+		return nil
+	case "json":
+		structuredHandler = newCloudLoggingHandler(w, loggingProjectID())
+		slog.SetDefault(slog.New(structuredHandler))
+		return nil
+	default:
+		return fmt.Errorf("expected --log_format %q to be glog or json", *logFormat)
+	}
+}
+
+// loggingProjectID returns the ID of the project that log entries' traces belong to, from GOOGLE_CLOUD_PROJECT or
+// the metadata server, or "" if it is unknown.
+func loggingProjectID() string {
+	if p, ok := GetEnv("GOOGLE_CLOUD_PROJECT"); ok {
+		return p
+	}
+	if !metadata.OnGCE() {
+		return ""
+	}
+	p, err := metadata.ProjectID()
+	if err != nil {
+		log.Warningf("failed to get the project ID for log traces: %v", err)
+		return ""
+	}
+	return p
+}
+
+// Infof logs an informational message, like glog.Infof. With --log_format=json, it is logged as a structured entry
+// with the fields of the context (see cloudLoggingHandler).
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, 1, slog.LevelInfo, format, args...)
+}
+
+// Warningf logs a warning, like glog.Warningf. See Infof.
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, 1, slog.LevelWarn, format, args...)
+}
+
+// Errorf logs an error, like glog.Errorf. See Infof.
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, 1, slog.LevelError, format, args...)
+}
+
+// Verbose logs debug messages if its verbosity level is enabled, like glog.Verbose.
+type Verbose bool
+
+// V returns a Verbose that logs if the glog verbosity (`-v` or `-vmodule`) is at least the given level. Its messages
+// have the DEBUG severity with --log_format=json.
+func V(level log.Level) Verbose {
+	return Verbose(log.VDepth(1, level))
+}
+
+// Infof logs a debug message if v is enabled. See Infof.
+func (v Verbose) Infof(ctx context.Context, format string, args ...interface{}) {
+	if v {
+		logf(ctx, 1, slog.LevelDebug, format, args...)
+	}
+}
+
+// logf logs the message to glog or structuredHandler, attributing it to the caller depth frames up from logf's caller.
+func logf(ctx context.Context, depth int, level slog.Level, format string, args ...interface{}) {
+	h := structuredHandler
+	if h == nil {
+		switch {
+		case level >= slog.LevelError:
+			log.ErrorDepthf(depth+1, format, args...)
+		case level >= slog.LevelWarn:
+			log.WarningDepthf(depth+1, format, args...)
+		default:
+			log.InfoDepthf(depth+1, format, args...)
+		}
+		return
+	}
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	// Skip runtime.Callers, logf and the depth frames above it.
+	var pcs [1]uintptr
+	runtime.Callers(depth+2, pcs[:])
+	r := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), pcs[0])
+	if err := h.Handle(ctx, r); err != nil {
+		log.ErrorDepthf(depth+1, "failed to write log entry %q: %v", r.Message, err)
+	}
+}
+
+type buildKey struct{}
+
+// withBuild returns a context whose log entries carry the ID and status of the Build.
+func withBuild(ctx context.Context, build *cbpb.Build) context.Context {
+	return context.WithValue(ctx, buildKey{}, build)
+}
+
+// cloudLoggingHandler is a slog.Handler that writes one
+// [structured Cloud Logging entry](https://cloud.google.com/logging/docs/structured-logging) per line, with its
+// `severity`, `message`, `time` and source location, and the following fields of the context, where it has them:
+// `buildId` and `buildStatus`, `notifierKind` (of the notification rule that is sending), `messageId` (of the Pub/Sub
+// message) and the trace and span IDs of the current span, which correlate the entry with the request's trace.
+type cloudLoggingHandler struct {
+	slog.Handler
+	// projectID qualifies trace IDs, which Cloud Logging requires to correlate entries with traces.
+	projectID string
+}
+
+func newCloudLoggingHandler(w io.Writer, projectID string) *cloudLoggingHandler {
+	return &cloudLoggingHandler{
+		Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{
+			AddSource:   true,
+			Level:       slog.LevelDebug,
+			ReplaceAttr: cloudLoggingAttr,
+		}),
+		projectID: projectID,
+	}
+}
+
+func (h *cloudLoggingHandler) Handle(ctx context.Context, r slog.Record) error {
+	r = r.Clone()
+	if build, ok := ctx.Value(buildKey{}).(*cbpb.Build); ok && build != nil {
+		r.AddAttrs(slog.String("buildId", build.GetId()), slog.String("buildStatus", build.GetStatus().String()))
+	}
+	if d, ok := ctx.Value(deliveryKey{}).(*delivery); ok {
+		r.AddAttrs(slog.String("notifierKind", d.kind))
+	}
+	if m, ok := ctx.Value(messageKey{}).(*MessageView); ok && m != nil && m.ID != "" {
+		r.AddAttrs(slog.String("messageId", m.ID))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceID := sc.TraceID().String()
+		if h.projectID != "" {
+			traceID = fmt.Sprintf("projects/%s/traces/%s", h.projectID, traceID)
+		}
+		r.AddAttrs(slog.String(traceField, traceID), slog.String(spanIDField, sc.SpanID().String()), slog.Bool(traceSampledField, sc.IsSampled()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *cloudLoggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &cloudLoggingHandler{Handler: h.Handler.WithAttrs(attrs), projectID: h.projectID}
+}
+
+func (h *cloudLoggingHandler) WithGroup(name string) slog.Handler {
+	return &cloudLoggingHandler{Handler: h.Handler.WithGroup(name), projectID: h.projectID}
+}
+
+// cloudLoggingAttr renames the built-in attributes of slog records to the fields that Cloud Logging expects.
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		level, _ := a.Value.Any().(slog.Level)
+		return slog.String("severity", severity(level))
+	case slog.MessageKey:
+		a.Key = "message"
+	case slog.SourceKey:
+		a.Key = sourceField
+	}
+	return a
+}
+
+// severity returns the Cloud Logging severity of the slog level.
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logStructured sends the log functions' entries to a cloudLoggingHandler on the returned buffer, until the test ends.
+func logStructured(t *testing.T, projectID string) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	structuredHandler = newCloudLoggingHandler(buf, projectID)
+	t.Cleanup(func() { structuredHandler = nil })
+	return buf
+}
+
+// logEntries decodes the JSON entries in buf.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("failed to unmarshal log entry %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestStructuredLogging(t *testing.T) {
+	buf := logStructured(t, "some-project")
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	ctx = WithMessage(ctx, &MessageView{ID: "some-message-id"})
+	ctx = withBuild(ctx, &cbpb.Build{Id: "some-build-id", Status: cbpb.Build_FAILURE})
+	ctx, _ = withDelivery(ctx, "TestLogNotifier")
+
+	Errorf(ctx, "failed to send: %v", "boom")
+	Warningf(ctx, "retrying")
+	Infof(context.Background(), "no context")
+	V(0).Infof(ctx, "debug")
+
+	entries := logEntries(t, buf)
+	if len(entries) != 4 {
+		t.Fatalf("got %d log entries, want 4:\n%s", len(entries), buf)
+	}
+	for i, e := range entries {
+		source, _ := e[sourceField].(map[string]interface{})
+		if file, _ := source["file"].(string); !strings.HasSuffix(file, "logging_test.go") {
+			t.Errorf("entry %d has source file %q, want the caller's", i, file)
+		}
+		delete(e, sourceField)
+		delete(e, "time")
+	}
+
+	contextFields := map[string]interface{}{
+		"buildId":         "some-build-id",
+		"buildStatus":     "FAILURE",
+		"notifierKind":    "TestLogNotifier",
+		"messageId":       "some-message-id",
+		traceField:        "projects/some-project/traces/4bf92f3577b34da6a3ce929d0e0e4736",
+		spanIDField:       "00f067aa0ba902b7",
+		traceSampledField: true,
+	}
+	withContext := func(severity, message string) map[string]interface{} {
+		e := map[string]interface{}{"severity": severity, "message": message}
+		for k, v := range contextFields {
+			e[k] = v
+		}
+		return e
+	}
+	want := []map[string]interface{}{
+		withContext("ERROR", "failed to send: boom"),
+		withContext("WARNING", "retrying"),
+		{"severity": "INFO", "message": "no context"},
+		withContext("DEBUG", "debug"),
+	}
+	if diff := cmp.Diff(want, entries); diff != "" {
+		t.Errorf("got unexpected log entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestStructuredLoggingWithoutProject(t *testing.T) {
+	buf := logStructured(t, "")
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+
+	Infof(ctx, "hello")
+	entries := logEntries(t, buf)
+	if got := entries[0][traceField]; got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got trace %v, want the bare trace ID", got)
+	}
+}
+
+func TestSetUpLogging(t *testing.T) {
+	defer func(format string, logger *slog.Logger) {
+		*logFormat = format
+		slog.SetDefault(logger)
+		structuredHandler = nil
+	}(*logFormat, slog.Default())
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "some-project")
+
+	for _, tc := range []struct {
+		format   string
+		wantJSON bool
+		wantErr  bool
+	}{
+		{format: "glog"},
+		{format: "json", wantJSON: true},
+		{format: "text", wantErr: true},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			structuredHandler = nil
+			*logFormat = tc.format
+			buf := new(bytes.Buffer)
+			err := setUpLogging(buf)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("setUpLogging got error %v, want error %v", err, tc.wantErr)
+			}
+			if got := structuredHandler != nil; got != tc.wantJSON {
+				t.Fatalf("got structured logging %v, want %v", got, tc.wantJSON)
+			}
+			if !tc.wantJSON {
+				return
+			}
+			slog.Info("from slog")
+			if entries := logEntries(t, buf); entries[0]["severity"] != "INFO" || entries[0]["message"] != "from slog" {
+				t.Errorf("default slog logger wrote %v, want a Cloud Logging entry", entries[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"google.golang.org/protobuf/proto"
+)
+
+// MessageView is the data container for the Pub/Sub message that a Build was delivered in. It is available to
+// templates as `.Message` and to CEL filters as the `message` variable, whose fields are `id`, `publishTime`,
+// `attributes` and `subscription`.
+type MessageView struct {
+	ID string `json:"ID"`
+	// PublishTime is the zero time if it is unknown.
+	PublishTime time.Time `json:"PublishTime"`
+	// Attributes are the message's attributes; Cloud Build sets `buildId` and `status`.
+	Attributes   map[string]string `json:"Attributes"`
+	Subscription string            `json:"Subscription"`
+}
+
+// Latency returns how long ago the message was published, or 0 if that is unknown.
+func (m *MessageView) Latency() time.Duration {
+	if m == nil || m.PublishTime.IsZero() {
+		return 0
+	}
+	return time.Since(m.PublishTime)
+}
+
+// celValue returns the value of the `message` variable in CEL filters.
+func (m *MessageView) celValue() map[string]interface{} {
+	attrs := m.Attributes
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	return map[string]interface{}{
+		"id":           m.ID,
+		"publishTime":  m.PublishTime,
+		"attributes":   attrs,
+		"subscription": m.Subscription,
+	}
+}
+
+// messageViewOf returns the MessageView of the given push envelope.
+func messageViewOf(pspw *pubSubPushWrapper) *MessageView {
+	m := &MessageView{
+		ID:           pspw.Message.ID,
+		Attributes:   pspw.Message.Attributes,
+		Subscription: pspw.Subscription,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, pspw.Message.PublishTime); err == nil {
+		m.PublishTime = t
+	}
+	return m
+}
+
+// pushMessage returns the Pub/Sub message that the view is of, without its data, e.g. for dead-letter records.
+func (m *MessageView) pushMessage() pubSubPushMessage {
+	msg := pubSubPushMessage{ID: m.ID, Attributes: m.Attributes}
+	if !m.PublishTime.IsZero() {
+		msg.PublishTime = m.PublishTime.Format(time.RFC3339Nano)
+	}
+	return msg
+}
+
+type messageKey struct{}
+
+// WithMessage returns a context that carries the Pub/Sub message that a Build was delivered in.
+func WithMessage(ctx context.Context, m *MessageView) context.Context {
+	return context.WithValue(ctx, messageKey{}, m)
+}
+
+// MessageFrom returns the Pub/Sub message that the context carries, or an empty MessageView if there is none (e.g.
+// for dry runs), so that it can always be used in a TemplateView.
+func MessageFrom(ctx context.Context) *MessageView {
+	if m, ok := ctx.Value(messageKey{}).(*MessageView); ok && m != nil {
+		return m
+	}
+	return new(MessageView)
+}
+
+// messageDecl declares the `message` variable for CEL programs.
+var messageDecl = decls.NewVar("message", decls.NewMapType(decls.String, decls.Dyn))
+
+// messagePredicate is a CEL program over the `message` variable only, which is evaluated before the Build in the
+// message is unmarshalled.
+type messagePredicate struct {
+	prg cel.Program
+}
+
+// makeMessagePredicate returns a messagePredicate for the given filter string of CEL code.
+func makeMessagePredicate(filter string) (*messagePredicate, error) {
+	env, err := cel.NewEnv(cel.Declarations(messageDecl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a CEL env: %w", err)
+	}
+	ast, issues := env.Compile(filter)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile CEL message filter %q: %w", filter, issues.Err())
+	}
+	if !proto.Equal(ast.ResultType(), decls.Bool) {
+		return nil, fmt.Errorf("expected CEL message filter %q to have a boolean result type, but was %v", filter, ast.ResultType())
+	}
+	prg, err := env.Program(ast, cel.EvalOptions(cel.OptOptimize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL program from message filter %q: %w", filter, err)
+	}
+	return &messagePredicate{prg}, nil
+}
+
+// apply returns true iff the program returns true for the given message. Like CELPredicate, it returns false if the
+// program fails, e.g. because an attribute is missing.
+func (p *messagePredicate) apply(ctx context.Context, m *MessageView) bool {
+	out, _, err := p.prg.Eval(map[string]interface{}{"message": m.celValue()})
+	if err != nil {
+		V(2).Infof(ctx, "CEL message filter did not match message %q: %v", m.ID, err)
+		return false
+	}
+	match, ok := out.Value().(bool)
+	return ok && match
+}
+
+// messageMatcher is implemented by Notifiers that can tell from a Pub/Sub message alone whether they might notify for
+// its Build.
+type messageMatcher interface {
+	// matchesMessage returns false if the Notifier would not notify for the Build in the given message.
+	matchesMessage(context.Context, *MessageView) bool
+}
+
+// matchesMessage returns false if the Notifier implements messageMatcher and does not match the message.
+func matchesMessage(ctx context.Context, n Notifier, m *MessageView) bool {
+	mm, ok := n.(messageMatcher)
+	return !ok || mm.matchesMessage(ctx, m)
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestPubSubPushMessageUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want pubSubPushMessage
+	}{{
+		name: "push",
+		body: `{"data": "e30=", "messageId": "1", "message_id": "1", "publishTime": "2020-01-01T12:00:00Z", "attributes": {"status": "SUCCESS"}}`,
+		want: pubSubPushMessage{Data: []byte("{}"), ID: "1", PublishTime: "2020-01-01T12:00:00Z", Attributes: map[string]string{"status": "SUCCESS"}},
+	}, {
+		name: "id",
+		body: `{"data": "e30=", "id": "2", "messageId": "1"}`,
+		want: pubSubPushMessage{Data: []byte("{}"), ID: "2"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got pubSubPushMessage
+			if err := json.Unmarshal([]byte(tc.body), &got); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unmarshal got unexpected diff: (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCELPredicateMessage(t *testing.T) {
+	msg := &MessageView{
+		ID:           "some-message-id",
+		PublishTime:  time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Attributes:   map[string]string{"buildId": "some-build-id", "status": "FAILURE"},
+		Subscription: "projects/some-project/subscriptions/cloud-builds-notifier",
+	}
+	build := &cbpb.Build{Id: "some-build-id", Status: cbpb.Build_FAILURE}
+
+	for _, tc := range []struct {
+		filter    string
+		noMessage bool
+		want      bool
+	}{
+		{filter: `message.attributes.status == "FAILURE"`, want: true},
+		{filter: `message.attributes.buildId == build.id && message.id == "some-message-id"`, want: true},
+		{filter: `message.subscription.endsWith("/cloud-builds-notifier")`, want: true},
+		{filter: `message.publishTime < timestamp("2021-01-01T00:00:00Z")`, want: true},
+		{filter: `message.attributes.status == "SUCCESS"`, want: false},
+		// Without a message, attributes are missing, so filters on them do not match.
+		{filter: `message.attributes.status == "FAILURE"`, noMessage: true, want: false},
+		{filter: `build.status == Build.Status.FAILURE`, noMessage: true, want: true},
+	} {
+		prd, err := MakeCELPredicate(tc.filter)
+		if err != nil {
+			t.Fatalf("MakeCELPredicate(%q) failed: %v", tc.filter, err)
+		}
+		ctx := context.Background()
+		if !tc.noMessage {
+			ctx = WithMessage(ctx, msg)
+		}
+		if got := prd.Apply(ctx, build); got != tc.want {
+			t.Errorf("Apply(%q) = %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestMakeMessagePredicateErrors(t *testing.T) {
+	for _, filter := range []string{
+		`build.status == Build.Status.FAILURE`,
+		`message.attributes.status`,
+		`message.attributes.status ==`,
+	} {
+		if _, err := makeMessagePredicate(filter); err == nil {
+			t.Errorf("makeMessagePredicate(%q) unexpectedly succeeded", filter)
+		}
+	}
+}
+
+func TestReceiverMessageFilter(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "attributes"},
+		Spec: &Spec{
+			Notifications: []*Notification{
+				{Filter: "failures", MessageFilter: `message.attributes.status == "FAILURE"`},
+				{Filter: "timeouts", MessageFilter: `message.attributes.status in ["TIMEOUT", "FAILURE"]`},
+			},
+		},
+	}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(new(ruleNotifier)), new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+	rs := n.(*ruleSet)
+	failures, timeouts := rs.rules[0].Notifier.(*ruleNotifier), rs.rules[1].Notifier.(*ruleNotifier)
+	handler := newReceiver(n, &receiverParams{})
+
+	send := func(status string, data []byte) int {
+		t.Helper()
+		body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{ID: status, Data: data, Attributes: map[string]string{"status": status}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "http://notifier.example.com/", bytes.NewBuffer(body)))
+		return w.Result().StatusCode
+	}
+
+	// Messages that no rule matches are acked without unmarshalling their data.
+	if got := send("SUCCESS", []byte("#corrupted#")); got != http.StatusOK {
+		t.Errorf("got status %d for a message that no rule matches, want %d", got, http.StatusOK)
+	}
+	for _, status := range []cbpb.Build_Status{cbpb.Build_TIMEOUT, cbpb.Build_FAILURE} {
+		data, err := protojson.Marshal(&cbpb.Build{Id: status.String(), Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := send(status.String(), data); got != http.StatusOK {
+			t.Errorf("got status %d for %v, want %d", got, status, http.StatusOK)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"FAILURE"}, failures.builds); diff != "" {
+		t.Errorf("failures rule got unexpected Builds: (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"TIMEOUT", "FAILURE"}, timeouts.builds); diff != "" {
+		t.Errorf("timeouts rule got unexpected Builds: (-want +got)\n%s", diff)
+	}
+}
+
+func TestRenderRuleMessage(t *testing.T) {
+	rl := &rule{
+		name: "test[0]",
+		tmpl: `{{ .Build.Id }} via {{ .Message.ID }} ({{ .Message.Attributes.status }}){{ if .Message.Latency }} after {{ .Message.Latency }}{{ end }}`,
+		br:   new(jpResolver),
+	}
+	build := &cbpb.Build{Id: "some-build-id"}
+
+	got, err := renderRule(context.Background(), rl, build)
+	if err != nil {
+		t.Fatalf("renderRule failed: %v", err)
+	}
+	if want := "some-build-id via  (<no value>)"; got != want {
+		t.Errorf("renderRule without a message = %q, want %q", got, want)
+	}
+
+	ctx := WithMessage(context.Background(), &MessageView{ID: "some-message-id", Attributes: map[string]string{"status": "FAILURE"}})
+	got, err = renderRule(ctx, rl, build)
+	if err != nil {
+		t.Fatalf("renderRule failed: %v", err)
+	}
+	if want := "some-build-id via some-message-id (FAILURE)"; got != want {
+		t.Errorf("renderRule = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// unknownKind is the kind label of metrics that are recorded outside of a notification rule.
+const unknownKind = "unknown"
+
+// Prometheus metrics, which Main serves on /metrics. Metrics with a `kind` label are per notifier kind, i.e. the
+// config's `kind`.
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notifier_messages_received_total",
+		Help: "Pub/Sub messages received.",
+	})
+	unmarshalFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notifier_unmarshal_failures_total",
+		Help: "Pub/Sub messages whose data could not be unmarshalled into a Build.",
+	})
+	failedMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_failed_messages_total",
+		Help: "Pub/Sub messages whose notifications failed, by outcome: permanent, exhausted or retryable.",
+	}, []string{"outcome"})
+	filterEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_filter_evaluations_total",
+		Help: "CEL filter evaluations, by Build status and result: match or miss.",
+	}, []string{"kind", "status", "result"})
+	bindingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_binding_errors_total",
+		Help: "Failures to resolve the params of a notification.",
+	}, []string{"kind"})
+	renderErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_render_errors_total",
+		Help: "Failures to execute the template of a notification.",
+	}, []string{"kind"})
+	deliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_delivery_attempts_total",
+		Help: "Attempts to deliver a notification, including retries.",
+	}, []string{"kind"})
+	deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_deliveries_total",
+		Help: "Notifications that were delivered or failed after all attempts, by result: success or failure.",
+	}, []string{"kind", "result"})
+	deliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notifier_delivery_latency_seconds",
+		Help:    "Time from the finish time of a Build to the delivery of its notification.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 14),
+	}, []string{"kind"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifier_rate_limited_total",
+		Help: "Notifications that a rate limit suppressed, by policy: drop or coalesce.",
+	}, []string{"kind", "policy"})
+)
+
+// delivery tracks the notification of a single rule for one Build, so that metrics that are recorded deeper down (e.g.
+// by RetryPolicy.Do) can be attributed to the rule's kind.
+type delivery struct {
+	kind string
+
+	mtx       sync.Mutex
+	delivered bool
+	// filtered is set if a filter of the Notifier did not match the Build.
+	filtered bool
+}
+
+type deliveryKey struct{}
+
+// withDelivery returns a context that attributes metrics to the given notifier kind.
+func withDelivery(ctx context.Context, kind string) (context.Context, *delivery) {
+	d := &delivery{kind: kind}
+	return context.WithValue(ctx, deliveryKey{}, d), d
+}
+
+// deliveryFrom returns the delivery that the context carries, or one of unknownKind.
+func deliveryFrom(ctx context.Context) *delivery {
+	if d, ok := ctx.Value(deliveryKey{}).(*delivery); ok {
+		return d
+	}
+	return &delivery{kind: unknownKind}
+}
+
+// attempted records an attempt to deliver the notification.
+func (d *delivery) attempted() {
+	deliveryAttempts.WithLabelValues(d.kind).Inc()
+}
+
+// finished records whether the notification was delivered after all attempts.
+func (d *delivery) finished(err error) {
+	if err != nil {
+		deliveries.WithLabelValues(d.kind, "failure").Inc()
+		return
+	}
+	deliveries.WithLabelValues(d.kind, "success").Inc()
+	d.mtx.Lock()
+	d.delivered = true
+	d.mtx.Unlock()
+}
+
+// succeeded returns true if the notification was delivered, rather than skipped (e.g. by a filter).
+func (d *delivery) succeeded() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.delivered
+}
+
+// filteredOut records that a filter of the Notifier did not match the Build.
+func (d *delivery) filteredOut() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.filtered = true
+}
+
+// outcome describes what became of a notification whose SendNotification call returned without an error.
+func (d *delivery) outcome() string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	switch {
+	case d.delivered:
+		return "delivered"
+	case d.filtered:
+		return "filtered out"
+	default:
+		return "not delivered"
+	}
+}
+
+// observeLatency records the time from the Build's finish time to now if the notification was delivered.
+func (d *delivery) observeLatency(build *cbpb.Build) {
+	if !d.succeeded() || build.GetFinishTime() == nil {
+		return
+	}
+	deliveryLatency.WithLabelValues(d.kind).Observe(time.Since(build.GetFinishTime().AsTime()).Seconds())
+}
+
+// ExecuteTemplate executes a html/template or text/template template with the view in a `notifiers.render` span, and
+// counts failures in the notifier_render_errors_total metric.
+func ExecuteTemplate(ctx context.Context, w io.Writer, tmpl interface {
+	Execute(io.Writer, interface{}) error
+}, view *TemplateView) error {
+	var build *cbpb.Build
+	if view != nil && view.Build != nil {
+		build = view.Build.Build
+	}
+	_, span := StartSpan(ctx, "notifiers.render", build)
+	if err := tmpl.Execute(w, view); err != nil {
+		renderErrors.WithLabelValues(deliveryFrom(ctx).kind).Inc()
+		EndSpan(span, err)
+		return err
+	}
+	EndSpan(span, nil)
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// failingNotifier fails every SendNotification call with err, after counting its attempts through RetryPolicy.Do.
+type failingNotifier struct {
+	err error
+}
+
+func (f *failingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (f *failingNotifier) SendNotification(ctx context.Context, _ *cbpb.Build) error {
+	rp := &RetryPolicy{Attempts: 2}
+	return rp.Do(ctx, func(context.Context) error { return f.err })
+}
+
+// succeedingNotifier delivers every Build in one attempt.
+type succeedingNotifier struct{}
+
+func (succeedingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (succeedingNotifier) SendNotification(ctx context.Context, _ *cbpb.Build) error {
+	return new(RetryPolicy).Do(ctx, func(context.Context) error { return nil })
+}
+
+func TestFilterEvaluationMetrics(t *testing.T) {
+	pred, err := MakeCELPredicate(`build.status == Build.Status.SUCCESS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, _ := withDelivery(context.Background(), "TestFilterNotifier")
+	match := filterEvaluations.WithLabelValues("TestFilterNotifier", "SUCCESS", "match")
+	miss := filterEvaluations.WithLabelValues("TestFilterNotifier", "FAILURE", "miss")
+	wantMatch, wantMiss := testutil.ToFloat64(match)+1, testutil.ToFloat64(miss)+2
+
+	pred.Apply(ctx, &cbpb.Build{Status: cbpb.Build_SUCCESS})
+	pred.Apply(ctx, &cbpb.Build{Status: cbpb.Build_FAILURE})
+	pred.Apply(ctx, &cbpb.Build{Status: cbpb.Build_FAILURE})
+
+	if got := testutil.ToFloat64(match); got != wantMatch {
+		t.Errorf("got %v matches, want %v", got, wantMatch)
+	}
+	if got := testutil.ToFloat64(miss); got != wantMiss {
+		t.Errorf("got %v misses, want %v", got, wantMiss)
+	}
+}
+
+func TestDeliveryMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		kind         string
+		notifier     Notifier
+		wantAttempts float64
+		wantResult   string
+		wantLatency  bool
+	}{{
+		name:         "success",
+		kind:         "TestSuccessNotifier",
+		notifier:     succeedingNotifier{},
+		wantAttempts: 1,
+		wantResult:   "success",
+		wantLatency:  true,
+	}, {
+		name:         "retried failure",
+		kind:         "TestRetryNotifier",
+		notifier:     &failingNotifier{err: errors.New("unavailable")},
+		wantAttempts: 2,
+		wantResult:   "failure",
+	}, {
+		name:         "permanent failure",
+		kind:         "TestPermanentNotifier",
+		notifier:     &failingNotifier{err: Permanent(errors.New("bad request"))},
+		wantAttempts: 1,
+		wantResult:   "failure",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := deliveryAttempts.WithLabelValues(tc.kind)
+			results := deliveries.WithLabelValues(tc.kind, tc.wantResult)
+			wantAttempts, wantResults := testutil.ToFloat64(attempts)+tc.wantAttempts, testutil.ToFloat64(results)+1
+			wantLatencies := histogramCount(t, tc.kind)
+			if tc.wantLatency {
+				wantLatencies++
+			}
+
+			rl := &rule{name: "test[0]", cfg: &Config{Kind: tc.kind}, Notifier: tc.notifier}
+			build := &cbpb.Build{Id: "some-build-id", FinishTime: timestamppb.New(time.Now().Add(-time.Minute))}
+			if err := rl.SendNotification(context.Background(), build); (err != nil) != (tc.wantResult == "failure") {
+				t.Fatalf("SendNotification got error %v, want result %q", err, tc.wantResult)
+			}
+
+			if got := testutil.ToFloat64(attempts); got != wantAttempts {
+				t.Errorf("got %v attempts, want %v", got, wantAttempts)
+			}
+			if got := testutil.ToFloat64(results); got != wantResults {
+				t.Errorf("got %v %s deliveries, want %v", got, tc.wantResult, wantResults)
+			}
+			if got := histogramCount(t, tc.kind); got != wantLatencies {
+				t.Errorf("got %v latency observations, want %v", got, wantLatencies)
+			}
+		})
+	}
+}
+
+// histogramCount returns the number of observations of the delivery latency of the given kind.
+func histogramCount(t *testing.T, kind string) uint64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	deliveryLatency.WithLabelValues(kind).(prometheus.Histogram).Collect(ch)
+	m := new(dto.Metric)
+	if err := (<-ch).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestExecuteTemplateMetrics(t *testing.T) {
+	ctx, _ := withDelivery(context.Background(), "TestRenderNotifier")
+	failures := renderErrors.WithLabelValues("TestRenderNotifier")
+	want := testutil.ToFloat64(failures) + 1
+
+	good := template.Must(template.New("good").Parse(`{{.Build.Id}}`))
+	if err := ExecuteTemplate(ctx, io.Discard, good, &TemplateView{Build: &BuildView{Build: &cbpb.Build{Id: "some-build-id"}}}); err != nil {
+		t.Fatalf("ExecuteTemplate got unexpected error: %v", err)
+	}
+	bad := template.Must(template.New("bad").Parse(`{{.Build.Nope}}`))
+	if err := ExecuteTemplate(ctx, io.Discard, bad, &TemplateView{Build: &BuildView{Build: &cbpb.Build{}}}); err == nil {
+		t.Fatal("ExecuteTemplate unexpectedly succeeded")
+	}
+
+	if got := testutil.ToFloat64(failures); got != want {
+		t.Errorf("got %v render errors, want %v", got, want)
+	}
+}
+
+func TestReceiverMetrics(t *testing.T) {
+	wantReceived, wantFailures := testutil.ToFloat64(messagesReceived)+2, testutil.ToFloat64(unmarshalFailures)+1
+
+	receive(context.Background(), new(ruleNotifier), &receiverParams{}, &pubSubPushWrapper{Message: pubSubPushMessage{Data: []byte(`{"id": "some-build-id"}`)}})
+	receive(context.Background(), new(ruleNotifier), &receiverParams{}, &pubSubPushWrapper{Message: pubSubPushMessage{Data: []byte(`not a build`)}})
+
+	if got := testutil.ToFloat64(messagesReceived); got != wantReceived {
+		t.Errorf("got %v messages received, want %v", got, wantReceived)
+	}
+	if got := testutil.ToFloat64(unmarshalFailures); got != wantFailures {
+		t.Errorf("got %v unmarshal failures, want %v", got, wantFailures)
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "notifier_messages_received_total") {
+		t.Errorf("/metrics got status %d and body without notifier_messages_received_total:\n%s", rec.Code, rec.Body)
+	}
+}
@@ -19,27 +19,38 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"cloud.google.com/go/storage"
-	log "github.com/golang/glog"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/encoding/protojson"
-	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/protoadapt"
 	"gopkg.in/yaml.v2"
@@ -55,23 +66,42 @@ const (
 var (
 	// Set of allowed notifier Config `apiVersions`.
 	allowedYAMLAPIVersions = map[string]bool{
-		"cloud-build-notifiers/v1": true,
+		apiVersionV1: true,
+		apiVersionV2: true,
 	}
 	allowedTemplateTypes = map[string]bool{
 		"golang": true,
 	}
 )
 
+const (
+	apiVersionV1 = "cloud-build-notifiers/v1"
+	// apiVersionV2 configs only use `spec.notifications` and are validated against the JSON Schema of their kind.
+	apiVersionV2 = "cloud-build-notifiers/v2"
+)
+
 // Flags.
 var (
-	smoketest  = flag.Bool("smoketest", false, "If true, Main will simply log the notifier type and exit.")
-	setupCheck = flag.Bool("setup_check", false, "If true, the configuration YAML is read from stdin and notifier.SetUp is called in a faked-out way. The smoketest flag takes priority over this one.")
+	smoketest         = flag.Bool("smoketest", false, "If true, Main will simply log the notifier type and exit.")
+	setupCheck        = flag.Bool("setup_check", false, "If true, the configuration YAML is read from stdin, notifier.SetUp is called in a faked-out way and the templates and filters are dry-run against sample Builds. The smoketest flag takes priority over this one.")
+	setupCheckBuilds  = flag.String("setup_check_builds", "", "Comma-separated paths of Build JSON files that --setup_check renders the templates with and evaluates the filters against, in addition to built-in sample Builds.")
+	replayDeadLetter  = flag.Bool("replay_dead_letters", false, "If true, the notifications recorded in DEAD_LETTER_SINK are re-sent using the configs at CONFIG_PATH and removed from the sink once delivered, and then Main exits.")
+	replayPath        = flag.String("replay", "", "If set, the Pub/Sub push envelopes, CloudEvents or Build JSON in this file, or in the files of this directory, are handled like pushed messages (files may hold several messages, e.g. as newline-delimited JSON), the outcome of each message is printed, and then Main exits.")
+	replayConfig      = flag.String("replay_config", "", "Comma-separated paths or URIs of the configs that --replay uses instead of CONFIG_PATH.")
+	replayStubSecrets = flag.Bool("replay_stub_secrets", false, "If true, --replay resolves secrets to placeholder values instead of reading them from Secret Manager.")
+	pullSubscription  = flag.String("pull_subscription", "", "If set, Main pulls messages from this `projects/<project>/subscriptions/<id>` Pub/Sub subscription instead of serving push deliveries. Overrides PULL_SUBSCRIPTION.")
+	logFormat         = flag.String("log_format", "glog", "The format of the notifier's logs while it serves: `glog`, or `json` for one structured Cloud Logging entry per line on stderr, with the Build, notifier kind, Pub/Sub message and trace of the entry.")
 )
 
 var (
 	gcsConfigPattern = regexp.MustCompile(`^gs://([[\w-_.]+)/([^\\]+$)`)
 )
 
+// failedMessages counts Pub/Sub messages whose notifications failed, by outcome: "permanent" and "exhausted" messages
+// are acked, "retryable" ones are nacked so that Pub/Sub redelivers them.
+// It is published on /debug/vars.
+var failedMessages = expvar.NewMap("notifier_failed_messages")
+
 // Config is the common type for (YAML-based) configuration files for notifications.
 type Config struct {
 	APIVersion string    `yaml:"apiVersion"`
@@ -86,9 +116,31 @@ type Metadata struct {
 }
 
 // Spec is the data container for the fields that are relevant to the functionality of the notifier.
+// Exactly one of Notification or Notifications should be set.
 type Spec struct {
-	Notification *Notification `yaml:"notification"`
-	Secrets      []*Secret     `yaml:"secrets"`
+	Notification  *Notification   `yaml:"notification,omitempty"`
+	Notifications []*Notification `yaml:"notifications,omitempty"`
+	Secrets       []*Secret       `yaml:"secrets"`
+}
+
+// NotificationRules returns every notification rule in the Spec, regardless of whether it was configured via
+// `notification` or `notifications`.
+func (s *Spec) NotificationRules() []*Notification {
+	if s.Notification != nil {
+		return append([]*Notification{s.Notification}, s.Notifications...)
+	}
+	return s.Notifications
+}
+
+// forRule returns a copy of the Config whose Spec.Notification is the given rule.
+// This lets Notifier implementations that only read `spec.notification` be set up once per rule.
+func (c *Config) forRule(n *Notification) *Config {
+	cp := *c
+	cp.Spec = &Spec{
+		Notification: n,
+		Secrets:      c.Spec.Secrets,
+	}
+	return &cp
 }
 
 // Notification is the data container for the fields that are relevant to the configuration of sending the notification.
@@ -97,12 +149,29 @@ type Notification struct {
 	Delivery map[string]interface{} `yaml:"delivery"`
 	Params   map[string]string      `yaml:"params"`
 	Template *Template              `yaml:"template"`
+	// Retry configures how notifiers that support it retry failed deliveries (see NewRetryPolicy).
+	Retry *RetryConfig `yaml:"retry,omitempty"`
+	// RateLimit limits the notifications that the rule sends (see RateLimitConfig).
+	RateLimit *RateLimitConfig `yaml:"rateLimit,omitempty"`
+	// MessageFilter is an optional CEL filter on the `message` variable only, which is evaluated before the Build is
+	// unmarshalled. Messages that no rule's MessageFilter matches are acked without unmarshalling them.
+	MessageFilter string `yaml:"messageFilter,omitempty"`
 }
 
 type Template struct {
 	Type    string `yaml:"type"`
 	URI     string `yaml:"uri"`
 	Content string `yaml:"content"`
+	// Partials are named templates that are parsed into the same template set, so that they can be used as
+	// `{{ template "name" . }}`.
+	Partials []*Partial `yaml:"partials,omitempty"`
+}
+
+// Partial is a named template that is either read from URI or given inline as Content.
+type Partial struct {
+	Name    string `yaml:"name"`
+	URI     string `yaml:"uri,omitempty"`
+	Content string `yaml:"content,omitempty"`
 }
 
 // TemplateView is the data container for the fields relevant to rendering a template
@@ -110,6 +179,11 @@ type Template struct {
 type TemplateView struct {
 	Build  *BuildView        `json:"Build"`
 	Params map[string]string `json:"Params"`
+	// Message is the Pub/Sub message that the Build was delivered in (see MessageFrom).
+	Message *MessageView `json:"Message"`
+	// Suppressed is the number of other notifications that a `coalesce` rate limit suppressed in favor of this one
+	// (see SuppressedFrom), or 0.
+	Suppressed int `json:"Suppressed"`
 }
 
 // BuildView is the data container that contains the build
@@ -130,14 +204,34 @@ type Secret struct {
 
 // Copied from https://cloud.google.com/run/docs/tutorials/pubsub#looking_at_the_code.
 type pubSubPushMessage struct {
-	Data        []byte `json:"data,omitempty"`
-	ID          string `json:"id"`
-	PublishTime string `json:"publishTime"`
+	Data        []byte            `json:"data,omitempty"`
+	ID          string            `json:"id"`
+	PublishTime string            `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// UnmarshalJSON also reads the ID from `messageId`, which is where Pub/Sub push puts it.
+func (m *pubSubPushMessage) UnmarshalJSON(data []byte) error {
+	type message pubSubPushMessage
+	var aux struct {
+		message
+		MessageID string `json:"messageId"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*m = pubSubPushMessage(aux.message)
+	if m.ID == "" {
+		m.ID = aux.MessageID
+	}
+	return nil
 }
 
 type pubSubPushWrapper struct {
 	Message      pubSubPushMessage
 	Subscription string `json:"subscription"`
+	// DeliveryAttempt is only set for subscriptions with a dead-letter policy.
+	DeliveryAttempt *int `json:"deliveryAttempt,omitempty"`
 }
 
 // Notifier is the interface type that users should implement for usage in Cloud Build notifiers.
@@ -164,70 +258,147 @@ type CELPredicate struct {
 }
 
 // Apply returns true iff the underlying CEL program returns true for the given Build.
-func (c *CELPredicate) Apply(_ context.Context, build *cbpb.Build) bool {
-	out, _, err := c.prg.Eval(map[string]interface{}{"build": build})
+// The `message` variable is the Pub/Sub message that the context carries (see MessageFrom).
+func (c *CELPredicate) Apply(ctx context.Context, build *cbpb.Build) bool {
+	ctx, span := StartSpan(ctx, "notifiers.filter", build)
+	match := false
+	defer func() {
+		d := deliveryFrom(ctx)
+		result := "miss"
+		if match {
+			result = "match"
+		} else {
+			d.filteredOut()
+		}
+		filterEvaluations.WithLabelValues(d.kind, build.GetStatus().String(), result).Inc()
+		span.SetAttributes(attribute.String("notifier.filter.result", result))
+		span.End()
+	}()
+
+	match, err := c.eval(ctx, build)
 	if err != nil {
-		log.Errorf("failed to evaluate the CEL filter: %v", err)
+		Errorf(ctx, "%v", err)
 		return false
 	}
+	return match
+}
+
+// eval runs the CEL program for the given Build, without recording metrics or spans.
+func (c *CELPredicate) eval(ctx context.Context, build *cbpb.Build) (bool, error) {
+	out, _, err := c.prg.Eval(map[string]interface{}{"build": build, "message": MessageFrom(ctx).celValue()})
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate the CEL filter: %w", err)
+	}
 
 	match, ok := out.Value().(bool)
 	if !ok {
-		log.Errorf("failed to convert output %v of CEL filter program to a boolean: %v", out, err)
-		return false
+		return false, fmt.Errorf("failed to convert output %v of CEL filter program to a boolean", out)
 	}
 
-	return match
+	return match, nil
 }
 
 // Main is a function that can be called by `main()` functions in notifier binaries.
 func Main(notifier Notifier) error {
+	return doMain(fmt.Sprintf("%T", notifier), func(_ int, _ *Config) (Notifier, error) {
+		// Always set up copies, so that the given notifier stays pristine for (re)loading configs.
+		return newInstance(notifier)
+	})
+}
+
+// MainFromRegistry is like Main, but picks the Notifier implementation for each config by looking up its `kind` in
+// the registry (see Register).
+// Together with a comma-separated list of paths in CONFIG_PATH, this lets a single deployment serve several kinds
+// of notifiers.
+func MainFromRegistry() error {
+	return doMain(fmt.Sprintf("%v", Kinds()), func(_ int, cfg *Config) (Notifier, error) {
+		return newFromRegistry(cfg)
+	})
+}
+
+// prototypeFunc returns the (not yet set up) Notifier to use for the i-th config.
+type prototypeFunc func(i int, cfg *Config) (Notifier, error)
+
+func doMain(name string, prototypeFor prototypeFunc) error {
 	// TODO(ljr): Refactor/separate this flagged logic from the main logic via a Main/doMain refactor.
 	ctx := context.Background()
 
 	if !flag.Parsed() {
 		flag.Parse()
 	}
+	if err := setUpLogging(os.Stderr); err != nil {
+		return err
+	}
 	if *smoketest {
-		log.V(0).Infof("notifier smoketest: %T", notifier)
+		Infof(ctx, "notifier smoketest: %s", name)
 		return nil
 	}
 
 	if *setupCheck {
-		log.V(2).Info("starting setup check")
+		V(2).Infof(ctx, "starting setup check")
 		cfg, err := decodeConfig(os.Stdin)
 		if err != nil {
 			return fmt.Errorf("failed to decode YAML config from stdin: %w", err)
 		}
 
 		if out, err := yaml.Marshal(cfg); err != nil {
-			log.Warningf("failed to re-encode config YAML: %v", err)
+			Warningf(ctx, "failed to re-encode config YAML: %v", err)
 		} else {
-			log.V(2).Infof("got re-encoded YAML from stdin:\n%s", string(out))
+			V(2).Infof(ctx, "got re-encoded YAML from stdin:\n%s", string(out))
 		}
 
-		if err := validateConfig(cfg); err != nil {
+		if err := validateConfig(ctx, cfg); err != nil {
 			return fmt.Errorf("failed to validate config during setup check: %w", err)
 		}
+		cfg = convertConfig(cfg)
 
-		br, err := newResolver(cfg)
+		sg := new(setupCheckSecretGetter)
+		grf := new(lazyGCSReaderFactory)
+		defer grf.close()
+		n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeFor, sg, setupCheckConfigSource(grf))
 		if err != nil {
-			return fmt.Errorf("failed to create BindingResolver during setup check: %w", err)
+			return fmt.Errorf("failed to set up notifier during setup check: %w", err)
 		}
+		defer closeNotifier(ctx, n)
 
-		if err := notifier.SetUp(ctx, cfg, "", new(setupCheckSecretGetter), br); err != nil {
-			return fmt.Errorf("failed to run notifier.SetUp during setup check: %w", err)
+		// Render every template and evaluate every filter against sample Builds, without delivering anything.
+		samples := sampleBuilds()
+		if *setupCheckBuilds != "" {
+			builds, err := readSampleBuilds(splitConfigPaths(*setupCheckBuilds))
+			if err != nil {
+				return fmt.Errorf("failed to read Builds for setup check: %w", err)
+			}
+			samples = append(samples, builds...)
+		}
+		if err := dryRun(ctx, os.Stdout, n, samples); err != nil {
+			return fmt.Errorf("failed to render templates during setup check: %w", err)
 		}
 
-		log.V(2).Infof("setup check successful")
+		V(2).Infof(ctx, "setup check successful")
 		return nil
 	}
 
-	cfgPath, ok := GetEnv("CONFIG_PATH")
+	if *replayPath != "" {
+		return runReplay(ctx, prototypeFor)
+	}
+
+	cfgPaths, ok := GetEnv("CONFIG_PATH")
 	if !ok {
 		return errors.New("expected CONFIG_PATH to be non-empty")
 	}
 
+	shutdownTracing, err := setUpTracing(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			Warningf(ctx, "failed to flush traces: %v", err)
+		}
+	}()
+
 	sc, err := storage.NewClient(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create new GCS client: %w", err)
@@ -240,70 +411,421 @@ func Main(notifier Notifier) error {
 	}
 	defer smc.Close()
 
-	cfg, err := getGCSConfig(ctx, &actualGCSReaderFactory{sc}, cfgPath)
+	sm := &actualSecretManager{client: smc}
+	src := newConfigSource(&actualGCSReaderFactory{sc}, sm, http.DefaultClient)
+
+	paths := splitConfigPaths(cfgPaths)
+
+	deadLetters, err := deadLetterSinkFromEnv(sc)
 	if err != nil {
-		return fmt.Errorf("failed to get config from GCS: %w", err)
+		return fmt.Errorf("failed to configure the dead-letter sink: %w", err)
 	}
 
-	if err := validateConfig(cfg); err != nil {
-		return fmt.Errorf("got invalid config from path %q: %w", cfgPath, err)
+	if *replayDeadLetter {
+		if deadLetters == nil {
+			return errors.New("expected DEAD_LETTER_SINK to be non-empty when replaying dead letters")
+		}
+		lc, err := loadConfigs(ctx, paths, src, sm, prototypeFor)
+		if err != nil {
+			return fmt.Errorf("failed to set up notifier: %w", err)
+		}
+		return replayDeadLetters(ctx, deadLetters.store, lc.notifier)
 	}
-	log.V(2).Infof("got config from GCS (%q): %+v\n", cfgPath, cfg)
 
-	tmpl, err := parseTemplate(ctx, cfg.Spec.Notification.Template, &actualGCSReaderFactory{sc})
-	if err != nil {
-		return fmt.Errorf("failed to parse template from notiifer spec %q: %w", cfg.Spec.Notification.Template, err)
+	var pollInterval time.Duration
+	if pi, ok := GetEnv("CONFIG_POLL_INTERVAL"); ok {
+		pollInterval, err = time.ParseDuration(pi)
+		if err != nil {
+			return fmt.Errorf("failed to parse CONFIG_POLL_INTERVAL %q: %w", pi, err)
+		}
 	}
 
-	sm := &actualSecretManager{client: smc}
+	_, ignoreBadMessages := GetEnv("IGNORE_BAD_MESSAGES")
 
-	br, err := newResolver(cfg)
+	dedup, err := deduperFromEnv(sc)
 	if err != nil {
-		return fmt.Errorf("failed to construct a binding resolver: %v", err)
+		return fmt.Errorf("failed to configure deduplication: %w", err)
 	}
 
-	if err := notifier.SetUp(ctx, cfg, tmpl, sm, br); err != nil {
-		return fmt.Errorf("failed to call SetUp on notifier: %w", err)
+	maxAttempts := 0
+	if ma, ok := GetEnv("MAX_DELIVERY_ATTEMPTS"); ok {
+		maxAttempts, err = strconv.Atoi(ma)
+		if err != nil || maxAttempts < 1 {
+			return fmt.Errorf("expected MAX_DELIVERY_ATTEMPTS %q to be a positive integer", ma)
+		}
 	}
 
-	_, ignoreBadMessages := GetEnv("IGNORE_BAD_MESSAGES")
+	verifier, err := pushVerifierFromEnv(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to configure push authentication: %w", err)
+	}
+	previewVerifier, err := previewVerifierFromEnv(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to configure /preview: %w", err)
+	}
 
-	log.V(2).Infoln("starting HTTP server...")
+	params := &receiverParams{ignoreBadMessages: ignoreBadMessages, maxAttempts: maxAttempts, deadLetters: deadLetters, dedup: dedup, verifier: verifier}
+	if dedup == nil {
+		params.delivered = newDeliveredRules()
+	}
+
+	timeout, err := shutdownTimeout()
+	if err != nil {
+		return err
+	}
+	// SIGTERM (e.g. when Cloud Run scales down) stops the notifier gracefully; see serve.
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	// Our Pub/Sub push receiver.
-	http.HandleFunc("/", newReceiver(notifier, &receiverParams{ignoreBadMessages}))
+	serverStatus.configure(name, paths)
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/readyz", newReadyzHandler(serverStatus))
+	mux.HandleFunc("/statusz", newStatuszHandler(serverStatus))
 
 	// An auxilliary, healthz-style receiver.
 	// You can call this endpoint using the curl command here:
 	// https://cloud.google.com/run/docs/triggering/https-request#creating_private_services.
 	startTime := time.Now()
-	http.HandleFunc("/helloz", func(w http.ResponseWriter, _ *http.Request) {
-		fmt.Fprintf(w, "Greetings from a Google Cloud Build notifier: %T!\nStart Time: %s\nCurrent Time: %s\n",
-			notifier, startTime.Format(time.RFC1123), time.Now().Format(time.RFC1123))
+	mux.HandleFunc("/helloz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintf(w, "Greetings from a Google Cloud Build notifier: %s!\nStart Time: %s\nCurrent Time: %s\n",
+			name, startTime.Format(time.RFC1123), time.Now().Format(time.RFC1123))
 	})
 
 	var port string
 	if p, ok := GetEnv("PORT"); ok {
 		port = p
 	} else {
-		log.Warningf("PORT environment variable was not present, using %s instead", defaultHTTPPort)
+		Warningf(ctx, "PORT environment variable was not present, using %s instead", defaultHTTPPort)
 		port = defaultHTTPPort
 	}
 
-	// Block on the HTTP's health.
-	return http.ListenAndServe(":"+port, nil)
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %s: %w", port, err)
+	}
+	// Serve the auxiliary endpoints while the configs are set up, so that /readyz reports that the notifier is not
+	// ready yet rather than refusing connections.
+	V(2).Infof(ctx, "starting HTTP server...")
+	srv := &http.Server{Handler: mux}
+	httpErr := startServing(srv, ln)
+
+	notifier, err := newReloadingNotifier(ctx, func(ctx context.Context) (*loadedConfig, error) {
+		return loadConfigs(ctx, paths, src, sm, prototypeFor)
+	})
+	if err != nil {
+		srv.Close()
+		return fmt.Errorf("failed to set up notifier: %w", err)
+	}
+
+	// Configs can be reloaded without a restart by sending SIGHUP or by setting CONFIG_POLL_INTERVAL, which polls the
+	// config and template objects for new versions.
+	go notifier.reloadOnSignal(ctx, syscall.SIGHUP)
+	if pollInterval > 0 {
+		go notifier.poll(ctx, pollInterval, src)
+	}
+
+	if previewVerifier != nil {
+		mux.HandleFunc("/preview", newPreviewHandler(notifier, previewVerifier))
+	}
+
+	// In pull mode, messages are pulled from a subscription and the HTTP server only serves the auxiliary endpoints.
+	var pullErr chan error
+	if name := pullSubscriptionName(); name != "" {
+		rs, err := pullReceiveSettings()
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		client, sub, err := newPullSubscription(ctx, name)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		defer client.Close()
+		sub.ReceiveSettings = rs
+
+		pullErr = make(chan error, 1)
+		go func() {
+			pullErr <- receivePull(sigCtx, sub, notifier, params)
+		}()
+	} else {
+		// Our Pub/Sub push receiver.
+		mux.HandleFunc("/", newReceiver(notifier, params))
+	}
+
+	// Block on the HTTP's health, and on the pull subscriber's in pull mode, until SIGTERM.
+	return serve(sigCtx, srv, httpErr, pullErr, notifier, timeout)
+}
+
+// setUpConfigs calls SetUp on one Notifier per notification rule in the given Configs and returns a Notifier that
+// dispatches every Build to all of them.
+// If src is nil, templates are not fetched and every rule is set up with an empty template.
+func setUpConfigs(ctx context.Context, cfgs []*Config, prototypeFor prototypeFunc, sg SecretGetter, src ConfigSource) (Notifier, error) {
+	// Get every prototype before any SetUp call so that no copy starts out with another config's state.
+	prototypes := make([]Notifier, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		p, err := prototypeFor(i, cfg)
+		if err != nil {
+			return nil, err
+		}
+		prototypes = append(prototypes, p)
+	}
+
+	rs := new(ruleSet)
+	for i, cfg := range cfgs {
+		rules, err := setUpRules(ctx, prototypes[i], cfg, sg, src)
+		if err != nil {
+			return nil, err
+		}
+		rs.rules = append(rs.rules, rules...)
+	}
+
+	if len(rs.rules) == 1 {
+		// Keep the common, single rule case free of the ruleSet indirection.
+		return rs.rules[0], nil
+	}
+	return rs, nil
+}
+
+// setUpRules calls SetUp on one Notifier per notification rule in the given Config.
+func setUpRules(ctx context.Context, prototype Notifier, cfg *Config, sg SecretGetter, src ConfigSource) ([]*rule, error) {
+	ns := cfg.Spec.NotificationRules()
+	if len(ns) == 1 {
+		rl, err := setUpRule(ctx, ruleName(cfg, 0), prototype, cfg.forRule(ns[0]), sg, src)
+		if err != nil {
+			return nil, err
+		}
+		return []*rule{rl}, nil
+	}
+
+	// Copy the prototype before any SetUp call so that no instance starts out with another rule's state.
+	instances := make([]Notifier, 0, len(ns))
+	for range ns {
+		n, err := newInstance(prototype)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, n)
+	}
+
+	rules := make([]*rule, 0, len(ns))
+	for i, n := range ns {
+		name := ruleName(cfg, i)
+		rl, err := setUpRule(ctx, name, instances[i], cfg.forRule(n), sg, src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up notification rule %s: %w", name, err)
+		}
+		rules = append(rules, rl)
+	}
+	return rules, nil
+}
+
+func setUpRule(ctx context.Context, name string, notifier Notifier, cfg *Config, sg SecretGetter, src ConfigSource) (*rule, error) {
+	var tmpl string
+	if src != nil {
+		t, err := parseTemplate(ctx, cfg.Spec.Notification.Template, src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template from notifier spec %+v: %w", cfg.Spec.Notification.Template, err)
+		}
+		tmpl = t
+	}
+
+	br, err := newResolver(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct a binding resolver: %w", err)
+	}
+
+	var mf *messagePredicate
+	if f := cfg.Spec.Notification.MessageFilter; f != "" {
+		if mf, err = makeMessagePredicate(f); err != nil {
+			return nil, err
+		}
+	}
+
+	rl := &rule{name: name, cfg: cfg, tmpl: tmpl, sg: sg, br: br, messageFilter: mf, Notifier: notifier}
+	if rlc := cfg.Spec.Notification.RateLimit; rlc != nil {
+		if rl.limiter, err = sharedRateLimiter(cfg.Kind, cfg.Spec.Notification.Delivery, rlc); err != nil {
+			return nil, err
+		}
+		if f := cfg.Spec.Notification.Filter; f != "" {
+			if rl.filter, err = MakeCELPredicate(f); err != nil {
+				return nil, fmt.Errorf("failed to make CEL predicate: %w", err)
+			}
+		}
+	}
+
+	if err := notifier.SetUp(ctx, cfg, tmpl, sg, br); err != nil {
+		return nil, fmt.Errorf("failed to call SetUp on notifier: %w", err)
+	}
+	return rl, nil
+}
+
+// ruleName returns a human-readable name for the i-th notification rule of the given Config, for use in logs.
+func ruleName(cfg *Config, i int) string {
+	name := cfg.Kind
+	if cfg.Metadata != nil && cfg.Metadata.Name != "" {
+		name = cfg.Metadata.Name
+	}
+	return fmt.Sprintf("%s[%d]", name, i)
+}
+
+// newInstance returns a shallow copy of the given Notifier, which must be a pointer to a struct.
+// Copying (rather than using a zero value) preserves any dependencies that were injected before calling Main.
+// Copies are taken before SetUp is ever called on them, so no set up state is shared.
+func newInstance(prototype Notifier) (Notifier, error) {
+	v := reflect.ValueOf(prototype)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("notifier of type %T must be a non-nil pointer to a struct ", prototype)
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(Notifier), nil
+}
+
+// rule is a Notifier that has been set up for a single notification rule.
+type rule struct {
+	name string
+	// cfg is the Config of this rule only (see Config.forRule); tmpl, sg and br are what the Notifier was set up with.
+	cfg  *Config
+	tmpl string
+	sg   SecretGetter
+	br   BindingResolver
+	// messageFilter is the rule's compiled MessageFilter, if any.
+	messageFilter *messagePredicate
+	// limiter enforces the rule's RateLimit, if any, on the Builds that filter matches. It is shared with the other rules
+	// that send to the same destination with the same RateLimit.
+	limiter *rateLimiter
+	filter  *CELPredicate
+	Notifier
+}
+
+func (r *rule) matchesMessage(ctx context.Context, m *MessageView) bool {
+	return r.messageFilter == nil || r.messageFilter.apply(ctx, m)
+}
+
+// kind returns the Config kind of the rule, which its metrics are attributed to.
+func (r *rule) kind() string {
+	if r.cfg != nil && r.cfg.Kind != "" {
+		return r.cfg.Kind
+	}
+	return unknownKind
+}
+
+// SendNotification sends the Build using the rule's Notifier and wraps any error in a ruleError.
+// If the context has a deduper, Build statuses that the rule already delivered are skipped. If it carries a Pub/Sub
+// message, messages that do not match the rule's MessageFilter are skipped. Notifications in excess of the rule's
+// RateLimit are dropped or coalesced (see RateLimitConfig).
+func (r *rule) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if m, ok := ctx.Value(messageKey{}).(*MessageView); ok && !r.matchesMessage(ctx, m) {
+		V(2).Infof(ctx, "notification rule %s does not match PubSub message %q, skipping it", r.name, m.ID)
+		recordOutcome(ctx, r.name, "skipped, since its messageFilter does not match")
+		return nil
+	}
+	if d := deduperFrom(ctx); d != nil {
+		key := buildDedupKey(r.name, build)
+		if !d.claim(ctx, key) {
+			Infof(ctx, "notification rule %s already handled status %v of Build %q, skipping it", r.name, build.GetStatus(), build.GetId())
+			recordOutcome(ctx, r.name, "skipped, since it was already handled")
+			return nil
+		}
+		if err := r.deliver(ctx, build); err != nil {
+			d.release(ctx, key)
+			return err
+		}
+		return nil
+	}
+	return r.deliver(ctx, build)
+}
+
+// deliver sends the Build unless the rule's rate limit suppresses it.
+func (r *rule) deliver(ctx context.Context, build *cbpb.Build) error {
+	if r.rateLimited(ctx, build) {
+		return nil
+	}
+	return r.send(ctx, build)
+}
+
+// send sends a copy of the Build using the rule's Notifier, attributing its metrics to the rule's kind.
+func (r *rule) send(ctx context.Context, build *cbpb.Build) error {
+	kind := r.kind()
+	ctx, d := withDelivery(ctx, kind)
+	ctx, span := StartSpan(ctx, "notifiers.send", build)
+	span.SetAttributes(ruleKey.String(r.name))
+	// Notifiers may modify the Build (e.g. to add UTM parameters to its log URL), so each one gets its own copy, and the
+	// Build that other rules, dead letters and rate limits see is left as it was received.
+	if err := r.Notifier.SendNotification(ctx, proto.Clone(build).(*cbpb.Build)); err != nil {
+		EndSpan(span, err)
+		serverStatus.failed(kind, build, err)
+		recordOutcome(ctx, r.name, fmt.Sprintf("failed: %v", err))
+		return &ruleError{rule: r, err: err}
+	}
+	EndSpan(span, nil)
+	recordOutcome(ctx, r.name, d.outcome())
+	d.observeLatency(build)
+	if d.succeeded() {
+		serverStatus.delivered(kind, build)
+	}
+	return nil
+}
+
+// ruleError is an error returned by the Notifier of a single notification rule.
+type ruleError struct {
+	rule *rule
+	err  error
 }
 
-func parseTemplate(ctx context.Context, tmpl *Template, grf gcsReaderFactory) (string, error) {
+func (e *ruleError) Error() string {
+	return fmt.Sprintf("notification rule %s: %v", e.rule.name, e.err)
+}
+
+func (e *ruleError) Unwrap() error {
+	return e.err
+}
+
+// ruleSet is a Notifier that sends every Build to each of its rules.
+// Each rule's Notifier is responsible for applying its own filter.
+type ruleSet struct {
+	rules []*rule
+}
+
+// SetUp is a no-op since each of the underlying Notifiers was already set up with its own rule.
+func (r *ruleSet) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (r *ruleSet) matchesMessage(ctx context.Context, m *MessageView) bool {
+	for _, rl := range r.rules {
+		if rl.matchesMessage(ctx, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendNotification sends the Build to every rule, even if some of them fail.
+func (r *ruleSet) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	var errs []error
+	for _, rl := range r.rules {
+		if err := rl.SendNotification(ctx, build); err != nil {
+			Errorf(ctx, "notification rule %s failed for build %q: %v", rl.name, build.GetId(), err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseTemplate(ctx context.Context, tmpl *Template, src ConfigSource) (string, error) {
 	templateString := ""
 	if tmpl != nil {
 		if _, ok := allowedTemplateTypes[tmpl.Type]; !ok {
 			return "", fmt.Errorf("got invalid Template Type: %v", tmpl.Type)
 		}
 		if tmpl.URI != "" {
-			parsed, err := getGCSTemplate(ctx, grf, tmpl.URI)
+			parsed, err := getTemplate(ctx, src, tmpl.URI)
 			if err != nil {
-				return "", fmt.Errorf("failed to get template from GCS: %w", err)
+				return "", fmt.Errorf("failed to get template: %w", err)
 			}
 			templateString = parsed
 		} else {
@@ -312,13 +834,60 @@ func parseTemplate(ctx context.Context, tmpl *Template, grf gcsReaderFactory) (s
 		if err := validateTemplate(templateString); err != nil {
 			return "", fmt.Errorf("got invalid template from path %q: %w", tmpl.URI, err)
 		}
+
+		partials, err := parsePartials(ctx, tmpl.Partials, src)
+		if err != nil {
+			return "", err
+		}
+		if partials != "" {
+			templateString += partials
+			if err := validateTemplate(templateString); err != nil {
+				return "", fmt.Errorf("got invalid template after adding partials: %w", err)
+			}
+		}
 	}
 	return templateString, nil
 
 }
 
+// parsePartials loads the given partials and returns them as `{{define "name"}}...{{end}}` blocks, which are appended
+// to the main template so that Notifiers parse them into the same template set.
+func parsePartials(ctx context.Context, partials []*Partial, src ConfigSource) (string, error) {
+	var defines strings.Builder
+	seen := map[string]bool{}
+	for i, p := range partials {
+		if p == nil || p.Name == "" {
+			return "", fmt.Errorf("expected template.partials[%d] to have a name", i)
+		}
+		if seen[p.Name] {
+			return "", fmt.Errorf("got more than one template partial named %q", p.Name)
+		}
+		seen[p.Name] = true
+
+		if (p.URI == "") == (p.Content == "") {
+			return "", fmt.Errorf("expected exactly one of uri or content for template partial %q", p.Name)
+		}
+		content := p.Content
+		if p.URI != "" {
+			c, err := getTemplate(ctx, src, p.URI)
+			if err != nil {
+				return "", fmt.Errorf("failed to get template partial %q: %w", p.Name, err)
+			}
+			content = c
+		}
+		if err := validateTemplate(content); err != nil {
+			return "", fmt.Errorf("got invalid template partial %q: %w", p.Name, err)
+		}
+
+		fmt.Fprintf(&defines, "{{define %s}}%s{{end}}", strconv.Quote(p.Name), content)
+	}
+	return defines.String(), nil
+}
+
 type gcsReaderFactory interface {
 	NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error)
+	// Generation returns the current generation of the given object, which changes whenever the object does.
+	Generation(ctx context.Context, bucket, object string) (int64, error)
 }
 
 type actualGCSReaderFactory struct {
@@ -329,6 +898,14 @@ func (a *actualGCSReaderFactory) NewReader(ctx context.Context, bucket, object s
 	return a.client.Bucket(bucket).Object(object).NewReader(ctx)
 }
 
+func (a *actualGCSReaderFactory) Generation(ctx context.Context, bucket, object string) (int64, error) {
+	attrs, err := a.client.Bucket(bucket).Object(object).Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
 type actualSecretManager struct {
 	client *secretmanager.Client
 	// TODO(ljr): Do we want any sort of timed cache here?
@@ -344,38 +921,36 @@ func (a *actualSecretManager) GetSecret(ctx context.Context, name string) (strin
 	return string(res.GetPayload().GetData()), nil
 }
 
-// setupCheckSecretGetter is a faked-out SecretGetter that is only used by the setup check functionality in Main.
+// setupCheckSecretGetter is a faked-out SecretGetter that is only used by the setup check functionality in Main, and
+// by --replay with --replay_stub_secrets.
 type setupCheckSecretGetter struct{}
 
 func (c *setupCheckSecretGetter) GetSecret(_ context.Context, name string) (string, error) {
 	return fmt.Sprintf("[SECRET VALUE FOR %q]", name), nil
 }
 
-// getGCSConfig fetches the YAML Config file from the given GCS path and returns the parsed Config.
-func getGCSConfig(ctx context.Context, grf gcsReaderFactory, path string) (*Config, error) {
-	if !gcsConfigPattern.MatchString(path) {
-		return nil, fmt.Errorf("expected path %q to match pattern %v", path, gcsConfigPattern)
-	}
-	// if trm := strings.TrimPrefix(path, "gs://"); trm != path {
-	// 	// path started with the prefix
-	// 	path = trm
-	// } else {
-	// 	return nil, fmt.Errorf("expected %q to start with `gs://`", path)
-	// }
+// setupCheckSource is a faked-out ConfigSource that the setup check functionality in Main reads `sm://` URIs with.
+// It reads `file://` URIs and returns an empty template for all other URIs, so that inline templates and partials are
+// still validated.
+type setupCheckSource struct{}
 
-	// split := strings.SplitN(path, "/", 2)
-	// log.V(2).Infof("got path split: %+v", split)
-	// if len(split) != 2 {
-	// 	return nil, fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
-	// }
-	split := gcsConfigPattern.FindStringSubmatch(path)
-	if len(split) != 3 {
-		return nil, fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
+func (setupCheckSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	if strings.HasPrefix(uri, "file://") {
+		return fileSource{}.Open(ctx, uri)
 	}
-	bucket, object := split[1], split[2]
-	r, err := grf.NewReader(ctx, bucket, object)
+	Warningf(ctx, "not reading %q during setup check", uri)
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (setupCheckSource) Version(_ context.Context, _ string) (string, error) {
+	return "", nil
+}
+
+// getConfig fetches the YAML Config file from the given URI and returns the parsed Config.
+func getConfig(ctx context.Context, src ConfigSource, path string) (*Config, error) {
+	r, err := src.Open(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
+		return nil, err
 	}
 	defer r.Close()
 
@@ -387,25 +962,20 @@ func getGCSConfig(ctx context.Context, grf gcsReaderFactory, path string) (*Conf
 	return cfg, nil
 }
 
-// getGCSConfig fetches the Template file from the given GCS path and returns the parsed Config.
-func getGCSTemplate(ctx context.Context, grf gcsReaderFactory, path string) (string, error) {
-	if trm := strings.TrimPrefix(path, "gs://"); trm != path {
-		// path started with the prefix
-		path = trm
-	} else {
-		return "", fmt.Errorf("expected %q to start with `gs://`", path)
-	}
-
-	split := strings.SplitN(path, "/", 2)
-	log.V(2).Infof("got path split: %+v", split)
-	if len(split) != 2 {
-		return "", fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
+// splitGCSPath splits the given `gs://bucket/path/to/object` path into its bucket and object.
+func splitGCSPath(path string) (string, string, error) {
+	split := gcsConfigPattern.FindStringSubmatch(path)
+	if len(split) != 3 {
+		return "", "", fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
 	}
+	return split[1], split[2], nil
+}
 
-	bucket, object := split[0], split[1]
-	r, err := grf.NewReader(ctx, bucket, object)
+// getTemplate fetches the Template file from the given URI and returns its contents.
+func getTemplate(ctx context.Context, src ConfigSource, path string) (string, error) {
+	r, err := src.Open(ctx, path)
 	if err != nil {
-		return "", fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
+		return "", err
 	}
 	defer r.Close()
 	tmpl, err := decodeTemplate(r)
@@ -416,9 +986,23 @@ func getGCSTemplate(ctx context.Context, grf gcsReaderFactory, path string) (str
 	return tmpl, nil
 }
 
+// decodeConfig strictly decodes the given YAML config, after interpolating environment variables in its values (see
+// interpolateEnv).
 func decodeConfig(r io.Reader) (*Config, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if envVarPattern.Match(raw) {
+		// The config is parsed before interpolating, so that values cannot inject YAML and references in comments are
+		// ignored.
+		if raw, err = interpolateEnv(raw); err != nil {
+			return nil, err
+		}
+	}
+
 	cfg := new(Config)
-	dcd := yaml.NewDecoder(r)
+	dcd := yaml.NewDecoder(bytes.NewReader(raw))
 	dcd.SetStrict(true)
 	return cfg, dcd.Decode(cfg)
 }
@@ -434,30 +1018,63 @@ func decodeTemplate(r io.Reader) (string, error) {
 
 // validateConfig checks the following (or errors):
 // - apiVersion is one of allowedYAMLAPIVersions.
+// - for v2 configs, the config matches the JSON Schema of its kind.
+// - for v1 configs, exactly one of spec.notification or spec.notifications is present.
 // - user substitution names match the subNamePattern regexp.
-func validateConfig(cfg *Config) error {
+func validateConfig(ctx context.Context, cfg *Config) error {
 	if allowed := allowedYAMLAPIVersions[cfg.APIVersion]; !allowed {
 		return fmt.Errorf("expected `apiVersion` %q to be one of the following:\n%v",
 			cfg.APIVersion, allowedYAMLAPIVersions)
 	}
 
+	if cfg.APIVersion == apiVersionV2 {
+		return validateSchema(cfg)
+	}
+
 	if cfg.Spec == nil {
 		return errors.New("expected config.spec to be present")
 	}
 
-	if cfg.Spec.Notification == nil {
-		return errors.New("expected config.spec.notification to be present")
+	if cfg.Spec.Notification == nil && len(cfg.Spec.Notifications) == 0 {
+		return errors.New("expected one of config.spec.notification or config.spec.notifications to be present")
+	}
+
+	if cfg.Spec.Notification != nil && len(cfg.Spec.Notifications) != 0 {
+		return errors.New("expected only one of config.spec.notification or config.spec.notifications to be present")
+	}
+
+	for i, n := range cfg.Spec.Notifications {
+		if n == nil {
+			return fmt.Errorf("expected config.spec.notifications[%d] to be non-empty", i)
+		}
+	}
+
+	// v1 configs are not held to the schema, but point out what would need fixing before moving to v2.
+	if err := validateSchema(convertConfig(cfg)); err != nil {
+		Warningf(ctx, "config would not be a valid %s config: %v", apiVersionV2, err)
 	}
 
 	return nil
 }
 
+// convertConfig returns the `cloud-build-notifiers/v2` equivalent of a valid `cloud-build-notifiers/v1` config,
+// which moves `spec.notification` into `spec.notifications`. Other configs are returned as-is.
+func convertConfig(cfg *Config) *Config {
+	if cfg.APIVersion != apiVersionV1 {
+		return cfg
+	}
+
+	cp := *cfg
+	cp.APIVersion = apiVersionV2
+	cp.Spec = &Spec{
+		Notifications: cfg.Spec.NotificationRules(),
+		Secrets:       cfg.Spec.Secrets,
+	}
+	return &cp
+}
+
 func validateTemplate(s string) error {
-	_, err := template.New("").Funcs(template.FuncMap{
-		"replace": func(s, old, new string) string {
-			return strings.ReplaceAll(s, old, new)
-		},
-	}).Parse(s)
+	_, err := template.New("").Funcs(TemplateFuncs()).Parse(s)
 
 	return err
 }
@@ -466,7 +1083,7 @@ func validateTemplate(s string) error {
 func MakeCELPredicate(filter string) (*CELPredicate, error) {
 	env, err := cel.NewEnv(
 		// Declare the `build` variable for useage in CEL programs.
-		cel.Declarations(decls.NewIdent("build", decls.NewObjectType(cloudBuildProtoPkg+".Build"), nil)),
+		cel.Declarations(decls.NewIdent("build", decls.NewObjectType(cloudBuildProtoPkg+".Build"), nil), messageDecl),
 		// Register the `Build` type in the environment.
 		cel.Types(new(cbpb.Build)),
 		// `Container` is necessary for better (enum) scoping
@@ -498,68 +1115,236 @@ func MakeCELPredicate(filter string) (*CELPredicate, error) {
 func GetEnv(name string) (string, bool) {
 	val := os.Getenv(name)
 	if val == "" {
-		log.V(2).Infof("env var %q is empty", name)
+		V(2).Infof(context.Background(), "env var %q is empty", name)
 	} else {
-		log.V(2).Infof("env var %q is %q", name, val)
+		V(2).Infof(context.Background(), "env var %q is %q", name, val)
 	}
 	return val, val != ""
 }
 
 type receiverParams struct {
 	ignoreBadMessages bool
+	// verifier, if set, rejects push requests without a valid OIDC token.
+	verifier *pushVerifier
+	// maxAttempts, if positive, is the number of failed attempts after which a message is acked even if its
+	// notifications failed with retryable errors.
+	maxAttempts int
+	// deadLetters, if set, records messages that failed permanently or too many times, before they are acked.
+	deadLetters *deadLetterSink
+	// dedup, if set, acks messages that were already handled and skips Build statuses that were already delivered.
+	dedup *deduper
+	// delivered is used instead of dedup if that is not set. It only skips Build statuses that rules already delivered,
+	// so that when a message is redelivered because one of its rules failed, the others do not send it again.
+	delivered *deduper
+	attempts  attemptCounter
+}
+
+// maxTrackedAttempts bounds the number of messages whose failed attempts are counted in memory.
+const maxTrackedAttempts = 10000
+
+// attemptCounter counts failed attempts per Pub/Sub message ID, for subscriptions that do not report delivery attempts.
+type attemptCounter struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+// failed registers a failed attempt to handle the given message and returns the number of attempts so far.
+// If Pub/Sub reported the delivery attempt (which requires a dead-letter policy on the subscription), that is used.
+// Otherwise, attempts are counted in memory.
+func (a *attemptCounter) failed(msgID string, deliveryAttempt *int) int {
+	if deliveryAttempt != nil {
+		return *deliveryAttempt
+	}
+	if msgID == "" {
+		// Bare Builds have no ID to count their attempts by.
+		return 1
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.counts == nil || len(a.counts) >= maxTrackedAttempts {
+		a.counts = map[string]int{}
+	}
+	a.counts[msgID]++
+	return a.counts[msgID]
+}
+
+// forget stops counting attempts for the given message.
+func (a *attemptCounter) forget(msgID string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.counts, msgID)
 }
 
 // newReceiver returns a Pub/Sub push HTTP receiving http.HandlerFunc that calls the given notifier.
+// Besides Pub/Sub push envelopes, it accepts messagePublished CloudEvents and bare Builds (see decodePushRequest).
 func newReceiver(notifier Notifier, params *receiverParams) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		var pspw pubSubPushWrapper
+		// Continue the trace of the request, if its headers carry a W3C trace context.
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		if v := params.verifier; v != nil {
+			if err := v.verify(ctx, r); errors.Is(err, errForbidden) {
+				Errorf(ctx, "rejecting push request: %v", err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			} else if err != nil {
+				Errorf(ctx, "rejecting push request without a valid OIDC token: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Errorf("failed to read request message: %v", err)
+			Errorf(ctx, "failed to read request message: %v", err)
 			http.Error(w, "Bad request body", http.StatusBadRequest)
 			return
 		}
 
-		if err := json.Unmarshal(body, &pspw); err != nil {
-			log.Errorf("failed to unmarshal body %q: %v", body, err)
-			http.Error(w, "Bad pubsub.Message JSON", http.StatusBadRequest)
+		pspw, err := decodePushRequest(r, body)
+		if err != nil {
+			Errorf(ctx, "failed to decode body %q: %v", body, err)
+			http.Error(w, "Bad pubsub.Message, CloudEvent or Build JSON", http.StatusBadRequest)
 			return
 		}
 
-		log.V(2).Infof("got PubSub message with ID %q from subscription %q", pspw.Message.ID, pspw.Subscription)
+		if n := receive(ctx, notifier, params, pspw); n != nil {
+			http.Error(w, n.msg, n.code)
+		}
+	}
+}
+
+// nack is the reason that receive did not ack a message, as the status code and message of the push response.
+type nack struct {
+	code int
+	msg  string
+}
 
-		build := new(cbpb.Build)
-		// Be as lenient as possible in unmarshalling.
-		// `Unmarshal` will fail if we get a payload with a field that is unknown to the current proto version unless `DiscardUnknown` is set.
-		uo := protojson.UnmarshalOptions{
-			AllowPartial:   true,
-			DiscardUnknown: true,
+// receive handles a Pub/Sub message for both the push receiver and the pull subscriber. It returns nil if the message
+// should be acked.
+func receive(ctx context.Context, notifier Notifier, params *receiverParams, pspw *pubSubPushWrapper) (n *nack) {
+	V(2).Infof(ctx, "got PubSub message with ID %q from subscription %q", pspw.Message.ID, pspw.Subscription)
+	messagesReceived.Inc()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "notifiers.receive", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(messageIDKey.String(pspw.Message.ID)))
+	defer func() {
+		if n != nil {
+			span.SetStatus(codes.Error, n.msg)
 		}
-		bv2 := protoadapt.MessageV2Of(build)
-		if err := uo.Unmarshal(pspw.Message.Data, bv2); err != nil {
-			if params.ignoreBadMessages {
-				log.Warningf("not attempting to handle unmarshal-able Pub/Sub message id=%q data=%q publishTime=%q which gave error: %v",
-					pspw.Message.ID, string(pspw.Message.Data), pspw.Message.PublishTime, err)
-				return
-			}
+		span.End()
+	}()
 
-			log.Errorf("failed to unmarshal PubSub message id=%q data=%q publishTime=%q into a Build: %v",
+	msg := messageViewOf(pspw)
+	if !matchesMessage(ctx, notifier, msg) {
+		V(2).Infof(ctx, "acking PubSub message %q with attributes %v, since no notification rule matches it", msg.ID, msg.Attributes)
+		return nil
+	}
+	ctx = WithMessage(ctx, msg)
+
+	build, err := unmarshalBuild(pspw.Message.Data)
+	if err != nil {
+		unmarshalFailures.Inc()
+		serverStatus.failed("", nil, fmt.Errorf("failed to unmarshal PubSub message %q into a Build: %w", pspw.Message.ID, err))
+		if params.ignoreBadMessages {
+			Warningf(ctx, "not attempting to handle unmarshal-able Pub/Sub message id=%q data=%q publishTime=%q which gave error: %v",
 				pspw.Message.ID, string(pspw.Message.Data), pspw.Message.PublishTime, err)
-			http.Error(w, "Bad Cloud Build Pub/Sub data", http.StatusBadRequest)
-			return
+			return nil
 		}
-		build = protoadapt.MessageV1Of(bv2).(*cbpb.Build)
 
-		log.V(2).Infof("got PubSub Build payload:\n%+v\nattempting to send notification", prototext.Format(build))
-		if err := notifier.SendNotification(ctx, build); err != nil {
-			log.Errorf("failed to run SendNotification: %v", err)
-			http.Error(w, "failed to send notification", http.StatusInternalServerError)
-			return
+		Errorf(ctx, "failed to unmarshal PubSub message id=%q data=%q publishTime=%q into a Build: %v",
+			pspw.Message.ID, string(pspw.Message.Data), pspw.Message.PublishTime, err)
+		return &nack{http.StatusBadRequest, "Bad Cloud Build Pub/Sub data"}
+	}
+	setBuildAttributes(span, build)
+	ctx = withBuild(ctx, build)
+	serverStatus.received(build)
+
+	msgKey := ""
+	if d := params.dedup; d != nil {
+		ctx = withDeduper(ctx, d)
+		if pspw.Message.ID != "" {
+			msgKey = messageDedupKey(pspw.Message.ID)
+			if !d.claim(ctx, msgKey) {
+				Infof(ctx, "acking PubSub message %q, since it was already handled", pspw.Message.ID)
+				return nil
+			}
 		}
+	} else if d := params.delivered; d != nil {
+		ctx = withDeduper(ctx, d)
+	}
+	if dl := params.deadLetters; dl != nil {
+		ctx = withDeadLetters(ctx, dl)
+	}
 
-		log.V(2).Infof("acking PubSub message %q with Build payload:\n%v", pspw.Message.ID, prototext.Format(build))
+	V(2).Infof(ctx, "got PubSub message %q for Build %q with status %v, attempting to send notification", pspw.Message.ID, build.GetId(), build.GetStatus())
+	if err := notifier.SendNotification(ctx, build); err != nil {
+		Errorf(ctx, "failed to run SendNotification: %v", err)
+		if msgKey != "" {
+			params.dedup.release(ctx, msgKey)
+		}
+		if !handleFailure(ctx, params, pspw, build, err) {
+			return &nack{http.StatusInternalServerError, "failed to send notification"}
+		}
+		return nil
+	}
+	params.attempts.forget(pspw.Message.ID)
+	return nil
+}
+
+// unmarshalBuild unmarshals the data of a Cloud Build Pub/Sub message.
+func unmarshalBuild(data []byte) (*cbpb.Build, error) {
+	build := new(cbpb.Build)
+	// Be as lenient as possible in unmarshalling.
+	// `Unmarshal` will fail if we get a payload with a field that is unknown to the current proto version unless `DiscardUnknown` is set.
+	uo := protojson.UnmarshalOptions{
+		AllowPartial:   true,
+		DiscardUnknown: true,
+	}
+	bv2 := protoadapt.MessageV2Of(build)
+	if err := uo.Unmarshal(data, bv2); err != nil {
+		return nil, err
+	}
+	return protoadapt.MessageV1Of(bv2).(*cbpb.Build), nil
+}
+
+// handleFailure decides whether a message whose notifications failed with the given error is acked, and returns true
+// if it is. Messages are acked if the error is permanent (see IsPermanent), or if they failed params.maxAttempts times.
+// If there is a dead-letter sink, those messages, and messages that failed as often as the sink allows, are recorded
+// first; messages that cannot be recorded are only acked if they would have been acked without a sink.
+func handleFailure(ctx context.Context, params *receiverParams, pspw *pubSubPushWrapper, build *cbpb.Build, err error) bool {
+	id := pspw.Message.ID
+	attempts := params.attempts.failed(id, pspw.DeliveryAttempt)
+	outcome := "retryable"
+	if IsPermanent(err) {
+		outcome = "permanent"
+	} else if params.maxAttempts > 0 && attempts >= params.maxAttempts {
+		outcome = "exhausted"
+	}
+
+	if dl := params.deadLetters; dl != nil && (outcome != "retryable" || attempts >= dl.afterAttempts) {
+		if err := dl.record(ctx, pspw.Message, attempts, build, err); err != nil {
+			Errorf(ctx, "failed to record PubSub message %q in the dead-letter sink: %v", id, err)
+		} else {
+			Warningf(ctx, "acking PubSub message %q after %d failed attempts, since it was recorded in the dead-letter sink", id, attempts)
+			if outcome == "retryable" {
+				outcome = "exhausted"
+			}
+		}
+	}
+
+	failedMessages.Add(outcome, 1)
+	failedMessagesTotal.WithLabelValues(outcome).Inc()
+	switch outcome {
+	case "permanent":
+		Errorf(ctx, "acking PubSub message %q for Build %q, since its notifications failed permanently: %v", id, build.GetId(), err)
+	case "exhausted":
+		Errorf(ctx, "acking PubSub message %q for Build %q after %d failed attempts: %v", id, build.GetId(), attempts, err)
+	default:
+		Warningf(ctx, "nacking PubSub message %q for Build %q after %d failed attempts, so that it is redelivered", id, build.GetId(), attempts)
+		return false
 	}
+	params.attempts.forget(id)
+	return true
 }
 
 // GetSecretRef is a helper function for getting a Secret's local reference name from the given config.
@@ -27,6 +27,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"google.golang.org/protobuf/protoadapt"
@@ -226,6 +227,8 @@ func TestMakeCELPredicateErrors(t *testing.T) {
 type fakeGCSReaderFactory struct {
 	// A mapping of "gs://"+bucket+"/"+object -> content.
 	data map[string]string
+	// A mapping of "gs://"+bucket+"/"+object -> generation. Missing entries have generation 0.
+	generations map[string]int64
 }
 
 func (f *fakeGCSReaderFactory) NewReader(_ context.Context, bucket, object string) (io.ReadCloser, error) {
@@ -237,6 +240,14 @@ func (f *fakeGCSReaderFactory) NewReader(_ context.Context, bucket, object strin
 	return ioutil.NopCloser(bytes.NewBufferString(s)), nil
 }
 
+func (f *fakeGCSReaderFactory) Generation(_ context.Context, bucket, object string) (int64, error) {
+	path := "gs://" + bucket + "/" + object
+	if _, ok := f.data[path]; !ok {
+		return 0, fmt.Errorf("no data for bucket=%q object=%q", bucket, object)
+	}
+	return f.generations[path], nil
+}
+
 // It's annoying to update this config since YAML requires spaces but Go likes tabs.
 // Just keep everything at tabs and then replace accordingly.
 const validConfigYAMLWithTabs = `
@@ -351,7 +362,7 @@ func TestGetGCSConfig(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			gotConfig, err := getGCSConfig(context.Background(), tc.fake, tc.path)
+			gotConfig, err := getConfig(context.Background(), &gcsSource{tc.fake}, tc.path)
 			if err != nil {
 				if tc.wantError {
 					t.Logf("got expected error: %v", err)
@@ -410,7 +421,7 @@ func TestGetGCSTemplate(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			gotTemplate, err := getGCSTemplate(context.Background(), tc.fake, tc.path)
+			gotTemplate, err := getTemplate(context.Background(), &gcsSource{tc.fake}, tc.path)
 			if err != nil {
 				if tc.wantError {
 					t.Logf("got expected error: %v", err)
@@ -635,10 +646,33 @@ func TestValidateConfig(t *testing.T) {
 				Spec:       &Spec{},
 			},
 			wantErr: true,
+		}, {
+			name: "multiple notification rules",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec:       &Spec{Notifications: []*Notification{{}, {}}},
+			},
+		}, {
+			name: "both spec.notification and spec.notifications",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec: &Spec{
+					Notification:  &Notification{},
+					Notifications: []*Notification{{}},
+				},
+			},
+			wantErr: true,
+		}, {
+			name: "empty notification rule",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec:       &Spec{Notifications: []*Notification{{}, nil}},
+			},
+			wantErr: true,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			err := validateConfig(tc.cfg)
+			err := validateConfig(context.Background(), tc.cfg)
 			if err != nil {
 				if !tc.wantErr {
 					t.Fatalf("validateConfig(%v) got unexpected error: %v", tc.cfg, err)
@@ -721,6 +755,188 @@ func TestNewReceiver(t *testing.T) {
 	}
 }
 
+// ruleNotifier records the filter it was set up with and the Builds it was sent.
+type ruleNotifier struct {
+	injected string
+	filter   string
+	builds   []string
+	err      error
+}
+
+func (r *ruleNotifier) SetUp(_ context.Context, cfg *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	r.filter = cfg.Spec.Notification.Filter
+	return nil
+}
+
+func (r *ruleNotifier) SendNotification(_ context.Context, build *cbpb.Build) error {
+	r.builds = append(r.builds, build.Id)
+	return r.err
+}
+
+func prototypeOf(n Notifier) prototypeFunc {
+	return func(i int, _ *Config) (Notifier, error) {
+		if i == 0 {
+			return n, nil
+		}
+		return newInstance(n)
+	}
+}
+
+func TestSetUpConfigs(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Metadata:   &Metadata{Name: "multi"},
+		Spec: &Spec{
+			Notifications: []*Notification{
+				{Filter: "first"},
+				{Filter: "second"},
+			},
+		},
+	}
+
+	prototype := &ruleNotifier{injected: "dependency"}
+	n, err := setUpConfigs(ctx, []*Config{cfg}, prototypeOf(prototype), new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+
+	rs, ok := n.(*ruleSet)
+	if !ok {
+		t.Fatalf("setUpConfigs returned %T, want *ruleSet", n)
+	}
+	if len(rs.rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rs.rules))
+	}
+
+	if err := rs.SendNotification(ctx, &cbpb.Build{Id: "some-build"}); err != nil {
+		t.Fatalf("SendNotification failed: %v", err)
+	}
+
+	for i, want := range []string{"first", "second"} {
+		if wantName := fmt.Sprintf("multi[%d]", i); rs.rules[i].name != wantName {
+			t.Errorf("rule #%d has name %q, want %q", i, rs.rules[i].name, wantName)
+		}
+		got := rs.rules[i].Notifier.(*ruleNotifier)
+		if got == prototype {
+			t.Errorf("rule #%d reused the prototype notifier", i)
+		}
+		if got.injected != "dependency" {
+			t.Errorf("rule #%d lost injected field: got %q", i, got.injected)
+		}
+		if got.filter != want {
+			t.Errorf("rule #%d was set up with filter %q, want %q", i, got.filter, want)
+		}
+		if diff := cmp.Diff([]string{"some-build"}, got.builds); diff != "" {
+			t.Errorf("rule #%d got unexpected builds diff: (want- got+)\n%s", i, diff)
+		}
+	}
+}
+
+func TestSetUpConfigsSingleRule(t *testing.T) {
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Spec:       &Spec{Notification: &Notification{Filter: "only"}},
+	}
+
+	prototype := new(ruleNotifier)
+	n, err := setUpConfigs(context.Background(), []*Config{cfg}, prototypeOf(prototype), new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+
+	if rl, ok := n.(*rule); !ok || rl.Notifier != prototype {
+		t.Errorf("setUpConfigs returned %T, want a rule for the prototype notifier itself", n)
+	}
+	if prototype.filter != "only" {
+		t.Errorf("prototype was set up with filter %q, want %q", prototype.filter, "only")
+	}
+}
+
+func TestSetUpConfigsFromRegistry(t *testing.T) {
+	const kind = "TestSetUpConfigsFromRegistryNotifier"
+	Register(kind, func() Notifier { return new(ruleNotifier) })
+
+	cfgs := []*Config{{
+		Kind: kind,
+		Spec: &Spec{Notification: &Notification{Filter: "first"}},
+	}, {
+		Kind: kind,
+		Spec: &Spec{Notification: &Notification{Filter: "second"}},
+	}}
+	prototypeFor := func(_ int, cfg *Config) (Notifier, error) { return newFromRegistry(cfg) }
+
+	n, err := setUpConfigs(context.Background(), cfgs, prototypeFor, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpConfigs failed: %v", err)
+	}
+
+	rs, ok := n.(*ruleSet)
+	if !ok {
+		t.Fatalf("setUpConfigs returned %T, want *ruleSet", n)
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := rs.rules[i].Notifier.(*ruleNotifier).filter; got != want {
+			t.Errorf("config #%d was set up with filter %q, want %q", i, got, want)
+		}
+	}
+
+	cfgs[1].Kind = "UnknownNotifier"
+	if _, err := setUpConfigs(context.Background(), cfgs, prototypeFor, new(setupCheckSecretGetter), nil); err == nil {
+		t.Error("setUpConfigs with an unregistered kind unexpectedly succeeded")
+	}
+}
+
+func TestRuleSetSendsToAllRules(t *testing.T) {
+	failing := &ruleNotifier{err: errors.New("failed to reticulate splines")}
+	ok := new(ruleNotifier)
+	rs := &ruleSet{rules: []*rule{{name: "failing", Notifier: failing}, {name: "ok", Notifier: ok}}}
+
+	if err := rs.SendNotification(context.Background(), &cbpb.Build{Id: "some-build"}); err == nil {
+		t.Error("SendNotification unexpectedly succeeded")
+	}
+
+	if len(ok.builds) != 1 {
+		t.Errorf("rule after a failing rule got %d builds, want 1", len(ok.builds))
+	}
+}
+
+// logURLNotifier adds a parameter to the log URL of the Builds it is sent, like notifiers that add UTM parameters do,
+// and records the result.
+type logURLNotifier struct {
+	logURLs []string
+}
+
+func (n *logURLNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (n *logURLNotifier) SendNotification(_ context.Context, build *cbpb.Build) error {
+	build.LogUrl += "?utm_source=notifier"
+	n.logURLs = append(n.logURLs, build.LogUrl)
+	return nil
+}
+
+func TestRuleSetSendsEachRuleItsOwnBuild(t *testing.T) {
+	first, second := new(logURLNotifier), new(logURLNotifier)
+	rs := &ruleSet{rules: []*rule{{name: "first", Notifier: first}, {name: "second", Notifier: second}}}
+
+	build := &cbpb.Build{Id: "some-build", LogUrl: "https://example.com/log"}
+	if err := rs.SendNotification(context.Background(), build); err != nil {
+		t.Fatalf("SendNotification failed: %v", err)
+	}
+
+	want := []string{"https://example.com/log?utm_source=notifier"}
+	for name, n := range map[string]*logURLNotifier{"first": first, "second": second} {
+		if diff := cmp.Diff(want, n.logURLs); diff != "" {
+			t.Errorf("rule %s got unexpected log URLs (-want +got):\n%s", name, diff)
+		}
+	}
+	if build.LogUrl != "https://example.com/log" {
+		t.Errorf("SendNotification modified the Build's log URL to %q", build.LogUrl)
+	}
+}
+
 type errNotifier struct {
 	err error
 }
@@ -779,6 +995,16 @@ func TestNewReceiverError(t *testing.T) {
 			body:     buildToBuffer(t, new(cbpb.Build)),
 			sendErr:  errors.New("failed to reticulate splines"),
 			wantCode: http.StatusInternalServerError,
+		}, {
+			name:     "permanent send notification error is acked",
+			body:     buildToBuffer(t, new(cbpb.Build)),
+			sendErr:  fmt.Errorf("notification rule a[0]: %w", Permanent(errors.New("bad template"))),
+			wantCode: http.StatusOK,
+		}, {
+			name:     "permanent and retryable send notification errors",
+			body:     buildToBuffer(t, new(cbpb.Build)),
+			sendErr:  errors.Join(Permanent(errors.New("bad template")), Retryable(errors.New("got a 503"))),
+			wantCode: http.StatusInternalServerError,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -796,6 +1022,37 @@ func TestNewReceiverError(t *testing.T) {
 	}
 }
 
+func TestReceiverMaxAttempts(t *testing.T) {
+	five := 5
+	for _, tc := range []struct {
+		name            string
+		deliveryAttempt *int
+		wantCodes       []int
+	}{{
+		name:      "attempts counted in memory",
+		wantCodes: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK, http.StatusInternalServerError},
+	}, {
+		name:            "attempts reported by Pub/Sub",
+		deliveryAttempt: &five,
+		wantCodes:       []int{http.StatusOK, http.StatusOK},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newReceiver(&errNotifier{Retryable(errors.New("got a 503"))}, &receiverParams{maxAttempts: 3})
+			for i, want := range tc.wantCodes {
+				body := wrapperToBuffer(t, &pubSubPushWrapper{
+					Message:         pubSubPushMessage{ID: "some-id", Data: []byte("{}")},
+					DeliveryAttempt: tc.deliveryAttempt,
+				})
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodPost, "http://notifer.example.com/", body))
+				if got := w.Result().StatusCode; got != want {
+					t.Errorf("attempt %d: result.StatusCode = %d, expected %d", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
 type fatalNotifier struct {
 	t *testing.T
 }
@@ -884,7 +1141,7 @@ func TestParseTemplate(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := parseTemplate(ctx, tc.tmpl, validFakeFactory)
+			got, err := parseTemplate(ctx, tc.tmpl, &gcsSource{validFakeFactory})
 			if err != nil {
 				if !tc.wantErr {
 					t.Fatalf("parseTemplate(%v) got unexpected error: %v", tc.tmpl, err)
@@ -904,3 +1161,100 @@ func TestParseTemplate(t *testing.T) {
 	}
 
 }
+
+func TestParseTemplatePartials(t *testing.T) {
+	ctx := context.Background()
+	src := &gcsSource{&fakeGCSReaderFactory{
+		data: map[string]string{
+			"gs://path/to/main.tmpl":    `{{ template "header" . }} {{ template "failure" . }}`,
+			"gs://path/to/failure.tmpl": `failed: {{ .Build.Id }}`,
+			"gs://path/to/bad.tmpl":     `{{ .Build.Id `,
+		},
+	}}
+
+	for _, tc := range []struct {
+		name    string
+		tmpl    *Template
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "uri and inline partials",
+			tmpl: &Template{
+				Type: "golang",
+				URI:  "gs://path/to/main.tmpl",
+				Partials: []*Partial{
+					{Name: "header", Content: "[{{ status .Build.Status }}]"},
+					{Name: "failure", URI: "gs://path/to/failure.tmpl"},
+				},
+			},
+			want: "[FAILURE] failed: some-build-id",
+		}, {
+			name: "missing partial object",
+			tmpl: &Template{
+				Type:     "golang",
+				Content:  `{{ template "footer" . }}`,
+				Partials: []*Partial{{Name: "footer", URI: "gs://path/to/missing.tmpl"}},
+			},
+			wantErr: true,
+		}, {
+			name: "invalid partial",
+			tmpl: &Template{
+				Type:     "golang",
+				Content:  `{{ template "footer" . }}`,
+				Partials: []*Partial{{Name: "footer", URI: "gs://path/to/bad.tmpl"}},
+			},
+			wantErr: true,
+		}, {
+			name: "partial without name",
+			tmpl: &Template{
+				Type:     "golang",
+				Content:  "hello",
+				Partials: []*Partial{{Content: "world"}},
+			},
+			wantErr: true,
+		}, {
+			name: "duplicate partial",
+			tmpl: &Template{
+				Type:     "golang",
+				Content:  "hello",
+				Partials: []*Partial{{Name: "a", Content: "1"}, {Name: "a", Content: "2"}},
+			},
+			wantErr: true,
+		}, {
+			name: "partial with both uri and content",
+			tmpl: &Template{
+				Type:     "golang",
+				Content:  "hello",
+				Partials: []*Partial{{Name: "a", URI: "gs://path/to/failure.tmpl", Content: "2"}},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTemplate(ctx, tc.tmpl, src)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseTemplate(%v) unexpectedly succeeded", tc.tmpl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTemplate(%v) got unexpected error: %v", tc.tmpl, err)
+			}
+
+			tmpl, err := template.New("").Funcs(TemplateFuncs()).Parse(got)
+			if err != nil {
+				t.Fatalf("failed to parse template %q: %v", got, err)
+			}
+			buf := new(bytes.Buffer)
+			view := &TemplateView{Build: &BuildView{&cbpb.Build{Id: "some-build-id", Status: cbpb.Build_FAILURE}}}
+			if err := tmpl.Execute(buf, view); err != nil {
+				t.Fatalf("failed to execute template %q: %v", got, err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("template with partials rendered %q, want %q", buf.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/api/idtoken"
+)
+
+// Renderer is an optional interface for Notifiers that can render the payload that SendNotification would deliver
+// for a Build, without delivering it. Render ignores the Notifier's filter. Its Build may be modified.
+// Notifiers that are not Renderers are previewed (and dead-lettered) with their template rendered by the library.
+type Renderer interface {
+	Render(ctx context.Context, build *cbpb.Build) (string, error)
+}
+
+// previewVerifierFromEnv returns the pushVerifier configured by PREVIEW_AUTH_AUDIENCE and
+// PREVIEW_AUTH_SERVICE_ACCOUNTS, or nil if PREVIEW_AUTH_AUDIENCE is not set, which disables /preview.
+func previewVerifierFromEnv(ctx context.Context) (*pushVerifier, error) {
+	audience, ok := GetEnv("PREVIEW_AUTH_AUDIENCE")
+	if !ok {
+		return nil, nil
+	}
+	// Any Google account can get a token for any audience, so /preview must be restricted to some of them.
+	sas, ok := GetEnv("PREVIEW_AUTH_SERVICE_ACCOUNTS")
+	if !ok {
+		return nil, errors.New("expected PREVIEW_AUTH_SERVICE_ACCOUNTS to be non-empty when PREVIEW_AUTH_AUDIENCE is set")
+	}
+	validator, err := idtoken.NewValidator(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ID token validator: %w", err)
+	}
+	return newPushVerifier(validator, audience, splitConfigPaths(sas))
+}
+
+// previewResponse is the JSON that /preview responds with.
+type previewResponse struct {
+	BuildID string         `json:"buildId"`
+	Status  string         `json:"status"`
+	Rules   []*rulePreview `json:"rules"`
+}
+
+// rulePreview is what a notification rule would do with the previewed Build.
+type rulePreview struct {
+	Rule string `json:"rule"`
+	Kind string `json:"kind"`
+	// Match is true if the rule would send a notification, i.e. if both its filter and messageFilter match.
+	Match              bool `json:"match"`
+	FilterMatch        bool `json:"filterMatch"`
+	MessageFilterMatch bool `json:"messageFilterMatch"`
+	// FilterError is why the filter could not be evaluated, which counts as not matching.
+	FilterError string `json:"filterError,omitempty"`
+	// Payload is rendered whether or not the rule matches, unless that fails with Error.
+	Payload string `json:"payload"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newPreviewHandler returns a handler that evaluates the filters of the notifier's rules against the POSTed Pub/Sub
+// message (in any of the formats of the receiver; see decodePushRequest) and renders their payloads, without
+// delivering anything. The `rule` query parameter limits the response to the rule of that name. Requests must carry
+// an OIDC token that the verifier accepts.
+func newPreviewHandler(notifier Notifier, verifier *pushVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if err := verifier.verify(ctx, r); errors.Is(err, errForbidden) {
+			Errorf(ctx, "rejecting preview request: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		} else if err != nil {
+			Errorf(ctx, "rejecting preview request without a valid OIDC token: %v", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad request body", http.StatusBadRequest)
+			return
+		}
+		pspw, err := decodePushRequest(r, body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad pubsub.Message, CloudEvent or Build JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		build, err := unmarshalBuild(pspw.Message.Data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Cloud Build Pub/Sub data: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if rn, ok := notifier.(*reloadingNotifier); ok {
+			lc, err := rn.acquire()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer lc.inflight.RUnlock()
+			notifier = lc.notifier
+		}
+
+		ctx = withBuild(WithMessage(ctx, messageViewOf(pspw)), build)
+		resp := &previewResponse{BuildID: build.GetId(), Status: build.GetStatus().String(), Rules: []*rulePreview{}}
+		name := r.URL.Query().Get("rule")
+		for _, rl := range rulesOf(notifier) {
+			if name == "" || rl.name == name {
+				resp.Rules = append(resp.Rules, previewRule(ctx, rl, build))
+			}
+		}
+		if name != "" && len(resp.Rules) == 0 {
+			http.Error(w, fmt.Sprintf("No notification rule named %q", name), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			Errorf(ctx, "failed to encode preview: %v", err)
+		}
+	}
+}
+
+// previewRule evaluates the filters of the rule against the Build and the message of the context, and renders the
+// rule's payload (see renderRule).
+func previewRule(ctx context.Context, rl *rule, build *cbpb.Build) *rulePreview {
+	ctx, _ = withDelivery(ctx, rl.kind())
+	p := &rulePreview{Rule: rl.name, Kind: rl.kind(), MessageFilterMatch: rl.matchesMessage(ctx, MessageFrom(ctx))}
+
+	if prd, err := MakeCELPredicate(rl.cfg.Spec.Notification.Filter); err != nil {
+		p.FilterError = err.Error()
+	} else if p.FilterMatch, err = prd.eval(ctx, build); err != nil {
+		p.FilterError = err.Error()
+	}
+	p.Match = p.FilterMatch && p.MessageFilterMatch
+
+	payload, err := renderRule(ctx, rl, build)
+	if err != nil {
+		p.Error = err.Error()
+	}
+	p.Payload = payload
+	return p
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// renderingNotifier is a ruleNotifier that renders its own payloads.
+type renderingNotifier struct {
+	ruleNotifier
+}
+
+func (r *renderingNotifier) Render(_ context.Context, build *cbpb.Build) (string, error) {
+	build.LogUrl = "modified"
+	return "rendered " + build.GetId(), nil
+}
+
+func TestPreview(t *testing.T) {
+	useStatus(t)
+	ctx := context.Background()
+	cfgs := []*Config{{
+		APIVersion: apiVersionV1,
+		Kind:       "TestRenderNotifier",
+		Metadata:   &Metadata{Name: "renderer"},
+		Spec:       &Spec{Notification: &Notification{Filter: `build.status == Build.Status.FAILURE`}},
+	}, {
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "template"},
+		Spec: &Spec{Notifications: []*Notification{{
+			Filter:   `build.status == Build.Status.SUCCESS`,
+			Template: &Template{Type: "golang", Content: `{{.Build.Id}} in {{.Message.ID}}`},
+		}, {
+			Filter:        `build.status == Build.Status.SUCCESS`,
+			MessageFilter: `message.attributes.env == "prod"`,
+			Template:      &Template{Type: "golang", Content: `{{.Build.Id}}`},
+		}}},
+	}}
+	rn, err := newReloadingNotifier(ctx, func(ctx context.Context) (*loadedConfig, error) {
+		n, err := setUpConfigs(ctx, cfgs, func(i int, _ *Config) (Notifier, error) {
+			if i == 0 {
+				return new(renderingNotifier), nil
+			}
+			return new(ruleNotifier), nil
+		}, new(setupCheckSecretGetter), setupCheckSource{})
+		if err != nil {
+			return nil, err
+		}
+		return &loadedConfig{notifier: n}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to set up notifier: %v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newPreviewHandler(rn, newTestVerifier(t, jwksTransport{"key-1": &key.PublicKey}))
+	token := func(email string) string {
+		return "Bearer " + signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "key-1"}, map[string]interface{}{
+			"iss":            "accounts.google.com",
+			"aud":            testAudience,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"email":          email,
+			"email_verified": true,
+		})
+	}
+
+	build := &cbpb.Build{Id: "some-build-id", Status: cbpb.Build_SUCCESS, LogUrl: "https://example.com/log"}
+	data, err := protojson.Marshal(build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{ID: "some-message-id", Data: data, Attributes: map[string]string{"env": "dev"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		method        string
+		target        string
+		authorization string
+		body          []byte
+		wantStatus    int
+		want          *previewResponse
+	}{{
+		name:       "no token",
+		method:     http.MethodPost,
+		body:       envelope,
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name:          "other service account",
+		method:        http.MethodPost,
+		authorization: token("intruder@example.com"),
+		body:          envelope,
+		wantStatus:    http.StatusForbidden,
+	}, {
+		name:          "GET",
+		method:        http.MethodGet,
+		authorization: token(testServiceAccount),
+		wantStatus:    http.StatusMethodNotAllowed,
+	}, {
+		name:          "bad body",
+		method:        http.MethodPost,
+		authorization: token(testServiceAccount),
+		body:          []byte(`{"foo": "bar"}`),
+		wantStatus:    http.StatusBadRequest,
+	}, {
+		name:          "unknown rule",
+		method:        http.MethodPost,
+		target:        "?rule=unknown[0]",
+		authorization: token(testServiceAccount),
+		body:          envelope,
+		wantStatus:    http.StatusNotFound,
+	}, {
+		name:          "envelope",
+		method:        http.MethodPost,
+		authorization: token(testServiceAccount),
+		body:          envelope,
+		wantStatus:    http.StatusOK,
+		want: &previewResponse{BuildID: "some-build-id", Status: "SUCCESS", Rules: []*rulePreview{
+			{Rule: "renderer[0]", Kind: "TestRenderNotifier", MessageFilterMatch: true, Payload: "rendered some-build-id"},
+			{Rule: "template[0]", Kind: "TestNotifier", Match: true, FilterMatch: true, MessageFilterMatch: true, Payload: "some-build-id in some-message-id"},
+			{Rule: "template[1]", Kind: "TestNotifier", FilterMatch: true, Payload: "some-build-id"},
+		}},
+	}, {
+		name:          "Build JSON of one rule",
+		method:        http.MethodPost,
+		target:        "?rule=template[0]",
+		authorization: token(testServiceAccount),
+		body:          data,
+		wantStatus:    http.StatusOK,
+		want: &previewResponse{BuildID: "some-build-id", Status: "SUCCESS", Rules: []*rulePreview{
+			{Rule: "template[0]", Kind: "TestNotifier", Match: true, FilterMatch: true, MessageFilterMatch: true, Payload: "some-build-id in "},
+		}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://notifier.example.com/preview"+tc.target, bytes.NewReader(tc.body))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("got status %d (%s), want %d", w.Code, w.Body, tc.wantStatus)
+			}
+			if tc.want == nil {
+				return
+			}
+			got := new(previewResponse)
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("failed to unmarshal %q: %v", w.Body, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("got unexpected preview (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, rl := range rulesOf(rn.current.Load().notifier) {
+		var builds []string
+		switch n := rl.Notifier.(type) {
+		case *renderingNotifier:
+			builds = n.builds
+		case *ruleNotifier:
+			builds = n.builds
+		}
+		if len(builds) != 0 {
+			t.Errorf("notification rule %s was sent %v, want nothing", rl.name, builds)
+		}
+	}
+}
+
+func TestPreviewVerifierFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		audience        string
+		serviceAccounts string
+		wantVerifier    bool
+		wantErr         bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", audience: testAudience, serviceAccounts: testServiceAccount, wantVerifier: true},
+		{name: "without service accounts", audience: testAudience, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PREVIEW_AUTH_AUDIENCE", tc.audience)
+			t.Setenv("PREVIEW_AUTH_SERVICE_ACCOUNTS", tc.serviceAccounts)
+			v, err := previewVerifierFromEnv(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("previewVerifierFromEnv() got error %v, want error %v", err, tc.wantErr)
+			}
+			if (v != nil) != tc.wantVerifier {
+				t.Errorf("previewVerifierFromEnv() = %v, want a verifier %v", v, tc.wantVerifier)
+			}
+		})
+	}
+}
+
+func TestRenderRulePrefersRenderer(t *testing.T) {
+	build := &cbpb.Build{Id: "some-build-id", LogUrl: "https://example.com/log"}
+	rl := &rule{name: "renderer[0]", tmpl: "{{.Build.Id}} from the template", Notifier: new(renderingNotifier)}
+	got, err := renderRule(context.Background(), rl, build)
+	if err != nil {
+		t.Fatalf("renderRule failed: %v", err)
+	}
+	if got != "rendered some-build-id" {
+		t.Errorf("renderRule() = %q, want the Renderer's payload", got)
+	}
+	if build.LogUrl != "https://example.com/log" {
+		t.Errorf("Render modified the Build's log URL to %q", build.LogUrl)
+	}
+}
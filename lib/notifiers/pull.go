@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+const (
+	// defaultPullMaxOutstandingMessages bounds the number of messages that are handled concurrently in pull mode,
+	// unless PULL_MAX_OUTSTANDING_MESSAGES is set.
+	defaultPullMaxOutstandingMessages = 10
+	// defaultPullMaxExtension is how long the ack deadline of a message is extended for while it is being handled,
+	// unless PULL_MAX_EXTENSION is set.
+	defaultPullMaxExtension = 10 * time.Minute
+)
+
+var subscriptionName = regexp.MustCompile(`^projects/([^/]+)/subscriptions/([^/]+)$`)
+
+// pullSubscriptionName returns the subscription to pull from, given by --pull_subscription or PULL_SUBSCRIPTION, or
+// "" for push mode.
+func pullSubscriptionName() string {
+	if *pullSubscription != "" {
+		return *pullSubscription
+	}
+	name, _ := GetEnv("PULL_SUBSCRIPTION")
+	return name
+}
+
+// pullReceiveSettings returns the flow control settings for pull mode, from PULL_MAX_OUTSTANDING_MESSAGES,
+// PULL_MAX_OUTSTANDING_BYTES, PULL_NUM_GOROUTINES and PULL_MAX_EXTENSION.
+func pullReceiveSettings() (pubsub.ReceiveSettings, error) {
+	rs := pubsub.DefaultReceiveSettings
+	rs.MaxOutstandingMessages = defaultPullMaxOutstandingMessages
+	rs.MaxExtension = defaultPullMaxExtension
+
+	for _, setting := range []struct {
+		env string
+		dst *int
+	}{
+		{"PULL_MAX_OUTSTANDING_MESSAGES", &rs.MaxOutstandingMessages},
+		{"PULL_MAX_OUTSTANDING_BYTES", &rs.MaxOutstandingBytes},
+		{"PULL_NUM_GOROUTINES", &rs.NumGoroutines},
+	} {
+		v, ok := GetEnv(setting.env)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return rs, fmt.Errorf("expected %s %q to be a positive integer", setting.env, v)
+		}
+		*setting.dst = n
+	}
+
+	if v, ok := GetEnv("PULL_MAX_EXTENSION"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return rs, fmt.Errorf("expected PULL_MAX_EXTENSION %q to be a positive duration", v)
+		}
+		rs.MaxExtension = d
+	}
+	return rs, nil
+}
+
+// newPullSubscription returns a client and the subscription with the given `projects/<project>/subscriptions/<id>`
+// name. The client connects to the Pub/Sub emulator if PUBSUB_EMULATOR_HOST is set.
+func newPullSubscription(ctx context.Context, name string, opts ...option.ClientOption) (*pubsub.Client, *pubsub.Subscription, error) {
+	m := subscriptionName.FindStringSubmatch(name)
+	if m == nil {
+		return nil, nil, fmt.Errorf("expected pull subscription %q to be of the form `projects/<project>/subscriptions/<id>`", name)
+	}
+	client, err := pubsub.NewClient(ctx, m[1], opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create new Pub/Sub client: %w", err)
+	}
+	return client, client.Subscription(m[2]), nil
+}
+
+// receivePull pulls messages from the subscription until the context is done, and handles each of them like the push
+// receiver does. Messages that the push receiver would respond to with a non-2xx status are nacked.
+// While a message is being handled, the client extends its ack deadline for up to ReceiveSettings.MaxExtension.
+// Once the context is done, no more messages are pulled, and receivePull returns when the messages that are being
+// handled are finished; their notifications are not cancelled.
+func receivePull(ctx context.Context, sub *pubsub.Subscription, notifier Notifier, params *receiverParams) error {
+	V(2).Infof(ctx, "pulling messages from subscription %q with settings %+v", sub, sub.ReceiveSettings)
+	return sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		ctx = context.WithoutCancel(ctx)
+		pspw := &pubSubPushWrapper{
+			Message: pubSubPushMessage{
+				Data:        m.Data,
+				ID:          m.ID,
+				PublishTime: m.PublishTime.UTC().Format(time.RFC3339Nano),
+				Attributes:  m.Attributes,
+			},
+			Subscription:    sub.String(),
+			DeliveryAttempt: m.DeliveryAttempt,
+		}
+		if n := receive(ctx, notifier, params, pspw); n != nil {
+			V(2).Infof(ctx, "nacking PubSub message %q: %s", m.ID, n.msg)
+			m.Nack()
+			return
+		}
+		m.Ack()
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// flakyNotifier fails the first attempt for every Build whose ID is in failOnce.
+type flakyNotifier struct {
+	mtx      sync.Mutex
+	failOnce map[string]bool
+	attempts map[string]int
+}
+
+func (f *flakyNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (f *flakyNotifier) SendNotification(_ context.Context, b *cbpb.Build) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.attempts[b.Id]++
+	if f.failOnce[b.Id] && f.attempts[b.Id] == 1 {
+		return errors.New("got a 503")
+	}
+	return nil
+}
+
+func (f *flakyNotifier) count(id string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.attempts[id]
+}
+
+func TestReceivePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, sub, err := newPullSubscription(ctx, "projects/some-project/subscriptions/cloud-builds-notifier", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("newPullSubscription failed: %v", err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, cloudBuildTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateSubscription(ctx, sub.ID(), pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgIDs := map[string]string{}
+	for _, id := range []string{"good-build", "flaky-build"} {
+		data, err := protojson.Marshal(&cbpb.Build{Id: id, Status: cbpb.Build_SUCCESS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgIDs[id], err = topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a Build; nacked like the push receiver responds with a 400, unless bad messages are ignored.
+	badID, err := topic.Publish(ctx, &pubsub.Message{Data: []byte("#corrupted#")}).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.Stop()
+
+	n := &flakyNotifier{failOnce: map[string]bool{"flaky-build": true}, attempts: map[string]int{}}
+	pullCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- receivePull(pullCtx, sub, n, &receiverParams{ignoreBadMessages: true})
+	}()
+
+	for n.count("good-build") < 1 || n.count("flaky-build") < 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out with %d attempts for good-build and %d for flaky-build", n.count("good-build"), n.count("flaky-build"))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	stop()
+	if err := <-done; err != nil {
+		t.Errorf("receivePull failed: %v", err)
+	}
+
+	if got := n.count("good-build"); got != 1 {
+		t.Errorf("got %d attempts for good-build, want 1", got)
+	}
+	for _, id := range []string{msgIDs["good-build"], msgIDs["flaky-build"], badID} {
+		if m := srv.Message(id); m == nil || m.Acks == 0 {
+			t.Errorf("message %q was not acked: %+v", id, m)
+		}
+	}
+	if m := srv.Message(msgIDs["flaky-build"]); m.Deliveries < 2 {
+		t.Errorf("nacked message was delivered %d times, want at least 2", m.Deliveries)
+	}
+}
+
+func TestPullReceiveSettings(t *testing.T) {
+	rs, err := pullReceiveSettings()
+	if err != nil {
+		t.Fatalf("pullReceiveSettings failed: %v", err)
+	}
+	if rs.MaxOutstandingMessages != defaultPullMaxOutstandingMessages || rs.MaxExtension != defaultPullMaxExtension {
+		t.Errorf("got default settings %+v", rs)
+	}
+
+	t.Setenv("PULL_MAX_OUTSTANDING_MESSAGES", "3")
+	t.Setenv("PULL_NUM_GOROUTINES", "2")
+	t.Setenv("PULL_MAX_EXTENSION", "90s")
+	rs, err = pullReceiveSettings()
+	if err != nil {
+		t.Fatalf("pullReceiveSettings failed: %v", err)
+	}
+	if rs.MaxOutstandingMessages != 3 || rs.NumGoroutines != 2 || rs.MaxExtension != 90*time.Second {
+		t.Errorf("got settings %+v, want 3 outstanding messages, 2 goroutines and a 90s maximum extension", rs)
+	}
+
+	t.Setenv("PULL_MAX_OUTSTANDING_BYTES", "lots")
+	if _, err := pullReceiveSettings(); err == nil {
+		t.Error("pullReceiveSettings with a bad PULL_MAX_OUTSTANDING_BYTES unexpectedly succeeded")
+	}
+}
+
+func TestNewPullSubscriptionBadName(t *testing.T) {
+	if _, _, err := newPullSubscription(context.Background(), "cloud-builds-notifier"); err == nil {
+		t.Error("newPullSubscription with a short name unexpectedly succeeded")
+	}
+}
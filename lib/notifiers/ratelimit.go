@@ -0,0 +1,336 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultRateLimitInterval = time.Minute
+
+	rateLimitDrop     = "drop"
+	rateLimitCoalesce = "coalesce"
+)
+
+// RateLimitConfig is the `rateLimit` section of a notification rule, which limits the notifications that the rule sends
+// with a token bucket. Only Builds that match the rule's filter take a token. Rules that send to the same destination
+// (i.e. that have the same kind and `delivery` config) with the same `rateLimit` share their buckets.
+type RateLimitConfig struct {
+	// Rate is the number of notifications per Interval. Required.
+	Rate int `yaml:"rate"`
+	// Interval is the period of Rate, as a Go duration. Defaults to 1m.
+	Interval string `yaml:"interval,omitempty"`
+	// Burst is the number of notifications that can be sent at once after a quiet period. Defaults to Rate.
+	Burst int `yaml:"burst,omitempty"`
+	// PerTrigger gives every build trigger a bucket of its own, rather than sharing one between all Builds of the
+	// destination.
+	// Builds that were not started by a trigger share a bucket.
+	PerTrigger bool `yaml:"perTrigger,omitempty"`
+	// Policy is what happens to notifications in excess of the limit: `drop` (the default) drops them, and `coalesce`
+	// replaces them with one follow-up notification for the last of them once the bucket has a token again. Coalescing
+	// is best-effort: the suppressed messages are acked, and a pending follow-up only lives in memory, so it is lost if
+	// the instance stops without shutting down.
+	Policy string `yaml:"policy,omitempty"`
+}
+
+// rateLimiter is a token bucket for the notifications to one destination, or one per build trigger. It is shared by
+// every rule that sends to the destination with the same `rateLimit` config (see sharedRateLimiter).
+type rateLimiter struct {
+	// perSecond is the rate at which tokens are added to a bucket, up to burst.
+	perSecond  float64
+	burst      float64
+	perTrigger bool
+	coalesce   bool
+	// retry is the backoff between the attempts to send a follow-up, which cannot be redelivered by Pub/Sub.
+	retry *RetryPolicy
+	// now is replaced in tests.
+	now func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+	// pending counts the scheduled follow-ups that have not been sent yet.
+	pending sync.WaitGroup
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// followUp is the pending follow-up of a coalescing rateLimiter, which is sent when timer fires.
+	followUp *followUp
+	timer    *time.Timer
+}
+
+// followUp is the notification that stands in for those that a coalescing rateLimiter suppressed: that of the last
+// suppressed Build, along with the number of others.
+type followUp struct {
+	// send sends the follow-up through the rule that suppressed the last Build.
+	send    func(context.Context, *followUp)
+	build   *cbpb.Build
+	message *MessageView
+	others  int
+	// deadLetters records the follow-up if it cannot be sent, if set.
+	deadLetters *deadLetterSink
+}
+
+var (
+	rateLimitersMtx sync.Mutex
+	// rateLimiters are the rateLimiters of the process by destination and `rateLimit` config (see rateLimiterKey), so
+	// that they are shared between rules, and kept when the configs are reloaded. They are never removed, since there is
+	// only one for every destination and `rateLimit` config that was ever loaded.
+	rateLimiters = map[string]*rateLimiter{}
+)
+
+// sharedRateLimiter returns the rateLimiter for the given `rateLimit` config of rules of the given kind that send to
+// the given `delivery` config, creating it if no other rule uses it yet.
+func sharedRateLimiter(kind string, delivery map[string]interface{}, cfg *RateLimitConfig) (*rateLimiter, error) {
+	key := rateLimiterKey(kind, delivery, cfg)
+	rateLimitersMtx.Lock()
+	defer rateLimitersMtx.Unlock()
+	if l, ok := rateLimiters[key]; ok {
+		return l, nil
+	}
+	l, err := newRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rateLimiters[key] = l
+	return l, nil
+}
+
+// rateLimiterKey returns a hash of the destination of rules of the given kind with the given `delivery` config (before
+// secrets are resolved), and of their `rateLimit` config. fmt prints maps sorted by key, so equal configs hash alike.
+func rateLimiterKey(kind string, delivery map[string]interface{}, cfg *RateLimitConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%v\x00%+v", kind, delivery, *cfg)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newRateLimiter returns a new rateLimiter for the given `rateLimit` config.
+func newRateLimiter(cfg *RateLimitConfig) (*rateLimiter, error) {
+	if cfg.Rate <= 0 {
+		return nil, fmt.Errorf("expected rateLimit rate to be positive, got %d", cfg.Rate)
+	}
+	interval := defaultRateLimitInterval
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("expected rateLimit interval %q to be a positive duration", cfg.Interval)
+		}
+		interval = d
+	}
+	burst := cfg.Rate
+	if cfg.Burst < 0 {
+		return nil, fmt.Errorf("expected rateLimit burst to be positive, got %d", cfg.Burst)
+	} else if cfg.Burst > 0 {
+		burst = cfg.Burst
+	}
+	var coalesce bool
+	switch cfg.Policy {
+	case "", rateLimitDrop:
+	case rateLimitCoalesce:
+		coalesce = true
+	default:
+		return nil, fmt.Errorf("expected rateLimit policy to be %q or %q, got %q", rateLimitDrop, rateLimitCoalesce, cfg.Policy)
+	}
+
+	return &rateLimiter{
+		perSecond:  float64(cfg.Rate) / interval.Seconds(),
+		burst:      float64(burst),
+		perTrigger: cfg.PerTrigger,
+		coalesce:   coalesce,
+		retry:      &RetryPolicy{Attempts: defaultDeadLetterAttempts, InitialBackoff: defaultRetryInitialBackoff, MaxBackoff: defaultRetryMaxBackoff},
+		now:        time.Now,
+		buckets:    make(map[string]*bucket),
+	}, nil
+}
+
+func (l *rateLimiter) policy() string {
+	if l.coalesce {
+		return rateLimitCoalesce
+	}
+	return rateLimitDrop
+}
+
+// allow takes a token from the Build's bucket and returns true, or returns false if the bucket is empty. A coalescing
+// rateLimiter then schedules a follow-up for when the bucket has a token again, with a copy of the Build and the
+// message and dead-letter sink of the context, and suppresses every notification until then. The follow-up is sent
+// with the send function of the last suppressed notification.
+func (l *rateLimiter) allow(ctx context.Context, build *cbpb.Build, send func(context.Context, *followUp)) bool {
+	var key string
+	if l.perTrigger {
+		key = build.GetBuildTriggerId()
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b := l.refill(key)
+	if b.followUp == nil && b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	if !l.coalesce {
+		return false
+	}
+
+	if b.followUp == nil {
+		b.followUp = new(followUp)
+		wait := time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+		l.pending.Add(1)
+		b.timer = time.AfterFunc(wait, func() { l.fire(key) })
+	} else {
+		b.followUp.others++
+	}
+	b.followUp.send = send
+	b.followUp.build, b.followUp.message = proto.Clone(build).(*cbpb.Build), MessageFrom(ctx)
+	b.followUp.deadLetters = deadLettersFrom(ctx)
+	return false
+}
+
+// refill returns the bucket of the key with the tokens it gained since it was last refilled. l.mtx must be held.
+func (l *rateLimiter) refill(key string) *bucket {
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.perSecond
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+	b.last = now
+	return b
+}
+
+// fire sends the pending follow-up of the key's bucket, using the token that it waited for.
+func (l *rateLimiter) fire(key string) {
+	defer l.pending.Done()
+	l.mtx.Lock()
+	b := l.refill(key)
+	f := b.followUp
+	b.followUp, b.timer = nil, nil
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		b.tokens = 0
+	}
+	l.mtx.Unlock()
+
+	if f != nil {
+		f.send(context.Background(), f)
+	}
+}
+
+// flush sends the pending follow-ups right away, including those of other rules that share the rateLimiter, and waits
+// for those that are already being sent. The context bounds the retries of the follow-ups that flush sends.
+func (l *rateLimiter) flush(ctx context.Context) {
+	var fs []*followUp
+	l.mtx.Lock()
+	for _, b := range l.buckets {
+		if b.timer != nil && b.timer.Stop() {
+			fs = append(fs, b.followUp)
+			b.followUp, b.timer = nil, nil
+			l.pending.Done()
+		}
+	}
+	l.mtx.Unlock()
+
+	for _, f := range fs {
+		f.send(ctx, f)
+	}
+	l.pending.Wait()
+}
+
+type suppressedKey struct{}
+
+// withSuppressed returns a context for the follow-up of n suppressed notifications (see SuppressedFrom).
+func withSuppressed(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, suppressedKey{}, n)
+}
+
+// SuppressedFrom returns the number of notifications that a `coalesce` rate limit suppressed in favor of the
+// follow-up notification that the context is for, other than that of its own Build, or 0.
+func SuppressedFrom(ctx context.Context) int {
+	n, _ := ctx.Value(suppressedKey{}).(int)
+	return n
+}
+
+// rateLimited returns true if the rule's rate limit suppresses its notification of the Build. Builds that do not match
+// the rule's filter are never suppressed, since they are not delivered anyway.
+func (r *rule) rateLimited(ctx context.Context, build *cbpb.Build) bool {
+	if r.limiter == nil {
+		return false
+	}
+	if r.filter != nil {
+		if match, err := r.filter.eval(ctx, build); err != nil || !match {
+			return false
+		}
+	}
+	if r.limiter.allow(ctx, build, r.sendFollowUp) {
+		return false
+	}
+
+	policy := r.limiter.policy()
+	rateLimited.WithLabelValues(r.kind(), policy).Inc()
+	if policy == rateLimitCoalesce {
+		Infof(ctx, "notification rule %s is over the rate limit of its destination, coalescing its notification of Build %q into a follow-up", r.name, build.GetId())
+		recordOutcome(ctx, r.name, "coalesced into a follow-up by the rate limit")
+	} else {
+		Warningf(ctx, "notification rule %s is over the rate limit of its destination, dropping its notification of Build %q", r.name, build.GetId())
+		recordOutcome(ctx, r.name, "dropped by the rate limit")
+	}
+	return true
+}
+
+// sendFollowUp sends the follow-up of notifications that the rule's rate limit coalesced. The messages of those
+// notifications were acked, so rather than being redelivered, a follow-up that fails with a retryable error is
+// retried with the rate limiter's RetryPolicy, as often as the dead-letter sink allows before recording a message. A
+// follow-up that still fails (or whose destination asks to wait longer than the maximum backoff) is recorded in the
+// dead-letter sink, if there is one.
+func (r *rule) sendFollowUp(ctx context.Context, f *followUp) {
+	ctx = withSuppressed(withBuild(WithMessage(ctx, f.message), f.build), f.others)
+	Infof(ctx, "notification rule %s is sending a follow-up for Build %q and %d more suppressed notifications", r.name, f.build.GetId(), f.others)
+
+	p := *r.limiter.retry
+	if f.deadLetters != nil {
+		p.Attempts = f.deadLetters.afterAttempts
+	}
+	// Unlike Do, do leaves the delivery metrics alone, since send already counts every attempt.
+	attempt, err := p.do(ctx, func(ctx context.Context) error { return r.send(ctx, f.build) })
+	if err == nil {
+		return
+	}
+
+	if f.deadLetters == nil {
+		Errorf(ctx, "failed to send follow-up notification after %d attempts: %v", attempt, err)
+		return
+	}
+	if derr := f.deadLetters.record(ctx, f.message.pushMessage(), attempt, f.build, err); derr != nil {
+		Errorf(ctx, "failed to record follow-up notification in the dead-letter sink after %d failed attempts: %v (recording failed: %v)", attempt, err, derr)
+		return
+	}
+	Warningf(ctx, "recorded follow-up notification in the dead-letter sink after %d failed attempts: %v", attempt, err)
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+)
+
+// followUpNotifier sends the ID of every Build, along with the number of suppressed notifications, to its channel.
+type followUpNotifier struct {
+	sent chan string
+}
+
+func (f *followUpNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (f *followUpNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	f.sent <- fmt.Sprintf("%s+%d", build.GetId(), SuppressedFrom(ctx))
+	return nil
+}
+
+// failAfterFirstNotifier delivers the first Build and fails to deliver any other.
+type failAfterFirstNotifier struct {
+	calls int
+}
+
+func (f *failAfterFirstNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (f *failAfterFirstNotifier) SendNotification(_ context.Context, _ *cbpb.Build) error {
+	f.calls++
+	if f.calls > 1 {
+		return errors.New("destination is down")
+	}
+	return nil
+}
+
+// useRateLimiters replaces the process-wide rateLimiters for the duration of the test, so that tests do not share
+// buckets.
+func useRateLimiters(t *testing.T) {
+	t.Helper()
+	rateLimitersMtx.Lock()
+	prev := rateLimiters
+	rateLimiters = map[string]*rateLimiter{}
+	rateLimitersMtx.Unlock()
+	t.Cleanup(func() {
+		rateLimitersMtx.Lock()
+		rateLimiters = prev
+		rateLimitersMtx.Unlock()
+	})
+}
+
+func setUpRateLimitedRule(t *testing.T, n Notifier, rl *RateLimitConfig) *rule {
+	t.Helper()
+	useRateLimiters(t)
+	cfg := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       "TestNotifier",
+		Metadata:   &Metadata{Name: "limited"},
+		Spec:       &Spec{Notification: &Notification{Filter: `build.status == Build.Status.FAILURE`, RateLimit: rl}},
+	}
+	r, err := setUpRule(context.Background(), "limited[0]", n, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("setUpRule failed: %v", err)
+	}
+	return r
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     *RateLimitConfig
+		want    *rateLimiter
+		wantErr bool
+	}{
+		{name: "defaults", cfg: &RateLimitConfig{Rate: 30}, want: &rateLimiter{perSecond: 0.5, burst: 30}},
+		{name: "all fields", cfg: &RateLimitConfig{Rate: 2, Interval: "1s", Burst: 5, PerTrigger: true, Policy: "coalesce"}, want: &rateLimiter{perSecond: 2, burst: 5, perTrigger: true, coalesce: true}},
+		{name: "drop", cfg: &RateLimitConfig{Rate: 1, Policy: "drop"}, want: &rateLimiter{perSecond: 1.0 / 60, burst: 1}},
+		{name: "no rate", cfg: &RateLimitConfig{Interval: "1m"}, wantErr: true},
+		{name: "bad interval", cfg: &RateLimitConfig{Rate: 1, Interval: "0s"}, wantErr: true},
+		{name: "negative burst", cfg: &RateLimitConfig{Rate: 1, Burst: -1}, wantErr: true},
+		{name: "unknown policy", cfg: &RateLimitConfig{Rate: 1, Policy: "queue"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := newRateLimiter(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("newRateLimiter(%+v) got error %v, want error %v", tc.cfg, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if got.perSecond != tc.want.perSecond || got.burst != tc.want.burst || got.perTrigger != tc.want.perTrigger || got.coalesce != tc.want.coalesce {
+				t.Errorf("newRateLimiter(%+v) = %+v, want %+v", tc.cfg, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	useStatus(t)
+	n := new(ruleNotifier)
+	rl := setUpRateLimitedRule(t, n, &RateLimitConfig{Rate: 2, Interval: "1s", PerTrigger: true})
+	now := time.Unix(1600000000, 0)
+	rl.limiter.now = func() time.Time { return now }
+
+	for _, b := range []struct {
+		id      string
+		trigger string
+		status  cbpb.Build_Status
+		after   time.Duration
+	}{
+		{id: "a-1", trigger: "a", status: cbpb.Build_FAILURE},
+		{id: "a-2", trigger: "a", status: cbpb.Build_FAILURE},
+		{id: "a-3", trigger: "a", status: cbpb.Build_FAILURE},
+		// Builds that the filter does not match take no token.
+		{id: "a-success", trigger: "a", status: cbpb.Build_SUCCESS},
+		{id: "b-1", trigger: "b", status: cbpb.Build_FAILURE},
+		{id: "a-4", trigger: "a", status: cbpb.Build_FAILURE, after: 250 * time.Millisecond},
+		{id: "a-5", trigger: "a", status: cbpb.Build_FAILURE, after: 250 * time.Millisecond},
+		{id: "a-6", trigger: "a", status: cbpb.Build_FAILURE},
+	} {
+		now = now.Add(b.after)
+		if err := rl.SendNotification(context.Background(), &cbpb.Build{Id: b.id, BuildTriggerId: b.trigger, Status: b.status}); err != nil {
+			t.Fatalf("SendNotification(%s) failed: %v", b.id, err)
+		}
+	}
+
+	want := []string{"a-1", "a-2", "a-success", "b-1", "a-5"}
+	if diff := cmp.Diff(want, n.builds); diff != "" {
+		t.Errorf("got unexpected notifications (-want +got):\n%s", diff)
+	}
+}
+
+func TestRateLimitSharedByDestination(t *testing.T) {
+	useStatus(t)
+	useRateLimiters(t)
+	ctx := context.Background()
+	rlc := &RateLimitConfig{Rate: 1, Interval: "1h"}
+	setUp := func(name, url string, rlc *RateLimitConfig) (*rule, *ruleNotifier) {
+		t.Helper()
+		cfg := &Config{
+			APIVersion: apiVersionV1,
+			Kind:       "TestNotifier",
+			Metadata:   &Metadata{Name: name},
+			Spec: &Spec{Notification: &Notification{
+				Filter:    `build.status == Build.Status.FAILURE`,
+				Delivery:  map[string]interface{}{"webhookUrl": map[interface{}]interface{}{"secretRef": url}},
+				RateLimit: rlc,
+			}},
+		}
+		n := new(ruleNotifier)
+		r, err := setUpRule(ctx, name+"[0]", n, cfg, new(setupCheckSecretGetter), nil)
+		if err != nil {
+			t.Fatalf("setUpRule failed: %v", err)
+		}
+		return r, n
+	}
+	first, firstN := setUp("first", "webhook", rlc)
+	second, secondN := setUp("second", "webhook", &RateLimitConfig{Rate: 1, Interval: "1h"})
+	other, otherN := setUp("other", "other-webhook", rlc)
+	if first.limiter != second.limiter {
+		t.Error("rules with the same destination and rate limit got different rateLimiters")
+	}
+	if first.limiter == other.limiter {
+		t.Error("rules with different destinations got the same rateLimiter")
+	}
+
+	for i, rl := range []*rule{first, second, other} {
+		if err := rl.SendNotification(ctx, &cbpb.Build{Id: fmt.Sprintf("build-%d", i), Status: cbpb.Build_FAILURE}); err != nil {
+			t.Fatalf("SendNotification failed: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		n    *ruleNotifier
+		want []string
+	}{
+		{name: "first", n: firstN, want: []string{"build-0"}},
+		// The first rule took the only token of the destination.
+		{name: "second", n: secondN, want: nil},
+		{name: "other", n: otherN, want: []string{"build-2"}},
+	} {
+		if diff := cmp.Diff(tc.want, tc.n.builds); diff != "" {
+			t.Errorf("got unexpected notifications of rule %s (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestRateLimitCoalesce(t *testing.T) {
+	useStatus(t)
+	receive := func(t *testing.T, sent chan string) string {
+		t.Helper()
+		select {
+		case s := <-sent:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a notification")
+			return ""
+		}
+	}
+	send := func(t *testing.T, rl *rule, ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			if err := rl.SendNotification(context.Background(), &cbpb.Build{Id: id, Status: cbpb.Build_FAILURE}); err != nil {
+				t.Fatalf("SendNotification(%s) failed: %v", id, err)
+			}
+		}
+	}
+
+	t.Run("follow-up", func(t *testing.T) {
+		n := &followUpNotifier{sent: make(chan string, 10)}
+		rl := setUpRateLimitedRule(t, n, &RateLimitConfig{Rate: 1, Interval: "100ms", Policy: "coalesce"})
+		send(t, rl, "build-1", "build-2", "build-3", "build-4")
+		if got := receive(t, n.sent); got != "build-1+0" {
+			t.Errorf("got notification %q, want the first Build's", got)
+		}
+		if got := receive(t, n.sent); got != "build-4+2" {
+			t.Errorf("got follow-up %q, want one for the last Build and 2 more", got)
+		}
+	})
+
+	t.Run("flushed on close", func(t *testing.T) {
+		n := &followUpNotifier{sent: make(chan string, 10)}
+		rl := setUpRateLimitedRule(t, n, &RateLimitConfig{Rate: 1, Interval: "1h", Policy: "coalesce"})
+		send(t, rl, "build-1", "build-2")
+		if got := receive(t, n.sent); got != "build-1+0" {
+			t.Errorf("got notification %q, want the first Build's", got)
+		}
+		if err := closeNotifier(context.Background(), rl); err != nil {
+			t.Fatalf("closeNotifier failed: %v", err)
+		}
+		select {
+		case got := <-n.sent:
+			if got != "build-2+0" {
+				t.Errorf("got follow-up %q, want one for the suppressed Build", got)
+			}
+		default:
+			t.Error("closeNotifier did not send the pending follow-up")
+		}
+	})
+}
+
+func TestRateLimitFollowUpDeadLettered(t *testing.T) {
+	useStatus(t)
+	n := new(failAfterFirstNotifier)
+	rl := setUpRateLimitedRule(t, n, &RateLimitConfig{Rate: 1, Interval: "1h", Policy: "coalesce"})
+	rl.limiter.retry.sleep = func(context.Context, time.Duration) error { return nil }
+	store := fileDeadLetterStore(t.TempDir())
+	ctx := withDeadLetters(context.Background(), newDeadLetterSink(store, 3))
+
+	for _, id := range []string{"build-1", "build-2"} {
+		msgCtx := WithMessage(ctx, &MessageView{ID: "message-" + id})
+		if err := rl.SendNotification(msgCtx, &cbpb.Build{Id: id, Status: cbpb.Build_FAILURE}); err != nil {
+			t.Fatalf("SendNotification(%s) failed: %v", id, err)
+		}
+	}
+	if err := closeNotifier(ctx, rl); err != nil {
+		t.Fatalf("closeNotifier failed: %v", err)
+	}
+
+	// The first notification, then 3 attempts to send the follow-up.
+	if n.calls != 4 {
+		t.Errorf("got %d calls to SendNotification, want 4", n.calls)
+	}
+	names, err := store.List(ctx)
+	if err != nil || len(names) != 1 {
+		t.Fatalf("store.List() = (%v, %v), want one record", names, err)
+	}
+	data, err := store.Read(ctx, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(deadLetterRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MessageID != "message-build-2" || rec.Rule != "limited[0]" || rec.Attempts != 3 {
+		t.Errorf("got record of message %q for rule %q after %d attempts, want message-build-2 for limited[0] after 3", rec.MessageID, rec.Rule, rec.Attempts)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory returns a new Notifier that has not been set up yet.
+type Factory func() Notifier
+
+var (
+	registryMtx sync.RWMutex
+	registry    = map[string]Factory{}
+)
+
+// Register makes a Notifier implementation available under the given Config `kind` (e.g. `SlackNotifier`).
+// It is meant to be called from the `init` function of a notifier package and panics if the kind is empty or
+// already registered.
+func Register(kind string, f Factory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	if kind == "" {
+		panic("notifiers: Register called with an empty kind")
+	}
+	if f == nil {
+		panic(fmt.Sprintf("notifiers: Register called with a nil Factory for kind %q", kind))
+	}
+	if _, ok := registry[kind]; ok {
+		panic(fmt.Sprintf("notifiers: Register called twice for kind %q", kind))
+	}
+	registry[kind] = f
+}
+
+// Lookup returns the Factory registered under the given kind, if any.
+func Lookup(kind string) (Factory, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	f, ok := registry[kind]
+	return f, ok
+}
+
+// Kinds returns the sorted list of registered kinds.
+func Kinds() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	kinds := make([]string, 0, len(registry))
+	for k := range registry {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// newFromRegistry returns a new Notifier for the given Config's `kind`.
+func newFromRegistry(cfg *Config) (Notifier, error) {
+	f, ok := Lookup(cfg.Kind)
+	if !ok {
+		return nil, fmt.Errorf("no notifier is registered for kind %q (registered kinds: %v)", cfg.Kind, Kinds())
+	}
+	return f(), nil
+}
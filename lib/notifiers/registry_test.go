@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	const kind = "TestRegisterNotifier"
+	Register(kind, func() Notifier { return new(ruleNotifier) })
+
+	f, ok := Lookup(kind)
+	if !ok {
+		t.Fatalf("Lookup(%q) found nothing", kind)
+	}
+	if _, ok := f().(*ruleNotifier); !ok {
+		t.Errorf("Factory for %q returned %T, want *ruleNotifier", kind, f())
+	}
+
+	kinds := Kinds()
+	if !sort.StringsAreSorted(kinds) {
+		t.Errorf("Kinds() = %v, want a sorted list", kinds)
+	}
+	if i := sort.SearchStrings(kinds, kind); i == len(kinds) || kinds[i] != kind {
+		t.Errorf("Kinds() = %v, want it to contain %q", kinds, kind)
+	}
+
+	if _, ok := Lookup("UnknownNotifier"); ok {
+		t.Error("Lookup of an unregistered kind unexpectedly succeeded")
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	const kind = "TestRegisterPanicsNotifier"
+	Register(kind, func() Notifier { return new(ruleNotifier) })
+
+	for _, tc := range []struct {
+		name string
+		kind string
+		f    Factory
+	}{{
+		name: "duplicate kind",
+		kind: kind,
+		f:    func() Notifier { return new(ruleNotifier) },
+	}, {
+		name: "empty kind",
+		f:    func() Notifier { return new(ruleNotifier) },
+	}, {
+		name: "nil factory",
+		kind: "TestRegisterNilFactoryNotifier",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Register(%q) did not panic", tc.kind)
+				}
+			}()
+			Register(tc.kind, tc.f)
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+)
+
+// loadedConfig is the result of reading, validating and setting up all configs once.
+type loadedConfig struct {
+	notifier Notifier
+	// versions maps the URI of every object (config or template) that went into this load to its version.
+	versions map[string]string
+	// names are the metadata names of the loaded configs.
+	names []string
+
+	// inflight is held for reading by every SendNotification call, and for writing while the Notifiers are closed.
+	inflight sync.RWMutex
+	closed   bool
+}
+
+// close waits for in-flight notifications and then closes the Notifiers (see Closer).
+func (lc *loadedConfig) close(ctx context.Context) error {
+	lc.inflight.Lock()
+	defer lc.inflight.Unlock()
+	if lc.closed {
+		return nil
+	}
+	lc.closed = true
+	return closeNotifier(ctx, lc.notifier)
+}
+
+// loadFunc reads, validates and sets up all configs on fresh Notifier instances.
+type loadFunc func(context.Context) (*loadedConfig, error)
+
+// splitConfigPaths splits the (comma-separated) value of CONFIG_PATH into individual paths.
+func splitConfigPaths(paths string) []string {
+	var ret []string
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// loadConfigs reads and validates the configs at the given URIs and sets up all of their notification rules.
+func loadConfigs(ctx context.Context, paths []string, src ConfigSource, sg SecretGetter, prototypeFor prototypeFunc) (*loadedConfig, error) {
+	versions := map[string]string{}
+	// Record versions before reading, so that a concurrent update is (at worst) picked up by the next poll.
+	record := func(uri string) error {
+		v, err := src.Version(ctx, uri)
+		if err != nil {
+			return fmt.Errorf("failed to get version of %q: %w", uri, err)
+		}
+		versions[uri] = v
+		return nil
+	}
+
+	var cfgs []*Config
+	var names []string
+	for _, path := range paths {
+		if err := record(path); err != nil {
+			return nil, err
+		}
+
+		cfg, err := getConfig(ctx, src, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config: %w", err)
+		}
+
+		if err := validateConfig(ctx, cfg); err != nil {
+			return nil, fmt.Errorf("got invalid config from path %q: %w", path, err)
+		}
+		cfg = convertConfig(cfg)
+		V(2).Infof(ctx, "got config from %q: %+v", path, cfg)
+
+		for _, n := range cfg.Spec.NotificationRules() {
+			for _, uri := range templateURIs(n.Template) {
+				if err := record(uri); err != nil {
+					return nil, err
+				}
+			}
+		}
+		cfgs = append(cfgs, cfg)
+		if cfg.Metadata != nil && cfg.Metadata.Name != "" {
+			names = append(names, cfg.Metadata.Name)
+		}
+	}
+
+	notifier, err := setUpConfigs(ctx, cfgs, prototypeFor, sg, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loadedConfig{notifier: notifier, versions: versions, names: names}, nil
+}
+
+// templateURIs returns the URIs of the given template and of its partials.
+func templateURIs(tmpl *Template) []string {
+	if tmpl == nil {
+		return nil
+	}
+	var uris []string
+	if tmpl.URI != "" {
+		uris = append(uris, tmpl.URI)
+	}
+	for _, p := range tmpl.Partials {
+		if p != nil && p.URI != "" {
+			uris = append(uris, p.URI)
+		}
+	}
+	return uris
+}
+
+// reloadingNotifier is a Notifier that delegates to the most recently (and successfully) loaded configs.
+type reloadingNotifier struct {
+	load    loadFunc
+	current atomic.Pointer[loadedConfig]
+
+	// mtx serializes reloads.
+	mtx sync.Mutex
+	// failed holds the versions of the last load that failed, so that the same bad config is not retried on every
+	// poll.
+	failed map[string]string
+}
+
+// newReloadingNotifier performs the initial load, which must succeed.
+func newReloadingNotifier(ctx context.Context, load loadFunc) (*reloadingNotifier, error) {
+	lc, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reloadingNotifier{load: load}
+	r.current.Store(lc)
+	serverStatus.loaded(lc)
+	return r, nil
+}
+
+// SetUp is a no-op since configs are loaded (and their Notifiers set up) by the reloadingNotifier itself.
+func (r *reloadingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+// SendNotification sends the Build using the most recently loaded configs.
+func (r *reloadingNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	lc, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer lc.inflight.RUnlock()
+	return lc.notifier.SendNotification(ctx, build)
+}
+
+// acquire returns the most recently loaded configs, which are not closed until the caller calls
+// lc.inflight.RUnlock.
+func (r *reloadingNotifier) acquire() (*loadedConfig, error) {
+	for {
+		lc := r.current.Load()
+		lc.inflight.RLock()
+		if !lc.closed {
+			return lc, nil
+		}
+		lc.inflight.RUnlock()
+		// Closed by a reload, which already swapped in new configs, or by Close.
+		if r.current.Load() == lc {
+			return nil, errors.New("notifier is shut down")
+		}
+	}
+}
+
+// Close closes the Notifiers of the current configs once their in-flight notifications are finished.
+func (r *reloadingNotifier) Close(ctx context.Context) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.current.Load().close(ctx)
+}
+
+func (r *reloadingNotifier) matchesMessage(ctx context.Context, m *MessageView) bool {
+	return matchesMessage(ctx, r.current.Load().notifier, m)
+}
+
+// reload loads all configs again and, if that succeeds, atomically swaps them in.
+// If loading fails, the previously loaded configs keep serving, but the notifier is reported as not ready (see
+// status) until a reload succeeds.
+func (r *reloadingNotifier) reload(ctx context.Context) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	lc, err := r.load(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to reload configs, keeping the last good configs: %w", err)
+		serverStatus.reloadFailed(err)
+		return err
+	}
+
+	old := r.current.Swap(lc)
+	r.failed = nil
+	serverStatus.loaded(lc)
+	Infof(ctx, "reloaded notifier configs: %v", lc.versions)
+
+	// Notifications that are in flight finish with the old configs before their Notifiers are closed.
+	go func() {
+		if err := old.close(context.Background()); err != nil {
+			Warningf(ctx, "failed to close the Notifiers of replaced configs: %v", err)
+		}
+	}()
+	return nil
+}
+
+// changed returns true if the version of any tracked object differs from the loaded one and from that of the last
+// failed load.
+func (r *reloadingNotifier) changed(ctx context.Context, src ConfigSource) (bool, error) {
+	r.mtx.Lock()
+	failed := r.failed
+	r.mtx.Unlock()
+
+	current, err := currentVersions(ctx, src, r.current.Load().versions)
+	if err != nil {
+		return false, err
+	}
+
+	if sameVersions(current, r.current.Load().versions) {
+		return false, nil
+	}
+	if failed != nil && sameVersions(current, failed) {
+		// Nothing changed since the last failed attempt.
+		return false, nil
+	}
+	return true, nil
+}
+
+// poll reloads the configs whenever one of the tracked objects changes, until the context is done.
+func (r *reloadingNotifier) poll(ctx context.Context, interval time.Duration, src ConfigSource) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		changed, err := r.changed(ctx, src)
+		if err != nil {
+			Warningf(ctx, "failed to check notifier configs for changes: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		Infof(ctx, "detected a change in the notifier configs, reloading")
+		if err := r.reloadAndRemember(ctx, src); err != nil {
+			Errorf(ctx, "%v", err)
+		}
+	}
+}
+
+// reloadAndRemember is like reload, but remembers the versions of a failed load so that polling does not keep
+// retrying the same bad config.
+func (r *reloadingNotifier) reloadAndRemember(ctx context.Context, src ConfigSource) error {
+	err := r.reload(ctx)
+	if err == nil {
+		return nil
+	}
+
+	failed, verr := currentVersions(ctx, src, r.current.Load().versions)
+	if verr != nil {
+		Warningf(ctx, "failed to get versions of the failed notifier configs: %v", verr)
+	}
+	r.mtx.Lock()
+	r.failed = failed
+	r.mtx.Unlock()
+	return err
+}
+
+// reloadOnSignal reloads the configs every time one of the given signals is received, until the context is done.
+func (r *reloadingNotifier) reloadOnSignal(ctx context.Context, sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-c:
+			Infof(ctx, "got signal %v, reloading notifier configs", sig)
+			if err := r.reload(ctx); err != nil {
+				Errorf(ctx, "%v", err)
+			}
+		}
+	}
+}
+
+// currentVersions returns the current versions of all URIs in the given map.
+func currentVersions(ctx context.Context, src ConfigSource, versions map[string]string) (map[string]string, error) {
+	current := map[string]string{}
+	for uri := range versions {
+		v, err := src.Version(ctx, uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get version of %q: %w", uri, err)
+		}
+		current[uri] = v
+	}
+	return current, nil
+}
+
+func sameVersions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
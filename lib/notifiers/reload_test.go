@@ -0,0 +1,148 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+)
+
+const reloadConfigYAML = `
+apiVersion: cloud-build-notifiers/v1
+kind: TestNotifier
+spec:
+  notification:
+    filter: %s
+    template:
+      type: golang
+      uri: gs://bucket/template.json
+`
+
+func reloadConfig(filter string) string {
+	return fmt.Sprintf(reloadConfigYAML, filter)
+}
+
+func TestSplitConfigPaths(t *testing.T) {
+	got := splitConfigPaths(" gs://bucket/a.yaml,gs://bucket/b.yaml ,, ")
+	want := []string{"gs://bucket/a.yaml", "gs://bucket/b.yaml"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("splitConfigPaths produced unexpected diff: (want- got+)\n%s", diff)
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	grf := &fakeGCSReaderFactory{
+		data: map[string]string{
+			"gs://bucket/config.yaml":   reloadConfig("first"),
+			"gs://bucket/template.json": "{{.Build.Id}}",
+		},
+		generations: map[string]int64{
+			"gs://bucket/config.yaml":   1,
+			"gs://bucket/template.json": 2,
+		},
+	}
+
+	lc, err := loadConfigs(context.Background(), []string{"gs://bucket/config.yaml"}, &gcsSource{grf}, new(setupCheckSecretGetter), prototypeOf(new(ruleNotifier)))
+	if err != nil {
+		t.Fatalf("loadConfigs failed: %v", err)
+	}
+
+	wantVersions := map[string]string{
+		"gs://bucket/config.yaml":   "1",
+		"gs://bucket/template.json": "2",
+	}
+	if diff := cmp.Diff(wantVersions, lc.versions); diff != "" {
+		t.Errorf("loadConfigs recorded unexpected versions: (want- got+)\n%s", diff)
+	}
+	if got := lc.notifier.(*rule).Notifier.(*ruleNotifier).filter; got != "first" {
+		t.Errorf("loaded notifier has filter %q, want %q", got, "first")
+	}
+}
+
+func TestReloadingNotifier(t *testing.T) {
+	ctx := context.Background()
+	grf := &fakeGCSReaderFactory{
+		data: map[string]string{
+			"gs://bucket/config.yaml":   reloadConfig("first"),
+			"gs://bucket/template.json": "{{.Build.Id}}",
+		},
+		generations: map[string]int64{
+			"gs://bucket/config.yaml":   1,
+			"gs://bucket/template.json": 1,
+		},
+	}
+	src := &gcsSource{grf}
+	load := func(ctx context.Context) (*loadedConfig, error) {
+		return loadConfigs(ctx, []string{"gs://bucket/config.yaml"}, src, new(setupCheckSecretGetter), func(int, *Config) (Notifier, error) {
+			return new(ruleNotifier), nil
+		})
+	}
+
+	rn, err := newReloadingNotifier(ctx, load)
+	if err != nil {
+		t.Fatalf("newReloadingNotifier failed: %v", err)
+	}
+	first := rn.current.Load().notifier.(*rule).Notifier.(*ruleNotifier)
+
+	if changed, err := rn.changed(ctx, src); err != nil || changed {
+		t.Fatalf("changed() = (%v, %v) before any update, want (false, nil)", changed, err)
+	}
+
+	// A new template generation triggers a reload that swaps in a freshly set up notifier.
+	grf.generations["gs://bucket/template.json"] = 2
+	grf.data["gs://bucket/config.yaml"] = reloadConfig("second")
+	if changed, err := rn.changed(ctx, src); err != nil || !changed {
+		t.Fatalf("changed() = (%v, %v) after a template update, want (true, nil)", changed, err)
+	}
+	if err := rn.reloadAndRemember(ctx, src); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	if err := rn.SendNotification(ctx, &cbpb.Build{Id: "some-build"}); err != nil {
+		t.Fatalf("SendNotification failed: %v", err)
+	}
+	second := rn.current.Load().notifier.(*rule).Notifier.(*ruleNotifier)
+	if second == first {
+		t.Fatal("reload did not swap in a new notifier")
+	}
+	if second.filter != "second" {
+		t.Errorf("reloaded notifier has filter %q, want %q", second.filter, "second")
+	}
+	if len(first.builds) != 0 || len(second.builds) != 1 {
+		t.Errorf("got %d builds on the old notifier and %d on the new one, want 0 and 1", len(first.builds), len(second.builds))
+	}
+
+	// An invalid config keeps the last good one serving and is not retried until it changes again.
+	grf.generations["gs://bucket/config.yaml"] = 3
+	grf.data["gs://bucket/config.yaml"] = "apiVersion: cloud-build-notifiers/v0"
+	if err := rn.reloadAndRemember(ctx, src); err == nil {
+		t.Fatal("reload of an invalid config unexpectedly succeeded")
+	}
+	if rn.current.Load().notifier.(*rule).Notifier != second {
+		t.Error("failed reload replaced the last good notifier")
+	}
+	if changed, err := rn.changed(ctx, src); err != nil || changed {
+		t.Errorf("changed() = (%v, %v) after a failed reload, want (false, nil)", changed, err)
+	}
+
+	grf.generations["gs://bucket/config.yaml"] = 4
+	if changed, err := rn.changed(ctx, src); err != nil || !changed {
+		t.Errorf("changed() = (%v, %v) after fixing the config, want (true, nil)", changed, err)
+	}
+}
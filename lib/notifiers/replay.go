@@ -0,0 +1,263 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/storage"
+)
+
+// replayMessage is a request body that --replay handles like a pushed message.
+type replayMessage struct {
+	// source is the file that the message was read from, followed by its index for files of several messages.
+	source string
+	body   []byte
+}
+
+// readReplayMessages reads the messages in the file at path or, if it is a directory, in each of its files in lexical
+// order (skipping subdirectories and hidden files). Every file holds one or more JSON values, such as one Pub/Sub push
+// envelope or Build per line (NDJSON).
+func readReplayMessages(path string) ([]*replayMessage, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	if !fi.IsDir() {
+		return readReplayFile(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	var msgs []*replayMessage
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		m, err := readReplayFile(filepath.Join(path, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m...)
+	}
+	return msgs, nil
+}
+
+func readReplayFile(path string) ([]*replayMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	defer f.Close()
+
+	var msgs []*replayMessage
+	dec := json.NewDecoder(f)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read JSON value %d of %q: %w", len(msgs)+1, path, err)
+		}
+		msgs = append(msgs, &replayMessage{source: fmt.Sprintf("%s#%d", path, len(msgs)+1), body: raw})
+	}
+	if len(msgs) == 1 {
+		msgs[0].source = path
+	}
+	return msgs, nil
+}
+
+// replay handles each message like the push receiver does (see receive), and writes whether it was acked and the
+// outcome of every notification rule to w. It returns an error if any message was not acked.
+func replay(ctx context.Context, w io.Writer, notifier Notifier, msgs []*replayMessage) error {
+	params := new(receiverParams)
+	failed := 0
+	for _, m := range msgs {
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewReader(m.body))
+		if err != nil {
+			return fmt.Errorf("failed to create request for %s: %w", m.source, err)
+		}
+		pspw, err := decodePushRequest(r, m.body)
+		if err != nil {
+			fmt.Fprintf(w, "%s: not a Pub/Sub push envelope, CloudEvent or Build: %v\n", m.source, err)
+			failed++
+			continue
+		}
+
+		desc := m.source
+		if id := pspw.Message.ID; id != "" {
+			desc += fmt.Sprintf(" message %q", id)
+		}
+		if build, err := unmarshalBuild(pspw.Message.Data); err == nil {
+			desc += fmt.Sprintf(" Build %q (%s)", build.GetId(), build.GetStatus())
+		}
+
+		mctx, rec := withOutcomes(ctx)
+		result := "acked"
+		if n := receive(mctx, notifier, params, pspw); n != nil {
+			result = fmt.Sprintf("nacked with status %d: %s", n.code, n.msg)
+			failed++
+		}
+		fmt.Fprintf(w, "%s: %s\n", desc, result)
+		outcomes := rec.list()
+		for _, o := range outcomes {
+			fmt.Fprintf(w, "  %s: %s\n", o.rule, o.outcome)
+		}
+		if len(outcomes) == 0 && result == "acked" {
+			fmt.Fprintf(w, "  no notification rule matches the message\n")
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d replayed messages were not acked", failed, len(msgs))
+	}
+	return nil
+}
+
+// runReplay sets up the configs at --replay_config (or CONFIG_PATH) and replays the messages at --replay.
+func runReplay(ctx context.Context, prototypeFor prototypeFunc) error {
+	msgs, err := readReplayMessages(*replayPath)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	if *replayConfig != "" {
+		for _, p := range splitConfigPaths(*replayConfig) {
+			if !strings.Contains(p, "://") {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return fmt.Errorf("failed to resolve config path %q: %w", p, err)
+				}
+				p = "file://" + abs
+			}
+			paths = append(paths, p)
+		}
+	} else if cfgPaths, ok := GetEnv("CONFIG_PATH"); ok {
+		paths = splitConfigPaths(cfgPaths)
+	} else {
+		return errors.New("expected --replay_config or CONFIG_PATH to be non-empty when replaying messages")
+	}
+
+	var sg SecretGetter = new(setupCheckSecretGetter)
+	if !*replayStubSecrets {
+		smc, err := secretmanager.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create new SecretManager client: %w", err)
+		}
+		defer smc.Close()
+		sg = &actualSecretManager{client: smc}
+	}
+	grf := new(lazyGCSReaderFactory)
+	defer grf.close()
+
+	lc, err := loadConfigs(ctx, paths, newConfigSource(grf, sg, http.DefaultClient), sg, prototypeFor)
+	if err != nil {
+		return fmt.Errorf("failed to set up notifier: %w", err)
+	}
+	defer lc.close(ctx)
+	return replay(ctx, os.Stdout, lc.notifier, msgs)
+}
+
+// lazyGCSReaderFactory creates its GCS client on first use, so that --replay works without credentials when no
+// config or template is in GCS.
+type lazyGCSReaderFactory struct {
+	once sync.Once
+	grf  *actualGCSReaderFactory
+	err  error
+}
+
+func (l *lazyGCSReaderFactory) factory(ctx context.Context) (*actualGCSReaderFactory, error) {
+	l.once.Do(func() {
+		sc, err := storage.NewClient(ctx)
+		if err != nil {
+			l.err = fmt.Errorf("failed to create new GCS client: %w", err)
+			return
+		}
+		l.grf = &actualGCSReaderFactory{sc}
+	})
+	return l.grf, l.err
+}
+
+func (l *lazyGCSReaderFactory) NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	grf, err := l.factory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return grf.NewReader(ctx, bucket, object)
+}
+
+func (l *lazyGCSReaderFactory) Generation(ctx context.Context, bucket, object string) (int64, error) {
+	grf, err := l.factory(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return grf.Generation(ctx, bucket, object)
+}
+
+func (l *lazyGCSReaderFactory) close() {
+	if l.grf != nil {
+		l.grf.client.Close()
+	}
+}
+
+type outcomesKey struct{}
+
+// ruleOutcome is what became of the notification of one rule for a message, e.g. "delivered" or "filtered out".
+type ruleOutcome struct {
+	rule    string
+	outcome string
+}
+
+// outcomeRecorder collects the ruleOutcomes of a message.
+type outcomeRecorder struct {
+	mtx      sync.Mutex
+	outcomes []ruleOutcome
+}
+
+// withOutcomes returns a context in which the outcomes of notification rules are recorded in the returned recorder.
+func withOutcomes(ctx context.Context) (context.Context, *outcomeRecorder) {
+	rec := new(outcomeRecorder)
+	return context.WithValue(ctx, outcomesKey{}, rec), rec
+}
+
+// recordOutcome records the outcome of the rule if the context has an outcomeRecorder.
+func recordOutcome(ctx context.Context, rule, outcome string) {
+	rec, ok := ctx.Value(outcomesKey{}).(*outcomeRecorder)
+	if !ok {
+		return
+	}
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	rec.outcomes = append(rec.outcomes, ruleOutcome{rule: rule, outcome: outcome})
+}
+
+func (r *outcomeRecorder) list() []ruleOutcome {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]ruleOutcome(nil), r.outcomes...)
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/google/go-cmp/cmp"
+)
+
+// filteringNotifier delivers the Builds that its filter matches.
+type filteringNotifier struct {
+	filter EventFilter
+}
+
+func (f *filteringNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (f *filteringNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if !f.filter.Apply(ctx, build) {
+		return nil
+	}
+	return new(RetryPolicy).Do(ctx, func(context.Context) error { return nil })
+}
+
+func TestReadReplayMessages(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.json":         "{\n  \"message\": {\"messageId\": \"1\", \"data\": \"e30=\"}\n}\n",
+		"b.ndjson":       "{\"id\": \"build-1\"}\n\n{\"id\": \"build-2\"}\n",
+		".hidden.json":   `{"id": "hidden"}`,
+		"sub/c.json":     `{"id": "nested"}`,
+		"sub/.gitignore": "",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := readReplayMessages(dir)
+	if err != nil {
+		t.Fatalf("readReplayMessages failed: %v", err)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, strings.TrimPrefix(m.source, dir+"/")+" "+string(m.body))
+	}
+	want := []string{
+		"a.json {\n  \"message\": {\"messageId\": \"1\", \"data\": \"e30=\"}\n}",
+		`b.ndjson#1 {"id": "build-1"}`,
+		`b.ndjson#2 {"id": "build-2"}`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("got unexpected messages (-want +got):\n%s", diff)
+	}
+
+	if msgs, err := readReplayMessages(filepath.Join(dir, "sub", "c.json")); err != nil || len(msgs) != 1 {
+		t.Errorf("readReplayMessages of a file = %v, %v, want its message", msgs, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"id": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readReplayMessages(dir); err == nil {
+		t.Error("readReplayMessages unexpectedly succeeded for a truncated file")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	useStatus(t)
+	successes, err := MakeCELPredicate(`build.status == Build.Status.SUCCESS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, err := makeMessagePredicate(`message.attributes.env == "prod"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := &ruleSet{rules: []*rule{
+		{name: "successes[0]", Notifier: &filteringNotifier{filter: successes}},
+		{name: "prod[0]", messageFilter: prod, Notifier: succeedingNotifier{}},
+		{name: "broken[0]", Notifier: &failingNotifier{err: Permanent(errors.New("bad request"))}},
+	}}
+
+	msgs := []*replayMessage{
+		{source: "success.json", body: []byte(`{"message": {"messageId": "1", "attributes": {"env": "prod"}, "data": "eyJpZCI6ICJidWlsZC0xIiwgInN0YXR1cyI6ICJTVUNDRVNTIn0="}}`)},
+		{source: "failures.ndjson#1", body: []byte(`{"id": "build-2", "status": "FAILURE"}`)},
+		{source: "failures.ndjson#2", body: []byte(`{"foo": "bar"}`)},
+	}
+	buf := new(bytes.Buffer)
+	if err := replay(context.Background(), buf, notifier, msgs); err == nil {
+		t.Error("replay unexpectedly succeeded with a message that is not a Build")
+	}
+
+	want := `success.json message "1" Build "build-1" (SUCCESS): acked
+  successes[0]: delivered
+  prod[0]: delivered
+  broken[0]: failed: bad request
+failures.ndjson#1 Build "build-2" (FAILURE): acked
+  successes[0]: filtered out
+  prod[0]: skipped, since its messageFilter does not match
+  broken[0]: failed: bad request
+failures.ndjson#2: not a Pub/Sub push envelope, CloudEvent or Build: expected a Pub/Sub push envelope, a CloudEvent or a Build
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("got unexpected replay report (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// RetryConfig is the `retry` section of a notification rule. Unset fields take their defaults. Rules without a `retry`
+// section make a single attempt.
+type RetryConfig struct {
+	// Attempts is the total number of attempts, including the first one. Defaults to 3.
+	Attempts int `yaml:"attempts,omitempty"`
+	// InitialBackoff is the backoff before the first retry, as a Go duration. It doubles for every further retry.
+	// Defaults to 500ms.
+	InitialBackoff string `yaml:"initialBackoff,omitempty"`
+	// MaxBackoff caps the backoff, as a Go duration. A `Retry-After` longer than this stops retrying, so that the
+	// message is redelivered by Pub/Sub instead. Defaults to 5s.
+	MaxBackoff string `yaml:"maxBackoff,omitempty"`
+}
+
+// RetryPolicy retries deliveries that fail with errors that are not permanent (see IsPermanent), with jittered
+// exponential backoff. A nil *RetryPolicy makes a single attempt.
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// sleep waits for the given duration or until the context is done. It is replaced in tests.
+	sleep func(context.Context, time.Duration) error
+}
+
+// NewRetryPolicy returns the RetryPolicy for the given `retry` config. If it is nil, the policy makes a single attempt,
+// since retrying is not safe for every destination (e.g. a timed out request may still have created a GitHub issue).
+func NewRetryPolicy(cfg *RetryConfig) (*RetryPolicy, error) {
+	p := &RetryPolicy{
+		Attempts:       defaultRetryAttempts,
+		InitialBackoff: defaultRetryInitialBackoff,
+		MaxBackoff:     defaultRetryMaxBackoff,
+	}
+	if cfg == nil {
+		p.Attempts = 1
+		return p, nil
+	}
+
+	if cfg.Attempts < 0 {
+		return nil, fmt.Errorf("expected retry attempts to be positive, got %d", cfg.Attempts)
+	}
+	if cfg.Attempts > 0 {
+		p.Attempts = cfg.Attempts
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"initialBackoff", cfg.InitialBackoff, &p.InitialBackoff},
+		{"maxBackoff", cfg.MaxBackoff, &p.MaxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("expected retry %s %q to be a positive duration", d.name, d.value)
+		}
+		*d.dst = parsed
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return nil, fmt.Errorf("expected retry maxBackoff %v to be at least initialBackoff %v", p.MaxBackoff, p.InitialBackoff)
+	}
+	return p, nil
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, or the attempts are used up, and returns its last
+// error. Between attempts it waits for the backoff, or for the `Retry-After` of a RetryableError if there is one.
+// Attempts and their final outcome are counted in the delivery metrics of the notification rule in the context.
+func (p *RetryPolicy) Do(ctx context.Context, fn func(context.Context) error) (err error) {
+	d := deliveryFrom(ctx)
+	defer func() { d.finished(err) }()
+	_, err = p.do(ctx, func(ctx context.Context) error {
+		d.attempted()
+		return fn(ctx)
+	})
+	return err
+}
+
+// do is Do without the delivery metrics. It also returns the number of attempts it made.
+func (p *RetryPolicy) do(ctx context.Context, fn func(context.Context) error) (int, error) {
+	attempts := 1
+	if p != nil {
+		attempts = p.Attempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || IsPermanent(err) || attempt >= attempts {
+			return attempt, err
+		}
+
+		wait := p.backoff(attempt)
+		if after := retryAfter(err); after > 0 {
+			if after > p.MaxBackoff {
+				Warningf(ctx, "not retrying, since the destination asked to wait %v, which is longer than the maximum backoff %v: %v", after, p.MaxBackoff, err)
+				return attempt, err
+			}
+			wait = after
+		}
+
+		Warningf(ctx, "attempt %d of %d failed, retrying in %v: %v", attempt, attempts, wait, err)
+		sleep := p.sleep
+		if sleep == nil {
+			sleep = sleepContext
+		}
+		if serr := sleep(ctx, wait); serr != nil {
+			return attempt, err
+		}
+	}
+}
+
+// backoff returns the jittered backoff before the given retry: a random duration between half and all of
+// InitialBackoff * 2^(retry-1), capped at MaxBackoff.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	b := p.MaxBackoff
+	if retry < 32 {
+		if exp := p.InitialBackoff << (retry - 1); exp > 0 && exp < b {
+			b = exp
+		}
+	}
+	half := b / 2
+	return half + time.Duration(rand.Int63n(int64(b-half)+1))
+}
+
+// retryAfter returns how long the destination asked to wait before retrying the given error, or zero.
+func retryAfter(err error) time.Duration {
+	var re *RetryableError
+	if errors.As(err, &re) {
+		return re.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses the value of a `Retry-After` header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
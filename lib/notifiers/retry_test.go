@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     *RetryConfig
+		want    *RetryPolicy
+		wantErr bool
+	}{{
+		name: "no retry config",
+		want: &RetryPolicy{Attempts: 1, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+	}, {
+		name: "defaults",
+		cfg:  &RetryConfig{},
+		want: &RetryPolicy{Attempts: 3, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+	}, {
+		name: "configured",
+		cfg:  &RetryConfig{Attempts: 5, InitialBackoff: "1s", MaxBackoff: "1m"},
+		want: &RetryPolicy{Attempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute},
+	}, {
+		name: "partially configured",
+		cfg:  &RetryConfig{Attempts: 1},
+		want: &RetryPolicy{Attempts: 1, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+	}, {
+		name:    "negative attempts",
+		cfg:     &RetryConfig{Attempts: -1},
+		wantErr: true,
+	}, {
+		name:    "bad duration",
+		cfg:     &RetryConfig{InitialBackoff: "soon"},
+		wantErr: true,
+	}, {
+		name:    "max below initial",
+		cfg:     &RetryConfig{InitialBackoff: "10s", MaxBackoff: "1s"},
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewRetryPolicy(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewRetryPolicy(%+v) = %v, wantErr %v", tc.cfg, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(RetryPolicy{}), cmp.FilterPath(func(p cmp.Path) bool {
+				return p.Last().String() == ".sleep"
+			}, cmp.Ignore())); diff != "" {
+				t.Errorf("NewRetryPolicy(%+v) got unexpected diff: (-want +got)\n%s", tc.cfg, diff)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := errors.New("connection reset")
+	for _, tc := range []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+		wantWaits []time.Duration
+	}{{
+		name:      "success",
+		errs:      []error{nil},
+		wantCalls: 1,
+	}, {
+		name:      "success after retries",
+		errs:      []error{transient, Retryable(transient), nil},
+		wantCalls: 3,
+	}, {
+		name:      "permanent error",
+		errs:      []error{Permanent(transient)},
+		wantErr:   transient,
+		wantCalls: 1,
+	}, {
+		name:      "attempts used up",
+		errs:      []error{transient, transient, transient, nil},
+		wantErr:   transient,
+		wantCalls: 3,
+	}, {
+		name:      "Retry-After",
+		errs:      []error{&RetryableError{Err: transient, RetryAfter: 3 * time.Second}, nil},
+		wantCalls: 2,
+		wantWaits: []time.Duration{3 * time.Second},
+	}, {
+		name:      "Retry-After longer than the maximum backoff",
+		errs:      []error{&RetryableError{Err: transient, RetryAfter: time.Minute}, nil},
+		wantErr:   transient,
+		wantCalls: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var waits []time.Duration
+			p := &RetryPolicy{
+				Attempts:       3,
+				InitialBackoff: time.Second,
+				MaxBackoff:     10 * time.Second,
+				sleep: func(_ context.Context, d time.Duration) error {
+					waits = append(waits, d)
+					return nil
+				},
+			}
+			calls := 0
+			err := p.Do(context.Background(), func(context.Context) error {
+				calls++
+				return tc.errs[calls-1]
+			})
+			if !errors.Is(err, tc.wantErr) || (err == nil) != (tc.wantErr == nil) {
+				t.Errorf("Do() = %v, want %v", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("Do() made %d calls, want %d", calls, tc.wantCalls)
+			}
+			if tc.wantWaits != nil {
+				if diff := cmp.Diff(tc.wantWaits, waits); diff != "" {
+					t.Errorf("Do() waited unexpectedly: (-want +got)\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := &RetryPolicy{Attempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	calls := 0
+	if err := p.Do(ctx, func(context.Context) error { calls++; return errors.New("EOF") }); err == nil {
+		t.Error("Do() unexpectedly succeeded")
+	}
+	if calls != 1 {
+		t.Errorf("Do() made %d calls after the context was cancelled, want 1", calls)
+	}
+
+	var nilPolicy *RetryPolicy
+	calls = 0
+	nilPolicy.Do(context.Background(), func(context.Context) error { calls++; return errors.New("EOF") })
+	if calls != 1 {
+		t.Errorf("Do() on a nil policy made %d calls, want 1", calls)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for _, tc := range []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 2500 * time.Millisecond, 5 * time.Second},
+		{100, 2500 * time.Millisecond, 5 * time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			if got := p.backoff(tc.retry); got < tc.min || got > tc.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tc.retry, got, tc.min, tc.max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Wed, 01 Jan 2020 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 Jan 2020 11:00:00 GMT", 0},
+		{"later", 0},
+	} {
+		if got := parseRetryAfter(tc.header, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	schemaBaseURL     = "https://github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers/schemas/"
+	configSchemaURL   = schemaBaseURL + "config.schema.json"
+	deliverySchemaURL = schemaBaseURL + "delivery.schema.json"
+)
+
+var (
+	// configSchema is the JSON Schema for `cloud-build-notifiers/v2` configs.
+	// Its `delivery` field refers to the delivery schema of the config's `kind`.
+	//go:embed schemas/config.schema.json
+	configSchema []byte
+
+	// genericDeliverySchema is used for kinds that did not register a delivery schema.
+	genericDeliverySchema = []byte(`{"type": "object"}`)
+)
+
+var (
+	schemaMtx       sync.Mutex
+	deliverySchemas = map[string][]byte{}
+	compiledSchemas = map[string]*jsonschema.Schema{}
+)
+
+// RegisterDeliverySchema registers the JSON Schema that `spec.notifications[*].delivery` of
+// `cloud-build-notifiers/v2` configs of the given kind must match.
+// The schema may refer to `config.schema.json#/$defs/secretRef` for fields holding a `secretRef`.
+// It is meant to be called from the `init` function of a notifier package (next to Register) and panics if the
+// kind is empty or already has a schema, or if the schema does not compile.
+func RegisterDeliverySchema(kind string, schema []byte) {
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+
+	if kind == "" {
+		panic("notifiers: RegisterDeliverySchema called with an empty kind")
+	}
+	if _, ok := deliverySchemas[kind]; ok {
+		panic(fmt.Sprintf("notifiers: RegisterDeliverySchema called twice for kind %q", kind))
+	}
+	s, err := compileSchema(schema)
+	if err != nil {
+		panic(fmt.Sprintf("notifiers: invalid delivery schema for kind %q: %v", kind, err))
+	}
+	deliverySchemas[kind] = schema
+	compiledSchemas[kind] = s
+}
+
+// schemaFor returns the compiled config schema for the given kind.
+func schemaFor(kind string) (*jsonschema.Schema, error) {
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+
+	if s, ok := compiledSchemas[kind]; ok {
+		return s, nil
+	}
+	s, err := compileSchema(genericDeliverySchema)
+	if err != nil {
+		return nil, err
+	}
+	compiledSchemas[kind] = s
+	return s, nil
+}
+
+func compileSchema(delivery []byte) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	// Never fetch schemas over the network.
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("refusing to load schema %q", url)
+	}
+	if err := c.AddResource(configSchemaURL, bytes.NewReader(configSchema)); err != nil {
+		return nil, fmt.Errorf("failed to add config schema: %w", err)
+	}
+	if err := c.AddResource(deliverySchemaURL, bytes.NewReader(delivery)); err != nil {
+		return nil, fmt.Errorf("failed to add delivery schema: %w", err)
+	}
+	s, err := c.Compile(configSchemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile config schema: %w", err)
+	}
+	return s, nil
+}
+
+// validateSchema validates the given config against the JSON Schema of its kind.
+// Each violation is reported with the YAML path of the offending field, e.g.
+// `config.spec.notifications[0].delivery: missing properties: 'server'`.
+func validateSchema(cfg *Config) error {
+	s, err := schemaFor(cfg.Kind)
+	if err != nil {
+		return err
+	}
+
+	doc, err := schemaDocument(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = s.Validate(doc)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+
+	var msgs []string
+	seen := map[string]bool{}
+	for _, leaf := range schemaViolations(verr) {
+		msg := fmt.Sprintf("%s: %s", yamlPath(leaf.InstanceLocation), leaf.Message)
+		if !seen[msg] {
+			seen[msg] = true
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("config does not match the %s schema for kind %q:\n%s", cfg.APIVersion, cfg.Kind, strings.Join(msgs, "\n"))
+}
+
+// schemaViolations returns the most specific causes of the given error.
+func schemaViolations(verr *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(verr.Causes) == 0 {
+		return []*jsonschema.ValidationError{verr}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, c := range verr.Causes {
+		leaves = append(leaves, schemaViolations(c)...)
+	}
+	return leaves
+}
+
+// yamlPath converts a JSON pointer (e.g. `/spec/notifications/0/delivery`) into a YAML path
+// (e.g. `config.spec.notifications[0].delivery`).
+func yamlPath(pointer string) string {
+	var b strings.Builder
+	b.WriteString("config")
+	if pointer == "" {
+		return b.String()
+	}
+	for _, tok := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		tok = strings.NewReplacer("~1", "/", "~0", "~").Replace(tok)
+		if _, err := strconv.Atoi(tok); err == nil {
+			fmt.Fprintf(&b, "[%s]", tok)
+		} else {
+			fmt.Fprintf(&b, ".%s", tok)
+		}
+	}
+	return b.String()
+}
+
+// schemaDocument converts the given config into the generic (JSON) form that schemas are validated against.
+// Fields that are null (i.e. unset) are dropped.
+func schemaDocument(cfg *Config) (interface{}, error) {
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var generic interface{}
+	if err := yaml.Unmarshal(out, &generic); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	js, err := json.Marshal(jsonValue(generic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert config to JSON: %w", err)
+	}
+	dcd := json.NewDecoder(bytes.NewReader(js))
+	dcd.UseNumber()
+	var doc interface{}
+	if err := dcd.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON config: %w", err)
+	}
+	return doc, nil
+}
+
+// jsonValue converts YAML maps (keyed by interface{}) into JSON objects and drops null fields.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if e == nil {
+				continue
+			}
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = jsonValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const schemaTestKind = "SchemaTestNotifier"
+
+func init() {
+	RegisterDeliverySchema(schemaTestKind, []byte(`{
+  "type": "object",
+  "required": ["server", "recipients", "password"],
+  "additionalProperties": false,
+  "properties": {
+    "server": {"type": "string"},
+    "recipients": {"type": "array", "items": {"type": "string"}},
+    "password": {"$ref": "config.schema.json#/$defs/secretRef"}
+  }
+}`))
+}
+
+func TestValidateConfigV2(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		yaml    string
+		wantErr []string
+	}{{
+		name: "valid",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: SchemaTestNotifier
+metadata:
+  name: test
+spec:
+  notifications:
+  - filter: build.status == Build.Status.SUCCESS
+    messageFilter: message.attributes.status == "SUCCESS"
+    delivery:
+      server: smtp.example.com
+      recipients: [a@example.com]
+      password:
+        secretRef: pw
+    template:
+      type: golang
+      uri: gs://bucket/template.html
+      partials:
+      - name: footer
+        uri: gs://bucket/footer.html
+      - name: failure
+        content: '{{ .Build.Id }} failed'
+    retry:
+      attempts: 4
+      initialBackoff: 250ms
+      maxBackoff: 1m30s
+    rateLimit:
+      rate: 10
+      interval: 5m
+      perTrigger: true
+      policy: coalesce
+  secrets:
+  - name: pw
+    value: projects/p/secrets/pw/versions/1
+`,
+	}, {
+		name: "unregistered kind gets a generic delivery",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: UnknownNotifier
+spec:
+  notifications:
+  - delivery:
+      anything: goes
+`,
+	}, {
+		name: "misspelled and missing delivery fields",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: SchemaTestNotifier
+spec:
+  notifications:
+  - filter: "true"
+  - delivery:
+      server: smtp.example.com
+      recipent: [a@example.com]
+      password:
+        secretRef: pw
+`,
+		wantErr: []string{
+			"config.spec.notifications[1].delivery: additionalProperties 'recipent' not allowed",
+			"config.spec.notifications[1].delivery: missing properties: 'recipients'",
+		},
+	}, {
+		name: "invalid retry",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: UnknownNotifier
+spec:
+  notifications:
+  - retry:
+      attempts: -1
+      maxBackoff: soon
+`,
+		wantErr: []string{
+			"config.spec.notifications[0].retry.attempts: must be >= 1 but found -1",
+			"config.spec.notifications[0].retry.maxBackoff: does not match pattern",
+		},
+	}, {
+		name: "invalid rateLimit",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: UnknownNotifier
+spec:
+  notifications:
+  - rateLimit:
+      policy: queue
+`,
+		wantErr: []string{
+			"config.spec.notifications[0].rateLimit.rate: must be >= 1 but found 0",
+			"config.spec.notifications[0].rateLimit.policy: value must be one of",
+		},
+	}, {
+		name: "bad secretRef",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: SchemaTestNotifier
+spec:
+  notifications:
+  - delivery:
+      server: smtp.example.com
+      recipients: [a@example.com]
+      password: hunter2
+`,
+		wantErr: []string{
+			"config.spec.notifications[0].delivery.password: expected object, but got string",
+		},
+	}, {
+		name: "v1 spec.notification is not allowed",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: SchemaTestNotifier
+spec:
+  notification:
+    filter: "true"
+`,
+		wantErr: []string{
+			"config.spec: additionalProperties 'notification' not allowed",
+			"config.spec: missing properties: 'notifications'",
+		},
+	}, {
+		name: "partial with both uri and content",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: UnknownNotifier
+spec:
+  notifications:
+  - template:
+      type: golang
+      content: hello
+      partials:
+      - name: footer
+        uri: gs://bucket/footer.html
+        content: bye
+`,
+		wantErr: []string{
+			"config.spec.notifications[0].template.partials[0]: valid against schemas at indexes 0 and 1",
+		},
+	}, {
+		name: "bad template type",
+		yaml: `
+apiVersion: cloud-build-notifiers/v2
+kind: UnknownNotifier
+spec:
+  notifications:
+  - template:
+      type: jinja
+      content: hello
+`,
+		wantErr: []string{
+			"config.spec.notifications[0].template.type: value must be \"golang\"",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := decodeConfig(strings.NewReader(tc.yaml))
+			if err != nil {
+				t.Fatalf("decodeConfig failed: %v", err)
+			}
+
+			err = validateConfig(context.Background(), cfg)
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("validateConfig got unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateConfig unexpectedly succeeded")
+			}
+			for _, want := range tc.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateConfig error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertConfig(t *testing.T) {
+	n := &Notification{Filter: "true", Delivery: map[string]interface{}{"server": "smtp.example.com"}}
+	secrets := []*Secret{{LocalName: "pw", ResourceName: "projects/p/secrets/pw/versions/1"}}
+	v1 := &Config{
+		APIVersion: apiVersionV1,
+		Kind:       schemaTestKind,
+		Metadata:   &Metadata{Name: "test"},
+		Spec:       &Spec{Notification: n, Secrets: secrets},
+	}
+
+	got := convertConfig(v1)
+	want := &Config{
+		APIVersion: apiVersionV2,
+		Kind:       schemaTestKind,
+		Metadata:   &Metadata{Name: "test"},
+		Spec:       &Spec{Notifications: []*Notification{n}, Secrets: secrets},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("convertConfig got unexpected diff: (-want +got)\n%s", diff)
+	}
+	if v1.APIVersion != apiVersionV1 || v1.Spec.Notification != n {
+		t.Errorf("convertConfig modified its input: %+v", v1)
+	}
+
+	if got := convertConfig(want); got != want {
+		t.Errorf("convertConfig(v2 config) = %+v, want it returned as-is", got)
+	}
+}
+
+func TestYAMLPath(t *testing.T) {
+	for _, tc := range []struct {
+		pointer string
+		want    string
+	}{
+		{"", "config"},
+		{"/spec", "config.spec"},
+		{"/spec/notifications/0/delivery", "config.spec.notifications[0].delivery"},
+		{"/spec/notifications/2/params/a~1b", "config.spec.notifications[2].params.a/b"},
+	} {
+		if got := yamlPath(tc.pointer); got != tc.want {
+			t.Errorf("yamlPath(%q) = %q, want %q", tc.pointer, got, tc.want)
+		}
+	}
+}
+
+func TestRegisterDeliverySchemaPanics(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		kind   string
+		schema string
+	}{
+		{"empty kind", "", `{}`},
+		{"duplicate kind", schemaTestKind, `{}`},
+		{"invalid schema", "InvalidSchemaNotifier", `{"type": 42}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterDeliverySchema(%q) did not panic", tc.kind)
+				}
+			}()
+			RegisterDeliverySchema(tc.kind, []byte(tc.schema))
+		})
+	}
+}
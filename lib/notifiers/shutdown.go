@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultShutdownTimeout is how long in-flight notifications get to finish after SIGTERM, unless SHUTDOWN_TIMEOUT is
+// set. Cloud Run sends SIGKILL 10 seconds after SIGTERM.
+const defaultShutdownTimeout = 8 * time.Second
+
+// Closer is an optional interface for Notifiers that hold resources, such as clients or buffered rows, that should be
+// flushed or released when the notifier shuts down, or when a config reload replaces them. Close is only called once
+// no SendNotification calls are in flight.
+type Closer interface {
+	Close(context.Context) error
+}
+
+// closeNotifier calls Close on the Notifier, or on the Notifiers of all of its rules, that implement Closer, after
+// sending the pending follow-ups of their rate limits.
+func closeNotifier(ctx context.Context, n Notifier) error {
+	switch n := n.(type) {
+	case *ruleSet:
+		var errs []error
+		for _, rl := range n.rules {
+			if err := closeNotifier(ctx, rl); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	case *rule:
+		// Follow-ups of coalesced notifications are sent before the Notifier is closed, rather than lost.
+		if n.limiter != nil {
+			n.limiter.flush(ctx)
+		}
+		if err := closeNotifier(ctx, n.Notifier); err != nil {
+			return fmt.Errorf("notification rule %s: %w", n.name, err)
+		}
+		return nil
+	case Closer:
+		return n.Close(ctx)
+	}
+	return nil
+}
+
+// shutdownTimeout returns the value of SHUTDOWN_TIMEOUT, or defaultShutdownTimeout if it is not set.
+func shutdownTimeout() (time.Duration, error) {
+	st, ok := GetEnv("SHUTDOWN_TIMEOUT")
+	if !ok {
+		return defaultShutdownTimeout, nil
+	}
+	d, err := time.ParseDuration(st)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("expected SHUTDOWN_TIMEOUT %q to be a positive duration", st)
+	}
+	return d, nil
+}
+
+// startServing starts serving HTTP requests on the listener and returns a channel that receives the error that the
+// server stops with.
+func startServing(srv *http.Server, ln net.Listener) <-chan error {
+	httpErr := make(chan error, 1)
+	go func() {
+		httpErr <- srv.Serve(ln)
+	}()
+	return httpErr
+}
+
+// serve blocks until the HTTP server (see startServing) fails, until pulling messages stops (in pull mode, where
+// pullErr is non-nil), or until the context is done, e.g. on SIGTERM. In the latter case, the server stops accepting
+// requests, in-flight notifications get up to the timeout to finish, and then the notifier is closed (see Closer).
+// The pull subscriber is expected to stop pulling when the context is done, and to send on pullErr once the messages
+// that it is handling are finished.
+func serve(ctx context.Context, srv *http.Server, httpErr <-chan error, pullErr <-chan error, notifier Notifier, timeout time.Duration) error {
+	pulling := pullErr != nil
+	select {
+	case err := <-httpErr:
+		return err
+	case err := <-pullErr:
+		if ctx.Err() == nil {
+			if err == nil {
+				return errors.New("stopped pulling messages")
+			}
+			return fmt.Errorf("failed to pull messages: %w", err)
+		}
+		pulling = false
+	case <-ctx.Done():
+	}
+
+	Infof(ctx, "shutting down, waiting up to %v for in-flight notifications", timeout)
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(sctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain HTTP requests: %w", err))
+		srv.Close()
+	}
+	if pulling {
+		select {
+		case err := <-pullErr:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to pull messages: %w", err))
+			}
+		case <-sctx.Done():
+			errs = append(errs, fmt.Errorf("failed to drain pulled messages: %w", sctx.Err()))
+		}
+	}
+
+	// Closing waits for any notifications that are still in flight, so give up on it at the deadline too.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- closeNotifier(sctx, notifier)
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to close notifier: %w", err))
+		}
+	case <-sctx.Done():
+		errs = append(errs, fmt.Errorf("failed to close notifier: %w", sctx.Err()))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	Infof(ctx, "shut down cleanly")
+	return nil
+}
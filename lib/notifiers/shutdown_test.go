@@ -0,0 +1,243 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// blockingNotifier blocks every SendNotification call until release is closed, and records when it is closed.
+type blockingNotifier struct {
+	started chan struct{}
+	release chan struct{}
+
+	mtx    sync.Mutex
+	sent   int
+	closed bool
+	// sentBeforeClose is the number of Builds that were sent when Close was called.
+	sentBeforeClose int
+}
+
+func newBlockingNotifier() *blockingNotifier {
+	return &blockingNotifier{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (b *blockingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (b *blockingNotifier) SendNotification(_ context.Context, _ *cbpb.Build) error {
+	b.started <- struct{}{}
+	<-b.release
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sent++
+	return nil
+}
+
+func (b *blockingNotifier) Close(_ context.Context) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.closed = true
+	b.sentBeforeClose = b.sent
+	return nil
+}
+
+func (b *blockingNotifier) state() (sent int, closed bool, sentBeforeClose int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.sent, b.closed, b.sentBeforeClose
+}
+
+func pushBody(t *testing.T) []byte {
+	t.Helper()
+	data, err := protojson.Marshal(&cbpb.Build{Id: "some-build-id", Status: cbpb.Build_SUCCESS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{ID: "some-message-id", Data: data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestServeDrainsInFlightNotifications(t *testing.T) {
+	n := newBlockingNotifier()
+	notifier, err := newReloadingNotifier(context.Background(), func(context.Context) (*loadedConfig, error) {
+		return &loadedConfig{notifier: &rule{name: "test[0]", Notifier: n}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", newReceiver(notifier, &receiverParams{}))
+
+	srv := &http.Server{Handler: mux}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, startServing(srv, ln), nil, notifier, 10*time.Second)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+ln.Addr().String()+"/", "application/json", bytes.NewReader(pushBody(t)))
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-n.started
+	// SIGTERM while the notification is in flight.
+	stop()
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the in-flight notification finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, closed, _ := n.state(); closed {
+		t.Error("notifier was closed while a notification was in flight")
+	}
+
+	close(n.release)
+	if err := <-served; err != nil {
+		t.Errorf("serve failed: %v", err)
+	}
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("in-flight request got status %d, want %d", got, http.StatusOK)
+	}
+	if sent, closed, sentBeforeClose := n.state(); !closed || sent != 1 || sentBeforeClose != 1 {
+		t.Errorf("got %d Builds sent, closed %v after %d, want the notifier closed after 1 Build", sent, closed, sentBeforeClose)
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("server still accepts connections after shutting down")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	n := newBlockingNotifier()
+	defer close(n.release)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", newReceiver(n, &receiverParams{}))
+
+	srv := &http.Server{Handler: mux}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, startServing(srv, ln), nil, n, 50*time.Millisecond)
+	}()
+	go http.Post("http://"+ln.Addr().String()+"/", "application/json", bytes.NewReader(pushBody(t)))
+
+	<-n.started
+	stop()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("serve unexpectedly succeeded with a notification stuck in flight")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not give up at the shutdown timeout")
+	}
+}
+
+func TestServePullStopped(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pullErr := make(chan error, 1)
+	pullErr <- nil
+	srv := &http.Server{Handler: http.NewServeMux()}
+	if err := serve(context.Background(), srv, startServing(srv, ln), pullErr, new(ruleNotifier), time.Second); err == nil {
+		t.Error("serve unexpectedly succeeded after pulling stopped")
+	}
+}
+
+func TestReloadClosesReplacedNotifiers(t *testing.T) {
+	var loaded []*blockingNotifier
+	notifier, err := newReloadingNotifier(context.Background(), func(context.Context) (*loadedConfig, error) {
+		n := newBlockingNotifier()
+		loaded = append(loaded, n)
+		return &loadedConfig{notifier: &ruleSet{rules: []*rule{{name: "test[0]", Notifier: n}}}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- notifier.SendNotification(context.Background(), &cbpb.Build{Id: "some-build-id"})
+	}()
+	<-loaded[0].started
+
+	if err := notifier.reload(context.Background()); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, closed, _ := loaded[0].state(); closed {
+		t.Error("replaced notifier was closed while a notification was in flight")
+	}
+
+	close(loaded[0].release)
+	if err := <-sent; err != nil {
+		t.Errorf("in-flight SendNotification failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if _, closed, sentBeforeClose := loaded[0].state(); closed {
+			if sentBeforeClose != 1 {
+				t.Errorf("replaced notifier was closed after %d Builds, want 1", sentBeforeClose)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replaced notifier was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(loaded[1].release)
+	if err := notifier.Close(context.Background()); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, closed, _ := loaded[1].state(); !closed {
+		t.Error("Close did not close the current notifier")
+	}
+	if err := notifier.SendNotification(context.Background(), &cbpb.Build{Id: "some-build-id"}); err == nil {
+		t.Error("SendNotification after Close unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigSource fetches config and template objects (e.g. the value of CONFIG_PATH or a `template.uri`).
+type ConfigSource interface {
+	// Open returns a reader for the object at the given URI.
+	Open(ctx context.Context, uri string) (io.ReadCloser, error)
+	// Version returns an opaque version of the object at the given URI, which changes whenever the object does.
+	Version(ctx context.Context, uri string) (string, error)
+}
+
+// schemeSource is a ConfigSource that delegates to other ConfigSources based on the URI scheme.
+type schemeSource map[string]ConfigSource
+
+// newConfigSource returns a ConfigSource that supports `gs://`, `file://`, `https://` and `sm://` URIs.
+func newConfigSource(grf gcsReaderFactory, sg SecretGetter, hc *http.Client) ConfigSource {
+	return schemeSource{
+		"gs":    &gcsSource{grf},
+		"file":  fileSource{},
+		"https": &httpsSource{hc},
+		"sm":    &secretSource{sg},
+	}
+}
+
+func (s schemeSource) sourceFor(uri string) (ConfigSource, error) {
+	scheme, _, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("expected %q to be a URI of the form `<scheme>://...`", uri)
+	}
+	src, ok := s[scheme]
+	if !ok {
+		schemes := make([]string, 0, len(s))
+		for k := range s {
+			schemes = append(schemes, k)
+		}
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("unsupported scheme %q in URI %q (supported schemes: %v)", scheme, uri, schemes)
+	}
+	return src, nil
+}
+
+func (s schemeSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	src, err := s.sourceFor(uri)
+	if err != nil {
+		return nil, err
+	}
+	return src.Open(ctx, uri)
+}
+
+func (s schemeSource) Version(ctx context.Context, uri string) (string, error) {
+	src, err := s.sourceFor(uri)
+	if err != nil {
+		return "", err
+	}
+	return src.Version(ctx, uri)
+}
+
+// gcsSource reads `gs://bucket/path/to/object` URIs from GCS. Its version is the object's generation.
+type gcsSource struct {
+	grf gcsReaderFactory
+}
+
+func (g *gcsSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	bucket, object, err := splitGCSPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.grf.NewReader(ctx, bucket, object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
+	}
+	return r, nil
+}
+
+func (g *gcsSource) Version(ctx context.Context, uri string) (string, error) {
+	bucket, object, err := splitGCSPath(uri)
+	if err != nil {
+		return "", err
+	}
+	gen, err := g.grf.Generation(ctx, bucket, object)
+	if err != nil {
+		return "", fmt.Errorf("failed to get generation of (bucket=%q, object=%q): %w", bucket, object, err)
+	}
+	return strconv.FormatInt(gen, 10), nil
+}
+
+// fileSource reads `file:///path/to/object` URIs from the local filesystem (e.g. a mounted ConfigMap).
+// Its version is the file's modification time and size.
+type fileSource struct{}
+
+func filePath(uri string) (string, error) {
+	path := strings.TrimPrefix(uri, "file://")
+	if path == "" {
+		return "", fmt.Errorf("expected %q to be of the form `file:///path/to/object`", uri)
+	}
+	return path, nil
+}
+
+func (fileSource) Open(_ context.Context, uri string) (io.ReadCloser, error) {
+	path, err := filePath(uri)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (fileSource) Version(_ context.Context, uri string) (string, error) {
+	path, err := filePath(uri)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+// httpsSource reads `https://` URIs with GET requests.
+// Its version is the object's ETag or Last-Modified header, falling back to a hash of its content.
+type httpsSource struct {
+	client *http.Client
+}
+
+func (h *httpsSource) do(ctx context.Context, method, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new HTTP request: %w", err)
+	}
+	req.Header.Set("User-Agent", "GCB-Notifier/0.1 (config)")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, uri)
+	}
+	return resp, nil
+}
+
+func (h *httpsSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	resp, err := h.do(ctx, http.MethodGet, uri)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (h *httpsSource) Version(ctx context.Context, uri string) (string, error) {
+	resp, err := h.do(ctx, http.MethodHead, uri)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		return lm, nil
+	}
+
+	r, err := h.Open(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashOf(r)
+}
+
+// secretSource reads `sm://projects/<project>/secrets/<secret>[/versions/<version>]` URIs from Secret Manager.
+// If no version is given, the latest version is used. Its version is a hash of the secret's payload.
+type secretSource struct {
+	sg SecretGetter
+}
+
+func secretName(uri string) (string, error) {
+	name := strings.TrimPrefix(uri, "sm://")
+	parts := strings.Split(name, "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets":
+		return name + "/versions/latest", nil
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "secrets" && parts[4] == "versions":
+		return name, nil
+	default:
+		return "", fmt.Errorf("expected %q to be of the form `sm://projects/<project>/secrets/<secret>[/versions/<version>]`", uri)
+	}
+}
+
+func (s *secretSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	name, err := secretName(uri)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := s.sg.GetSecret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(payload)), nil
+}
+
+func (s *secretSource) Version(ctx context.Context, uri string) (string, error) {
+	r, err := s.Open(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashOf(r)
+}
+
+func hashOf(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("failed to hash content: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
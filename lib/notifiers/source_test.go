@@ -0,0 +1,217 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type mapSecretGetter map[string]string
+
+func (m mapSecretGetter) GetSecret(_ context.Context, name string) (string, error) {
+	s, ok := m[name]
+	if !ok {
+		return "", fmt.Errorf("no secret named %q", name)
+	}
+	return s, nil
+}
+
+func readSource(t *testing.T, src ConfigSource, uri string) string {
+	t.Helper()
+	r, err := src.Open(context.Background(), uri)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", uri, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", uri, err)
+	}
+	return string(b)
+}
+
+func TestConfigSource(t *testing.T) {
+	ctx := context.Background()
+	validYAML := strings.ReplaceAll(validConfigYAMLWithTabs, "\t", "    " /* 4 spaces */)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(validYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, validYAML)
+	}))
+	defer ts.Close()
+
+	src := newConfigSource(
+		&fakeGCSReaderFactory{data: map[string]string{"gs://bucket/config.yaml": validYAML}},
+		mapSecretGetter{"projects/p/secrets/config/versions/latest": validYAML},
+		ts.Client(),
+	)
+
+	for _, uri := range []string{
+		"gs://bucket/config.yaml",
+		"file://" + path,
+		ts.URL + "/config.yaml",
+		"sm://projects/p/secrets/config",
+		"sm://projects/p/secrets/config/versions/latest",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			cfg, err := getConfig(ctx, src, uri)
+			if err != nil {
+				t.Fatalf("getConfig(%q) failed: %v", uri, err)
+			}
+			if diff := cmp.Diff(validConfig, cfg); diff != "" {
+				t.Errorf("getConfig(%q) produced unexpected Config diff: (want- got+)\n%s", uri, diff)
+			}
+
+			if _, err := src.Version(ctx, uri); err != nil {
+				t.Errorf("Version(%q) failed: %v", uri, err)
+			}
+		})
+	}
+}
+
+func TestConfigSourceErrors(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	src := newConfigSource(&fakeGCSReaderFactory{}, mapSecretGetter{}, ts.Client())
+	for _, uri := range []string{
+		"/no/scheme.yaml",
+		"ftp://example.com/config.yaml",
+		"gs://bucket/missing.yaml",
+		"file://" + filepath.Join(t.TempDir(), "missing.yaml"),
+		"file://",
+		ts.URL + "/missing.yaml",
+		"sm://projects/p/secrets/missing",
+		"sm://not/a/secret",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			if r, err := src.Open(context.Background(), uri); err == nil {
+				r.Close()
+				t.Errorf("Open(%q) unexpectedly succeeded", uri)
+			}
+		})
+	}
+}
+
+func TestFileSourceVersion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := os.WriteFile(path, []byte("{{.Build.Id}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + path
+
+	before, err := fileSource{}.Version(ctx, uri)
+	if err != nil {
+		t.Fatalf("Version failed: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("{{.Build.Id}} {{.Build.Status}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := fileSource{}.Version(ctx, uri)
+	if err != nil {
+		t.Fatalf("Version failed: %v", err)
+	}
+
+	if before == after {
+		t.Errorf("Version did not change after the file changed: %q", after)
+	}
+	if got := readSource(t, fileSource{}, uri); got != "{{.Build.Id}} {{.Build.Status}}" {
+		t.Errorf("Open returned %q after the file changed", got)
+	}
+}
+
+func TestHTTPSSourceVersion(t *testing.T) {
+	ctx := context.Background()
+	var etag, lastModified, body string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if lastModified != "" {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	src := &httpsSource{ts.Client()}
+
+	for _, tc := range []struct {
+		name                     string
+		etag, lastModified, body string
+		want                     string
+	}{{
+		name: "etag",
+		etag: `"abc"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+		want: `"abc"`,
+	}, {
+		name:         "last modified",
+		lastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+		want:         "Mon, 02 Jan 2006 15:04:05 GMT",
+	}, {
+		name: "content hash",
+		body: "hello",
+		want: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			etag, lastModified, body = tc.etag, tc.lastModified, tc.body
+			got, err := src.Version(ctx, ts.URL)
+			if err != nil {
+				t.Fatalf("Version failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Version = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTemplateFromFile(t *testing.T) {
+	const tmpl = `{{.Build.Status}}`
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := os.WriteFile(path, []byte(tmpl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newConfigSource(&fakeGCSReaderFactory{}, mapSecretGetter{}, http.DefaultClient)
+	got, err := parseTemplate(context.Background(), &Template{Type: "golang", URI: "file://" + path}, src)
+	if err != nil {
+		t.Fatalf("parseTemplate failed: %v", err)
+	}
+	if got != tmpl {
+		t.Errorf("parseTemplate = %q, want %q", got, tmpl)
+	}
+}
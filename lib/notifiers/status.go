@@ -0,0 +1,240 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+)
+
+// urlPattern matches the URLs in error messages, e.g. of webhooks, which are secret.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// serverStatus is what Main's /readyz and /statusz endpoints report. Like the metrics, it is shared by everything in
+// the process.
+var serverStatus = newStatus()
+
+// status tracks the readiness of the notifier and the outcome of its most recent notifications.
+type status struct {
+	mtx       sync.Mutex
+	name      string
+	startTime time.Time
+	sources   []string
+
+	// loads is the number of times that configs were (re)loaded successfully, i.e. their generation. Until the first
+	// load, the notifier is not ready.
+	loads     int
+	loadedAt  time.Time
+	versions  map[string]string
+	names     []string
+	reloadErr *statusEvent
+
+	lastSuccess *statusEvent
+	lastErr     *statusEvent
+	// builds counts the Builds received, by status.
+	builds map[string]int64
+}
+
+// statusEvent is a notification, config load or failure on /statusz.
+type statusEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind,omitempty"`
+	BuildID string    `json:"buildId,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// statusPage is the JSON that /statusz serves.
+type statusPage struct {
+	Name        string           `json:"name"`
+	StartTime   time.Time        `json:"startTime"`
+	Ready       bool             `json:"ready"`
+	Config      configStatus     `json:"config"`
+	LastSuccess *statusEvent     `json:"lastSuccess,omitempty"`
+	LastError   *statusEvent     `json:"lastError,omitempty"`
+	Builds      map[string]int64 `json:"builds"`
+}
+
+type configStatus struct {
+	// Sources are the paths in CONFIG_PATH.
+	Sources []string `json:"sources"`
+	// Generation is the number of times that the configs were loaded successfully.
+	Generation int       `json:"generation"`
+	LoadedAt   time.Time `json:"loadedAt"`
+	// Versions are the versions (e.g. GCS generations) of the loaded config and template objects, by URI.
+	Versions      map[string]string `json:"versions"`
+	MetadataNames []string          `json:"metadataNames"`
+	ReloadError   *statusEvent      `json:"reloadError,omitempty"`
+}
+
+func newStatus() *status {
+	return &status{startTime: time.Now(), builds: map[string]int64{}}
+}
+
+// configure records the name of the notifier and the paths that its configs are loaded from.
+func (s *status) configure(name string, sources []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.name = name
+	s.sources = sources
+}
+
+// loaded records the configs that were loaded, which makes the notifier ready.
+func (s *status) loaded(lc *loadedConfig) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.loads++
+	s.loadedAt = time.Now()
+	s.versions = lc.versions
+	s.names = lc.names
+	s.reloadErr = nil
+}
+
+// reloadFailed records a failed reload, which makes the notifier unready until configs are loaded again.
+func (s *status) reloadFailed(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadErr = &statusEvent{Time: time.Now(), Error: redactError(err)}
+}
+
+// received counts a Build by its status.
+func (s *status) received(build *cbpb.Build) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.builds[build.GetStatus().String()]++
+}
+
+// delivered records a notification that was delivered by a Notifier of the given kind.
+func (s *status) delivered(kind string, build *cbpb.Build) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastSuccess = &statusEvent{Time: time.Now(), Kind: kind, BuildID: build.GetId()}
+}
+
+// failed records a failure to handle a Build, whose kind and Build are empty if it failed before reaching a Notifier.
+func (s *status) failed(kind string, build *cbpb.Build, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastErr = &statusEvent{Time: time.Now(), Kind: kind, BuildID: build.GetId(), Error: redactError(err)}
+}
+
+// redactError returns the message of the error for /statusz, which is served without authentication. The
+// `Post "<url>": ` prefixes of *url.Errors are dropped, and any other URLs are reduced to their scheme and host, since
+// the URLs of webhooks are secrets.
+func redactError(err error) string {
+	msg := err.Error()
+	for _, ue := range urlErrors(err) {
+		msg = strings.ReplaceAll(msg, ue.Error(), ue.Err.Error())
+	}
+	return urlPattern.ReplaceAllStringFunc(msg, func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return "[REDACTED URL]"
+		}
+		return u.Scheme + "://" + u.Hostname() + "/[REDACTED]"
+	})
+}
+
+// urlErrors returns the *url.Errors in the tree of the error, outermost first.
+func urlErrors(err error) []*url.Error {
+	if err == nil {
+		return nil
+	}
+	var ues []*url.Error
+	if ue, ok := err.(*url.Error); ok {
+		ues = append(ues, ue)
+	}
+	switch u := err.(type) {
+	case interface{ Unwrap() error }:
+		ues = append(ues, urlErrors(u.Unwrap())...)
+	case interface{ Unwrap() []error }:
+		for _, e := range u.Unwrap() {
+			ues = append(ues, urlErrors(e)...)
+		}
+	}
+	return ues
+}
+
+// ready returns nil if the configs are set up and the last reload, if any, succeeded.
+func (s *status) ready() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.loads == 0 {
+		return errors.New("configs are not set up yet")
+	}
+	if s.reloadErr != nil {
+		return fmt.Errorf("reloading configs failed at %s: %s", s.reloadErr.Time.Format(time.RFC3339), s.reloadErr.Error)
+	}
+	return nil
+}
+
+// page returns a snapshot of the status.
+func (s *status) page() *statusPage {
+	ready := s.ready() == nil
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	builds := make(map[string]int64, len(s.builds))
+	for k, v := range s.builds {
+		builds[k] = v
+	}
+	return &statusPage{
+		Name:      s.name,
+		StartTime: s.startTime,
+		Ready:     ready,
+		Config: configStatus{
+			Sources:       s.sources,
+			Generation:    s.loads,
+			LoadedAt:      s.loadedAt,
+			Versions:      s.versions,
+			MetadataNames: s.names,
+			ReloadError:   s.reloadErr,
+		},
+		LastSuccess: s.lastSuccess,
+		LastError:   s.lastErr,
+		Builds:      builds,
+	}
+}
+
+// newReadyzHandler returns a handler that responds with a 200 if the notifier is ready, and with a 503 otherwise, e.g.
+// for Cloud Run startup probes.
+func newReadyzHandler(s *status) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := s.ready(); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// newStatuszHandler returns a handler that serves the status as JSON.
+func newStatuszHandler(s *status) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.page()); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode status: %v", err), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database, since notifier images may not have one.
+	_ "time/tzdata"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var statusEmojis = map[cbpb.Build_Status]string{
+	cbpb.Build_STATUS_UNKNOWN: "❔",
+	cbpb.Build_PENDING:        "⏳",
+	cbpb.Build_QUEUED:         "⏳",
+	cbpb.Build_WORKING:        "🔄",
+	cbpb.Build_SUCCESS:        "✅",
+	cbpb.Build_FAILURE:        "❌",
+	cbpb.Build_INTERNAL_ERROR: "💥",
+	cbpb.Build_TIMEOUT:        "⏱️",
+	cbpb.Build_CANCELLED:      "🚫",
+	cbpb.Build_EXPIRED:        "⌛",
+}
+
+// TemplateFuncs returns the functions that are available to every notifier template.
+// The returned map can be passed to both `text/template` and `html/template`:
+//
+//   - `replace s old new` replaces all occurrences of old in s with new.
+//   - `truncate n s` shortens s to at most n characters, ending with "…" if it was shortened.
+//   - `status v` returns the name of a Build status (e.g. "SUCCESS"), given a status or its name or number.
+//   - `statusEmoji v` returns an emoji for a Build status (e.g. "✅" for SUCCESS).
+//   - `duration start end` returns the time between two timestamps (e.g. `.Build.StartTime .Build.FinishTime`),
+//     rounded to seconds, e.g. "1m23s".
+//   - `formatDuration d` formats a Duration (e.g. `.Build.Timeout`) rounded to seconds.
+//   - `formatTime layout zone t` formats a timestamp with a Go time layout (or a name like "RFC3339") in the
+//     given IANA time zone (e.g. "America/New_York"; "" is UTC).
+//   - `jsonEscape s` escapes s for use inside a JSON string literal (without the surrounding quotes).
+//   - `toJson v` encodes v (including protos such as `.Build`) as JSON.
+//   - `default def v` returns v, or def if v is empty (e.g. "", 0, nil or an empty map).
+func TemplateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"replace":        strings.ReplaceAll,
+		"truncate":       truncate,
+		"status":         statusName,
+		"statusEmoji":    statusEmoji,
+		"duration":       duration,
+		"formatDuration": formatDuration,
+		"formatTime":     formatTime,
+		"jsonEscape":     jsonEscape,
+		"toJson":         toJSON,
+		"default":        defaultValue,
+	}
+}
+
+func truncate(n int, s string) string {
+	r := []rune(s)
+	if n < 0 || len(r) <= n {
+		return s
+	}
+	if n == 0 {
+		return ""
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func toStatus(v interface{}) (cbpb.Build_Status, error) {
+	switch v := v.(type) {
+	case cbpb.Build_Status:
+		return v, nil
+	case string:
+		if s, ok := cbpb.Build_Status_value[strings.ToUpper(v)]; ok {
+			return cbpb.Build_Status(s), nil
+		}
+		if i, err := strconv.Atoi(v); err == nil {
+			return cbpb.Build_Status(i), nil
+		}
+		return 0, fmt.Errorf("unknown build status %q", v)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cbpb.Build_Status(rv.Int()), nil
+	}
+	return 0, fmt.Errorf("cannot convert %v (%T) to a build status", v, v)
+}
+
+func statusName(v interface{}) (string, error) {
+	s, err := toStatus(v)
+	if err != nil {
+		return "", err
+	}
+	return s.String(), nil
+}
+
+func statusEmoji(v interface{}) (string, error) {
+	s, err := toStatus(v)
+	if err != nil {
+		return "", err
+	}
+	if e, ok := statusEmojis[s]; ok {
+		return e, nil
+	}
+	return statusEmojis[cbpb.Build_STATUS_UNKNOWN], nil
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case *timestamppb.Timestamp:
+		if v == nil {
+			return time.Time{}, nil
+		}
+		return v.AsTime(), nil
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %v (%T) to a time", v, v)
+}
+
+func toDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case *durationpb.Duration:
+		return v.AsDuration(), nil
+	case time.Duration:
+		return v, nil
+	case string:
+		return time.ParseDuration(v)
+	}
+	return 0, fmt.Errorf("cannot convert %v (%T) to a duration", v, v)
+}
+
+func duration(start, end interface{}) (string, error) {
+	s, err := toTime(start)
+	if err != nil {
+		return "", err
+	}
+	e, err := toTime(end)
+	if err != nil {
+		return "", err
+	}
+	if s.IsZero() || e.IsZero() {
+		return "", nil
+	}
+	return e.Sub(s).Round(time.Second).String(), nil
+}
+
+func formatDuration(v interface{}) (string, error) {
+	d, err := toDuration(v)
+	if err != nil {
+		return "", err
+	}
+	return d.Round(time.Second).String(), nil
+}
+
+var timeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+}
+
+func formatTime(layout, zone string, v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	if t.IsZero() {
+		return "", nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return "", fmt.Errorf("failed to load time zone %q: %w", zone, err)
+	}
+	if l, ok := timeLayouts[layout]; ok {
+		layout = l
+	}
+	return t.In(loc).Format(layout), nil
+}
+
+func jsonEscape(s string) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b[1 : len(b)-1]), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	var b []byte
+	var err error
+	switch v := v.(type) {
+	case *BuildView:
+		b, err = protojson.Marshal(v.Build)
+	case proto.Message:
+		b, err = protojson.Marshal(v)
+	default:
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %T as JSON: %w", v, err)
+	}
+	return string(b), nil
+}
+
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	htmlTemplate "html/template"
+	"testing"
+	textTemplate "text/template"
+	"time"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	start := time.Date(2024, 3, 10, 6, 59, 30, 0, time.UTC)
+	view := &TemplateView{
+		Build: &BuildView{&cbpb.Build{
+			Id:         "some-build-id",
+			Status:     cbpb.Build_SUCCESS,
+			StartTime:  timestamppb.New(start),
+			FinishTime: timestamppb.New(start.Add(83*time.Second + 400*time.Millisecond)),
+			Timeout:    durationpb.New(10 * time.Minute),
+			Substitutions: map[string]string{
+				"COMMIT_SHA":      "abc123",
+				"_COMMIT_MESSAGE": "Fix the \"flaky\" test\nand more",
+			},
+		}},
+		Params: map[string]string{"status": "FAILURE"},
+	}
+
+	for _, tc := range []struct {
+		tmpl string
+		want string
+	}{
+		{`{{ replace "a-b-c" "-" "." }}`, "a.b.c"},
+		{`{{ "hello world" | truncate 5 }}`, "hell…"},
+		{`{{ "hello" | truncate 5 }}`, "hello"},
+		{`{{ status .Build.Status }}`, "SUCCESS"},
+		{`{{ if eq (status .Build.Status) "SUCCESS" }}yes{{ end }}`, "yes"},
+		{`{{ statusEmoji .Build.Status }} {{ statusEmoji .Params.status }} {{ statusEmoji 6 }}`, "✅ ❌ ⏱️"},
+		{`{{ duration .Build.StartTime .Build.FinishTime }}`, "1m23s"},
+		{`{{ duration .Build.StartTime .Build.CreateTime }}`, ""},
+		{`{{ formatDuration .Build.Timeout }}`, "10m0s"},
+		{`{{ .Build.StartTime | formatTime "2006-01-02 15:04 MST" "America/New_York" }}`, "2024-03-10 01:59 EST"},
+		{`{{ .Build.FinishTime | formatTime "RFC3339" "" }}`, "2024-03-10T07:00:53Z"},
+		{`"{{ jsonEscape .Build.Substitutions._COMMIT_MESSAGE }}"`, `"Fix the \"flaky\" test\nand more"`},
+		{`{{ toJson .Params }}`, `{"status":"FAILURE"}`},
+		{`{{ .Params.missing | default "none" }} {{ .Params.status | default "none" }}`, "none FAILURE"},
+		{`{{ .Build.Substitutions._COMMIT_MESSAGE | default .Build.Substitutions.COMMIT_SHA | truncate 7 }}`, "Fix th…"},
+	} {
+		tmpl, err := textTemplate.New("").Funcs(TemplateFuncs()).Parse(tc.tmpl)
+		if err != nil {
+			t.Fatalf("failed to parse template %q: %v", tc.tmpl, err)
+		}
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, view); err != nil {
+			t.Fatalf("failed to execute template %q: %v", tc.tmpl, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("template %q got %q, want %q", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestTemplateFuncsToJSONBuild(t *testing.T) {
+	tmpl := textTemplate.Must(textTemplate.New("").Funcs(TemplateFuncs()).Parse(`{{ toJson .Build }}`))
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, &TemplateView{Build: &BuildView{&cbpb.Build{Id: "b1", Status: cbpb.Build_FAILURE}}}); err != nil {
+		t.Fatalf("failed to execute template: %v", err)
+	}
+	// protojson output is not byte-for-byte stable, so only check that it is a Build.
+	if got := buf.String(); !bytes.Contains(buf.Bytes(), []byte(`"b1"`)) || !bytes.Contains(buf.Bytes(), []byte(`"FAILURE"`)) {
+		t.Errorf("toJson .Build = %q, want the Build's JSON", got)
+	}
+}
+
+func TestTemplateFuncsHTML(t *testing.T) {
+	if _, err := htmlTemplate.New("").Funcs(TemplateFuncs()).Parse(`{{ statusEmoji .Build.Status }}`); err != nil {
+		t.Errorf("TemplateFuncs() cannot be used with html/template: %v", err)
+	}
+}
+
+func TestTemplateFuncsErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		`{{ status "NOT_A_STATUS" }}`,
+		`{{ formatTime "RFC3339" "Not/AZone" .Build.StartTime }}`,
+		`{{ formatDuration 3 }}`,
+	} {
+		tpl := textTemplate.Must(textTemplate.New("").Funcs(TemplateFuncs()).Parse(tmpl))
+		view := &TemplateView{Build: &BuildView{&cbpb.Build{StartTime: timestamppb.Now()}}}
+		if err := tpl.Execute(new(bytes.Buffer), view); err == nil {
+			t.Errorf("template %q unexpectedly succeeded", tmpl)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+
+// Span attribute keys.
+const (
+	buildIDKey      = attribute.Key("cloudbuild.build.id")
+	buildStatusKey  = attribute.Key("cloudbuild.build.status")
+	notifierKindKey = attribute.Key("notifier.kind")
+	messageIDKey    = attribute.Key("messaging.message.id")
+	ruleKey         = attribute.Key("notifier.rule")
+)
+
+// HTTPClient is the http.Client that notifiers should use for outbound requests, such as webhook deliveries. It
+// records a span for every request and propagates the W3C trace context of the request's context in its headers.
+var HTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// StartSpan starts a span with the given name, whose attributes are the ID and status of the Build (if it is non-nil)
+// and the notifier kind of the notification rule that the context is sending for. End it with EndSpan.
+// Spans are only recorded if an exporter is configured with OTEL_TRACES_EXPORTER.
+func StartSpan(ctx context.Context, name string, build *cbpb.Build) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{notifierKindKey.String(deliveryFrom(ctx).kind)}
+	if build != nil {
+		attrs = append(attrs, buildIDKey.String(build.GetId()), buildStatusKey.String(build.GetStatus().String()))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan marks the span as failed if err is non-nil, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setBuildAttributes adds the ID and status of the Build to the span.
+func setBuildAttributes(span trace.Span, build *cbpb.Build) {
+	span.SetAttributes(buildIDKey.String(build.GetId()), buildStatusKey.String(build.GetStatus().String()))
+}
+
+// setUpTracing installs the W3C trace context propagator and, depending on OTEL_TRACES_EXPORTER, a tracer provider
+// that exports spans over OTLP (`otlp`, configured with the standard OTEL_EXPORTER_OTLP_* variables) or to stdout
+// (`console` or `stdout`). By default (or with `none`), no spans are recorded. The returned function flushes any
+// buffered spans.
+func setUpTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch name, _ := GetEnv("OTEL_TRACES_EXPORTER"); name {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "console", "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("expected OTEL_TRACES_EXPORTER %q to be one of otlp, console, stdout or none", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// resource.Default reads OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(resource.Default()))
+	otel.SetTracerProvider(tp)
+	V(2).Infof(ctx, "exporting traces with %T", exp)
+	return tp.Shutdown, nil
+}
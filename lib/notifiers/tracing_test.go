@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// tracingNotifier filters, renders and POSTs every Build to url, like a webhook notifier.
+type tracingNotifier struct {
+	filter EventFilter
+	url    string
+}
+
+func (n *tracingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (n *tracingNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if !n.filter.Apply(ctx, build) {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	tmpl := template.Must(template.New("").Parse(`{{.Build.Id}}`))
+	if err := ExecuteTemplate(ctx, buf, tmpl, &TemplateView{Build: &BuildView{Build: build}}); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, buf)
+	if err != nil {
+		return err
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// recordSpans installs a tracer provider that records every span, until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	if _, err := setUpTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func TestReceiverTracing(t *testing.T) {
+	sr := recordSpans(t)
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	pred, err := MakeCELPredicate(`build.status == Build.Status.SUCCESS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &rule{name: "test[0]", cfg: &Config{Kind: "TestTraceNotifier"}, Notifier: &tracingNotifier{filter: pred, url: srv.URL}}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t)))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	newReceiver(rl, &receiverParams{})(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		if got := s.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q has trace ID %s, want the request's %s", s.Name(), got, traceID)
+		}
+		spans[s.Name()] = s
+	}
+	for _, name := range []string{"notifiers.receive", "notifiers.send", "notifiers.filter", "notifiers.render"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("missing span %q, got %v", name, sr.Ended())
+			continue
+		}
+		attrs := attribute.NewSet(s.Attributes()...)
+		if v, _ := attrs.Value(buildIDKey); v.AsString() != "some-build-id" {
+			t.Errorf("span %q has build ID %q, want %q", name, v.AsString(), "some-build-id")
+		}
+		if v, _ := attrs.Value(buildStatusKey); v.AsString() != "SUCCESS" {
+			t.Errorf("span %q has build status %q, want %q", name, v.AsString(), "SUCCESS")
+		}
+		if name == "notifiers.receive" {
+			continue
+		}
+		if v, _ := attrs.Value(notifierKindKey); v.AsString() != "TestTraceNotifier" {
+			t.Errorf("span %q has notifier kind %q, want %q", name, v.AsString(), "TestTraceNotifier")
+		}
+	}
+	if send, receive := spans["notifiers.send"], spans["notifiers.receive"]; send != nil && receive != nil && send.Parent().SpanID() != receive.SpanContext().SpanID() {
+		t.Error("send span is not a child of the receive span")
+	}
+
+	if !strings.Contains(traceparent, traceID) {
+		t.Errorf("delivery got traceparent %q, want one of trace %s", traceparent, traceID)
+	}
+}
+
+func TestSetUpTracing(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	for _, tc := range []struct {
+		exporter string
+		wantErr  bool
+	}{
+		{exporter: ""},
+		{exporter: "none"},
+		{exporter: "console"},
+		{exporter: "stdout"},
+		{exporter: "otlp"},
+		{exporter: "jaeger", wantErr: true},
+	} {
+		t.Run(tc.exporter, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_EXPORTER", tc.exporter)
+			shutdown, err := setUpTracing(context.Background())
+			if err != nil {
+				if tc.wantErr {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("setUpTracing got unexpected error: %v", err)
+			}
+			if tc.wantErr {
+				t.Fatal("setUpTracing unexpectedly succeeded")
+			}
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("shutdown got unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEndSpan(t *testing.T) {
+	sr := recordSpans(t)
+
+	_, span := StartSpan(context.Background(), "ok", nil)
+	EndSpan(span, nil)
+	_, span = StartSpan(context.Background(), "failed", &cbpb.Build{Id: "some-build-id"})
+	EndSpan(span, io.ErrUnexpectedEOF)
+
+	ended := sr.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("got %d ended spans, want 2", len(ended))
+	}
+	if got := ended[0].Status().Code.String(); got != "Unset" {
+		t.Errorf("span without error has status %s, want Unset", got)
+	}
+	if got := ended[1].Status().Code.String(); got != "Error" {
+		t.Errorf("span with error has status %s, want Error", got)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package slacknotifier implements a Cloud Build notifier that posts Build updates to a Slack webhook.
+package slacknotifier
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+	"github.com/slack-go/slack"
+)
+
+const (
+	webhookURLSecretName = "webhookUrl"
+)
+
+// Kind is the Config `kind` that the Slack notifier is registered under.
+const Kind = "SlackNotifier"
+
+// deliverySchema is the JSON Schema for the `delivery` of `cloud-build-notifiers/v2` configs of this Kind.
+//
+//go:embed delivery.schema.json
+var deliverySchema []byte
+
+func init() {
+	notifiers.Register(Kind, New)
+	notifiers.RegisterDeliverySchema(Kind, deliverySchema)
+}
+
+// New returns a new Slack notifier that has not been set up yet.
+func New() notifiers.Notifier {
+	return new(slackNotifier)
+}
+
+type slackNotifier struct {
+	filter     notifiers.EventFilter
+	tmpl       *template.Template
+	webhookURL string
+	br         notifiers.BindingResolver
+	retry      *notifiers.RetryPolicy
+}
+
+func (s *slackNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, blockKitTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
+	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
+	if err != nil {
+		return fmt.Errorf("failed to make a CEL predicate: %w", err)
+	}
+	s.filter = prd
+
+	rp, err := notifiers.NewRetryPolicy(cfg.Spec.Notification.Retry)
+	if err != nil {
+		return fmt.Errorf("failed to configure retries: %w", err)
+	}
+	s.retry = rp
+
+	wuRef, err := notifiers.GetSecretRef(cfg.Spec.Notification.Delivery, webhookURLSecretName)
+	if err != nil {
+		return fmt.Errorf("failed to get Secret ref from delivery config (%v) field %q: %w", cfg.Spec.Notification.Delivery, webhookURLSecretName, err)
+	}
+	wuResource, err := notifiers.FindSecretResourceName(cfg.Spec.Secrets, wuRef)
+	if err != nil {
+		return fmt.Errorf("failed to find Secret for ref %q: %w", wuRef, err)
+	}
+	wu, err := sg.GetSecret(ctx, wuResource)
+	if err != nil {
+		return fmt.Errorf("failed to get token secret: %w", err)
+	}
+	s.webhookURL = wu
+	tmpl, err := template.New("blockkit_template").Funcs(notifiers.TemplateFuncs()).Parse(blockKitTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse Block Kit template: %w", err)
+	}
+
+	s.tmpl = tmpl
+	s.br = br
+
+	return nil
+}
+
+func (s *slackNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+
+	if !s.filter.Apply(ctx, build) {
+		return nil
+	}
+
+	notifiers.Infof(ctx, "sending Slack webhook for Build %q (status: %q)", build.Id, build.Status)
+
+	msg, err := s.message(ctx, build)
+	if err != nil {
+		return err
+	}
+
+	return s.retry.Do(ctx, func(ctx context.Context) error {
+		if err := slack.PostWebhookCustomHTTPContext(ctx, s.webhookURL, notifiers.HTTPClient, msg); err != nil {
+			return classifyWebhookError(fmt.Errorf("failed to post Slack webhook: %w", err))
+		}
+		return nil
+	})
+}
+
+// Render returns the JSON of the webhook message that SendNotification would post for the Build, regardless of the
+// filter.
+func (s *slackNotifier) Render(ctx context.Context, build *cbpb.Build) (string, error) {
+	msg, err := s.message(ctx, build)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Slack message: %w", err)
+	}
+	return string(payload), nil
+}
+
+// message resolves the bindings of the Build and writes its webhook message.
+func (s *slackNotifier) message(ctx context.Context, build *cbpb.Build) (*slack.WebhookMessage, error) {
+	bindings, err := s.br.Resolve(ctx, nil, build)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve bindings: %w", err)
+	}
+
+	view := &notifiers.TemplateView{
+		Build:      &notifiers.BuildView{Build: build},
+		Params:     bindings,
+		Message:    notifiers.MessageFrom(ctx),
+		Suppressed: notifiers.SuppressedFrom(ctx),
+	}
+
+	msg, err := s.writeMessage(ctx, view)
+	if err != nil {
+		return nil, notifiers.Permanent(fmt.Errorf("failed to write Slack message: %w", err))
+	}
+	return msg, nil
+}
+
+// classifyWebhookError marks errors for Slack's non-OK responses as permanent or retryable, depending on the status.
+// Other errors, such as network errors, are left unclassified, i.e. retryable.
+func classifyWebhookError(err error) error {
+	var sce slack.StatusCodeError
+	if errors.As(err, &sce) {
+		return notifiers.ClassifyHTTPStatus(sce.Code, err)
+	}
+	var rle *slack.RateLimitedError
+	if errors.As(err, &rle) {
+		return &notifiers.RetryableError{Err: err, RetryAfter: rle.RetryAfter}
+	}
+	return err
+}
+
+func (s *slackNotifier) writeMessage(ctx context.Context, view *notifiers.TemplateView) (*slack.WebhookMessage, error) {
+	build := view.Build
+	_, err := notifiers.AddUTMParams(build.LogUrl, notifiers.ChatMedium)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to add UTM params: %w", err)
+	}
+
+	var clr string
+	switch build.Status {
+	case cbpb.Build_SUCCESS:
+		clr = "#22bb33"
+	case cbpb.Build_FAILURE, cbpb.Build_INTERNAL_ERROR, cbpb.Build_TIMEOUT:
+		clr = "#bb2124"
+	default:
+		clr = "#f0ad4e"
+	}
+
+	var buf bytes.Buffer
+	if err := notifiers.ExecuteTemplate(ctx, &buf, s.tmpl, view); err != nil {
+		return nil, err
+	}
+	var blocks slack.Blocks
+
+	err = blocks.UnmarshalJSON(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal templating JSON: %w", err)
+	}
+
+	return &slack.WebhookMessage{Attachments: []slack.Attachment{{Color: clr, Blocks: blocks}}}, nil
+}
@@ -1,6 +1,7 @@
-package main
+package slacknotifier
 
 import (
+	"context"
 	"testing"
 	"text/template"
 	"strings"
@@ -76,9 +77,7 @@ func TestWriteMessage(t *testing.T) {
 	}
 
 	n.tmpl = tmpl
-	n.tmplView = &notifiers.TemplateView{Build: &notifiers.BuildView{Build: build}}
-
-	got, err := n.writeMessage()
+	got, err := n.writeMessage(context.Background(), &notifiers.TemplateView{Build: &notifiers.BuildView{Build: build}})
 	if err != nil {
 		t.Fatalf("writeMessage failed: %v", err)
 	}
@@ -0,0 +1,288 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package smtpnotifier implements a Cloud Build notifier that sends Build updates as emails via an SMTP server.
+package smtpnotifier
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	textTemplate "text/template"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+
+	cbpb "cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
+	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+const (
+	contentType = "text/html"
+)
+
+// Kind is the Config `kind` that the SMTP notifier is registered under.
+const Kind = "SMTPNotifier"
+
+// deliverySchema is the JSON Schema for the `delivery` of `cloud-build-notifiers/v2` configs of this Kind.
+//
+//go:embed delivery.schema.json
+var deliverySchema []byte
+
+func init() {
+	notifiers.Register(Kind, New)
+	notifiers.RegisterDeliverySchema(Kind, deliverySchema)
+}
+
+// New returns a new SMTP notifier that has not been set up yet.
+func New() notifiers.Notifier {
+	return new(smtpNotifier)
+}
+
+type smtpNotifier struct {
+	filter   notifiers.EventFilter
+	htmlTmpl *htmlTemplate.Template
+	textTmpl *textTemplate.Template
+	mcfg     mailConfig
+	br       notifiers.BindingResolver
+	retry    *notifiers.RetryPolicy
+}
+
+type mailConfig struct {
+	server, port, sender, from, password, subject string
+	recipients                                    []string
+}
+
+func (s *smtpNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, cfgTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
+	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
+	if err != nil {
+		return fmt.Errorf("failed to create CELPredicate: %w", err)
+	}
+	s.filter = prd
+
+	rp, err := notifiers.NewRetryPolicy(cfg.Spec.Notification.Retry)
+	if err != nil {
+		return fmt.Errorf("failed to configure retries: %w", err)
+	}
+	s.retry = rp
+	htmlTmpl, err := htmlTemplate.New("email_template").Funcs(notifiers.TemplateFuncs()).Parse(cfgTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse HTML email template: %w", err)
+	}
+	s.htmlTmpl = htmlTmpl
+
+	if subject, subjectFound := cfg.Spec.Notification.Delivery["subject"]; subjectFound {
+		textTmpl, err := textTemplate.New("subject_template").Funcs(notifiers.TemplateFuncs()).Parse(subject.(string))
+		if err != nil {
+			return fmt.Errorf("failed to parse TEXT subject template: %w", err)
+		}
+		s.textTmpl = textTmpl
+	}
+
+	mcfg, err := getMailConfig(ctx, sg, cfg.Spec)
+	if err != nil {
+		return fmt.Errorf("failed to construct a mail delivery config: %w", err)
+	}
+	s.mcfg = mcfg
+	s.br = br
+	return nil
+}
+
+func getMailConfig(ctx context.Context, sg notifiers.SecretGetter, spec *notifiers.Spec) (mailConfig, error) {
+	delivery := spec.Notification.Delivery
+
+	server, ok := delivery["server"].(string)
+	if !ok {
+		return mailConfig{}, fmt.Errorf("expected delivery config %v to have string field `server`", delivery)
+	}
+	port, ok := delivery["port"].(string)
+	if !ok {
+		return mailConfig{}, fmt.Errorf("expected delivery config %v to have string field `port`", delivery)
+	}
+	sender, ok := delivery["sender"].(string)
+	if !ok {
+		return mailConfig{}, fmt.Errorf("expected delivery config %v to have string field `sender`", delivery)
+	}
+
+	from, ok := delivery["from"].(string)
+	if !ok {
+		return mailConfig{}, fmt.Errorf("expected delivery config %v to have string field `from`", delivery)
+	}
+
+	ris, ok := delivery["recipients"].([]interface{})
+	if !ok {
+		return mailConfig{}, fmt.Errorf("expected delivery config %v to have repeated field `recipients`", delivery)
+	}
+
+	recipients := make([]string, 0, len(ris))
+	for _, ri := range ris {
+		r, ok := ri.(string)
+		if !ok {
+			return mailConfig{}, fmt.Errorf("failed to convert recipient (%v) into a string", ri)
+		}
+		recipients = append(recipients, r)
+	}
+
+	passwordRef, err := notifiers.GetSecretRef(delivery, "password")
+	if err != nil {
+		return mailConfig{}, fmt.Errorf("failed to get ref for secret field `password`: %w", err)
+	}
+
+	passwordResource, err := notifiers.FindSecretResourceName(spec.Secrets, passwordRef)
+	if err != nil {
+		return mailConfig{}, fmt.Errorf("failed to find Secret resource name for reference %q: %w", passwordRef, err)
+	}
+
+	password, err := sg.GetSecret(ctx, passwordResource)
+	if err != nil {
+		return mailConfig{}, fmt.Errorf("failed to get SMTP password: %w", err)
+	}
+
+	return mailConfig{
+		server:     server,
+		port:       port,
+		sender:     sender,
+		from:       from,
+		password:   password,
+		recipients: recipients,
+	}, nil
+}
+
+func (s *smtpNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if !s.filter.Apply(ctx, build) {
+		notifiers.V(2).Infof(ctx, "no mail for event:\n%s", prototext.Format(build))
+		return nil
+	}
+	view := s.view(ctx, build)
+	notifiers.Infof(ctx, "sending email for (build id = %q, status = %s)", build.GetId(), build.GetStatus())
+	return s.sendSMTPNotification(ctx, view)
+}
+
+// Render returns the email (headers and encoded body) that SendNotification would send for the Build, regardless of
+// the filter.
+func (s *smtpNotifier) Render(ctx context.Context, build *cbpb.Build) (string, error) {
+	email, err := s.buildEmail(ctx, s.view(ctx, build))
+	if err != nil {
+		return "", notifiers.Permanent(fmt.Errorf("failed to build email: %w", err))
+	}
+	return email, nil
+}
+
+// view resolves the bindings of the Build and returns the view that the templates are executed with.
+func (s *smtpNotifier) view(ctx context.Context, build *cbpb.Build) *notifiers.TemplateView {
+	bindings, err := s.br.Resolve(ctx, nil, build)
+	if err != nil {
+		notifiers.Errorf(ctx, "failed to resolve bindings :%v", err)
+	}
+	return &notifiers.TemplateView{
+		Build:      &notifiers.BuildView{Build: build},
+		Params:     bindings,
+		Message:    notifiers.MessageFrom(ctx),
+		Suppressed: notifiers.SuppressedFrom(ctx),
+	}
+}
+
+func (s *smtpNotifier) sendSMTPNotification(ctx context.Context, view *notifiers.TemplateView) error {
+	email, err := s.buildEmail(ctx, view)
+	if err != nil {
+		return notifiers.Permanent(fmt.Errorf("failed to build email: %w", err))
+	}
+
+	addr := fmt.Sprintf("%s:%s", s.mcfg.server, s.mcfg.port)
+	auth := smtp.PlainAuth("", s.mcfg.sender, s.mcfg.password, s.mcfg.server)
+
+	err = s.retry.Do(ctx, func(context.Context) error {
+		if err := smtp.SendMail(addr, auth, s.mcfg.from, s.mcfg.recipients, []byte(email)); err != nil {
+			return classifySMTPError(fmt.Errorf("failed to send email: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	notifiers.V(2).Infof(ctx, "email sent successfully")
+	return nil
+}
+
+// classifySMTPError marks errors for permanent negative SMTP replies (5xx codes, e.g. for rejected credentials or
+// recipients) as permanent and transient ones (4xx codes) as retryable. Other errors, such as network errors, are left
+// unclassified, i.e. retryable.
+func classifySMTPError(err error) error {
+	var tpe *textproto.Error
+	if !errors.As(err, &tpe) {
+		return err
+	}
+	if tpe.Code >= 500 {
+		return notifiers.Permanent(err)
+	}
+	return notifiers.Retryable(err)
+}
+
+func (s *smtpNotifier) buildEmail(ctx context.Context, view *notifiers.TemplateView) (string, error) {
+	build := view.Build
+	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.EmailMedium)
+	if err != nil {
+		return "", fmt.Errorf("failed to add UTM params: %w", err)
+	}
+	build.LogUrl = logURL
+
+	body := new(bytes.Buffer)
+	if err := notifiers.ExecuteTemplate(ctx, body, s.htmlTmpl, view); err != nil {
+		return "", err
+	}
+
+	subject := fmt.Sprintf("Cloud Build [%s]: %s", build.ProjectId, build.Id)
+	if s.textTmpl != nil {
+		subjectTmpl := new(bytes.Buffer)
+		if err := notifiers.ExecuteTemplate(ctx, subjectTmpl, s.textTmpl, view); err != nil {
+			return "", err
+		}
+
+		// Escape any string formatter
+		subject = strings.Join(strings.Fields(subjectTmpl.String()), " ")
+	}
+
+	header := make(map[string]string)
+	if s.mcfg.from != s.mcfg.sender {
+		header["Sender"] = s.mcfg.sender
+	}
+	header["From"] = s.mcfg.from
+	header["To"] = strings.Join(s.mcfg.recipients, ",")
+	header["Subject"] = subject
+	header["MIME-Version"] = "1.0"
+	header["Content-Type"] = fmt.Sprintf(`%s; charset="utf-8"`, contentType)
+	header["Content-Transfer-Encoding"] = "quoted-printable"
+	header["Content-Disposition"] = "inline"
+
+	var msg string
+	for key, value := range header {
+		msg += fmt.Sprintf("%s: %s\r\n", key, value)
+	}
+
+	encoded := new(bytes.Buffer)
+	finalMsg := quotedprintable.NewWriter(encoded)
+	finalMsg.Write(body.Bytes())
+	if err := finalMsg.Close(); err != nil {
+		return "", fmt.Errorf("failed to close MIME writer: %w", err)
+	}
+
+	msg += "\r\n" + encoded.String()
+
+	return msg, nil
+}